@@ -0,0 +1,442 @@
+package main
+
+import (
+	"fmt"
+
+	uuid "github.com/pborman/uuid"
+	"gopkg.in/yaml.v2"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+// secretSpec is a declarative list of the secrets that something (usually a
+// deployment) needs, along with how to generate each of them.
+type secretSpec struct {
+	Secrets []specEntry `yaml:"secrets"`
+}
+
+// specEntry describes a single generated secret.  Passwords, passphrases,
+// UUIDs and formatted values live in one key of a secret, so their paths
+// must name that key; keypairs, Diffie-Hellman parameters and certificates
+// take up a whole secret, so theirs must not.
+type specEntry struct {
+	Path string `yaml:"path"`
+	Type string `yaml:"type"`
+
+	//password
+	Length      int    `yaml:"length"`
+	Policy      string `yaml:"policy"`
+	Preset      string `yaml:"preset"`
+	MinLower    int    `yaml:"min_lower"`
+	MinUpper    int    `yaml:"min_upper"`
+	MinDigits   int    `yaml:"min_digits"`
+	MinSymbols  int    `yaml:"min_symbols"`
+	NoAmbiguous bool   `yaml:"no_ambiguous"`
+	NotFirst    string `yaml:"not_first"`
+
+	//passphrase
+	Words      int    `yaml:"words"`
+	Separator  string `yaml:"separator"`
+	Capitalize bool   `yaml:"capitalize"`
+	Digit      bool   `yaml:"digit"`
+
+	//ssh, rsa, dhparam and x509
+	Bits int `yaml:"bits"`
+
+	//fmt
+	Format string `yaml:"format"`
+	From   string `yaml:"from"`
+
+	//x509
+	CA           bool     `yaml:"ca"`
+	SignedBy     string   `yaml:"signed_by"`
+	Subject      string   `yaml:"subject"`
+	Names        []string `yaml:"names"`
+	TTL          string   `yaml:"ttl"`
+	KeyUsage     []string `yaml:"key_usage"`
+	SigAlgorithm string   `yaml:"sig_algorithm"`
+
+	secret    string
+	key       string
+	dependsOn string
+	password  vault.PasswordPolicy
+}
+
+// specAction is something that applying a spec will do: generate an entry
+// that does not exist yet, or regenerate one that does.
+type specAction struct {
+	entry  *specEntry
+	rotate bool
+	reason string
+}
+
+// parseSecretSpec parses and validates a spec, filling in the same defaults
+// that the equivalent commands use.
+func parseSecretSpec(b []byte) (*secretSpec, error) {
+	var spec secretSpec
+	if err := yaml.UnmarshalStrict(b, &spec); err != nil {
+		return nil, err
+	}
+
+	index := map[string]int{}
+	for i := range spec.Secrets {
+		e := &spec.Secrets[i]
+		if e.Path == "" {
+			return nil, fmt.Errorf("secret #%d has no path", i+1)
+		}
+		if err := e.validate(); err != nil {
+			return nil, fmt.Errorf("secret `%s': %s", e.Path, err)
+		}
+		if _, dup := index[e.Path]; dup {
+			return nil, fmt.Errorf("secret `%s' is listed more than once", e.Path)
+		}
+		index[e.Path] = i
+	}
+
+	//Anything that is derived from another entry has to come after it, so
+	// that a single pass through the spec always generates things in the
+	// right order.
+	for i, e := range spec.Secrets {
+		if e.dependsOn == "" {
+			continue
+		}
+		if j, found := index[e.dependsOn]; found && j > i {
+			return nil, fmt.Errorf("secret `%s' depends on `%s', so it must come after it in the spec", e.Path, e.dependsOn)
+		}
+		if e.Type == "x509" {
+			if j, found := index[e.dependsOn]; found && !(spec.Secrets[j].Type == "x509" && spec.Secrets[j].CA) {
+				return nil, fmt.Errorf("secret `%s' is signed by `%s', which is not a certificate authority", e.Path, e.dependsOn)
+			}
+		}
+	}
+
+	return &spec, nil
+}
+
+func (e *specEntry) validate() error {
+	var version uint64
+	e.secret, e.key, version = vault.ParsePath(e.Path)
+	if version != 0 {
+		return fmt.Errorf("paths cannot have versions")
+	}
+	e.secret = vault.Canonicalize(e.secret)
+	e.Path = vault.EncodePath(e.secret, e.key, 0)
+
+	switch e.Type {
+	case "password", "passphrase", "uuid", "fmt":
+		if e.key == "" {
+			return fmt.Errorf("%s secrets need a path with a key (like `%s:%s')", e.Type, e.Path, e.Type)
+		}
+	case "ssh", "rsa", "dhparam", "x509":
+		if e.key != "" {
+			return fmt.Errorf("%s secrets take up a whole secret, so the path cannot have a key", e.Type)
+		}
+	case "":
+		return fmt.Errorf("no type given")
+	default:
+		return fmt.Errorf("unrecognized type `%s'", e.Type)
+	}
+
+	switch e.Type {
+	case "password":
+		if e.Length == 0 {
+			e.Length = 64
+		}
+		e.password = vault.PasswordPolicy{Chars: "a-zA-Z0-9"}
+		if e.Preset != "" {
+			var err error
+			if e.password, err = vault.PasswordPreset(e.Preset); err != nil {
+				return err
+			}
+		}
+		e.password = e.password.Override(vault.PasswordPolicy{
+			Chars:       e.Policy,
+			MinLower:    e.MinLower,
+			MinUpper:    e.MinUpper,
+			MinDigits:   e.MinDigits,
+			MinSymbols:  e.MinSymbols,
+			NoAmbiguous: e.NoAmbiguous,
+			NotFirst:    e.NotFirst,
+		})
+		if _, err := e.password.Generate(e.Length); err != nil {
+			return err
+		}
+
+	case "passphrase":
+		if e.Words == 0 {
+			e.Words = 6
+		}
+		if e.Separator == "" {
+			e.Separator = " "
+		}
+
+	case "ssh", "rsa", "dhparam":
+		if e.Bits == 0 {
+			e.Bits = 2048
+		}
+
+	case "fmt":
+		switch e.Format {
+		case "base64", "bcrypt", "crypt-md5", "crypt-sha256", "crypt-sha512":
+		case "":
+			return fmt.Errorf("no format given")
+		default:
+			return fmt.Errorf("unrecognized format `%s'", e.Format)
+		}
+		if e.From == "" {
+			return fmt.Errorf("no key given to format the value of (from)")
+		}
+		e.dependsOn = vault.EncodePath(e.secret, e.From, 0)
+
+	case "x509":
+		if len(e.Names) == 0 {
+			return fmt.Errorf("certificates need at least one name")
+		}
+		if e.Subject == "" {
+			e.Subject = fmt.Sprintf("CN=%s", e.Names[0])
+		}
+		if e.Bits == 0 {
+			e.Bits = 4096
+		}
+		if len(e.KeyUsage) == 0 {
+			e.KeyUsage = []string{"server_auth", "client_auth"}
+			if e.CA {
+				e.KeyUsage = append(e.KeyUsage, "key_cert_sign", "crl_sign")
+			}
+		}
+		if e.TTL == "" {
+			e.TTL = "2y"
+			if e.CA {
+				e.TTL = "10y"
+			}
+		}
+		if _, err := duration(e.TTL); err != nil {
+			return err
+		}
+		if e.SignedBy != "" {
+			if vault.PathHasKey(e.SignedBy) {
+				return fmt.Errorf("signed_by must be the path of a certificate authority, not a key")
+			}
+			e.dependsOn = vault.Canonicalize(e.SignedBy)
+		}
+	}
+	return nil
+}
+
+// presentIn returns true if the entry has already been generated in s.
+func (e *specEntry) presentIn(s *vault.Secret) bool {
+	switch e.Type {
+	case "ssh", "rsa":
+		return s.Has("private")
+	case "dhparam":
+		return s.Has("dhparam-pem")
+	case "x509":
+		return s.Has("certificate")
+	}
+	return s.Has(e.key)
+}
+
+// Plan works out what needs to be done to make the Vault match the spec.
+// Anything named in rotate (either by its full path, or by the path of the
+// secret it is kept in) is regenerated, as is anything derived from
+// something that is being generated or regenerated.  It also returns how many
+// entries are already present, and are left alone.
+func (spec *secretSpec) Plan(v *vault.Vault, rotate []string) ([]specAction, int, error) {
+	rotating := map[string]bool{}
+	for _, path := range rotate {
+		path = vault.Canonicalize(path)
+		found := false
+		for _, e := range spec.Secrets {
+			if e.Path == path || e.secret == path {
+				found = true
+			}
+		}
+		if !found {
+			return nil, 0, fmt.Errorf("cannot rotate `%s': it is not in the spec", path)
+		}
+		rotating[path] = true
+	}
+
+	secrets := map[string]*vault.Secret{}
+	changing := map[string]bool{}
+	actions := []specAction{}
+	unchanged := 0
+	for i := range spec.Secrets {
+		e := &spec.Secrets[i]
+		s, found := secrets[e.secret]
+		if !found {
+			var err error
+			s, err = v.Read(e.secret)
+			if err != nil && !vault.IsNotFound(err) {
+				return nil, 0, err
+			}
+			secrets[e.secret] = s
+		}
+
+		if e.dependsOn != "" && !spec.has(e.dependsOn) {
+			if err := spec.checkExternal(v, e); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		a := specAction{entry: e, rotate: true}
+		switch {
+		case rotating[e.Path] || rotating[e.secret]:
+			a.reason = "asked to rotate"
+		case !e.presentIn(s):
+			a.rotate = false
+		case changing[e.dependsOn]:
+			a.reason = fmt.Sprintf("%s is changing", e.dependsOn)
+		default:
+			unchanged++
+			continue
+		}
+
+		actions = append(actions, a)
+		changing[e.Path] = true
+	}
+	return actions, unchanged, nil
+}
+
+func (spec *secretSpec) has(path string) bool {
+	for _, e := range spec.Secrets {
+		if e.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// checkExternal makes sure that something the entry depends on, but which is
+// not in the spec itself, exists in the Vault.
+func (spec *secretSpec) checkExternal(v *vault.Vault, e *specEntry) error {
+	secret, key, _ := vault.ParsePath(e.dependsOn)
+	s, err := v.Read(secret)
+	if err != nil && !vault.IsNotFound(err) {
+		return err
+	}
+
+	switch {
+	case key != "" && !s.Has(key):
+		return fmt.Errorf("secret `%s' is formatted from `%s', which is neither in the Vault nor in the spec", e.Path, e.dependsOn)
+	case key == "" && !s.Has("certificate"):
+		return fmt.Errorf("secret `%s' is signed by `%s', which is neither in the Vault nor in the spec", e.Path, e.dependsOn)
+	}
+	return nil
+}
+
+// Apply (re)generates the entry, and writes it to the Vault.  If the entry is
+// only meant to be created, and someone else has created it since the plan was
+// made, it is left alone.
+func (a specAction) Apply(v *vault.Vault) error {
+	e := a.entry
+	if e.Type == "x509" {
+		return a.issue(v)
+	}
+
+	//Keypairs and parameters can be slow to generate, so they are only
+	// generated once, no matter how many times the write has to be retried.
+	var generated *vault.Secret
+	return v.Update(e.secret, func(s *vault.Secret) error {
+		if !a.rotate && e.presentIn(s) {
+			return vault.SkipWrite
+		}
+
+		switch e.Type {
+		case "password":
+			return s.PasswordWithPolicy(e.key, e.Length, e.password, false)
+
+		case "passphrase":
+			return s.Passphrase(e.key, vault.PassphrasePolicy{
+				Words:      e.Words,
+				Separator:  e.Separator,
+				Capitalize: e.Capitalize,
+				Digit:      e.Digit,
+			}, false)
+
+		case "uuid":
+			return s.Set(e.key, uuid.NewRandom().String(), false)
+
+		case "fmt":
+			err := s.Format(e.From, e.key, e.Format, false)
+			if vault.IsNotFound(err) {
+				return fmt.Errorf("%s:%s does not exist, cannot create %s encoded copy at %s", e.secret, e.From, e.Format, e.Path)
+			}
+			return err
+		}
+
+		if generated == nil {
+			generated = vault.NewSecret()
+			var err error
+			switch e.Type {
+			case "ssh":
+				err = generated.SSHKey(e.Bits, false)
+			case "rsa":
+				err = generated.RSAKey(e.Bits, false)
+			case "dhparam":
+				err = generated.DHParam(e.Bits, false)
+			}
+			if err != nil {
+				generated = nil
+				return err
+			}
+		}
+		return mergeSecret(s, generated)
+	})
+}
+
+// issue generates a new certificate (or certificate authority) for the entry,
+// the same way that `safe x509 issue' does.
+func (a specAction) issue(v *vault.Vault) error {
+	e := a.entry
+	if !a.rotate {
+		s, err := v.Read(e.secret)
+		if err != nil && !vault.IsNotFound(err) {
+			return err
+		}
+		if err == nil && e.presentIn(s) {
+			return nil
+		}
+	}
+
+	cert, err := vault.NewCertificate(e.Subject, uniq(e.Names), e.KeyUsage, e.SigAlgorithm, e.Bits)
+	if err != nil {
+		return err
+	}
+	if e.CA {
+		cert.MakeCA()
+	}
+
+	ttl, err := duration(e.TTL)
+	if err != nil {
+		return err
+	}
+
+	if e.dependsOn == "" {
+		if err := cert.Sign(cert, ttl); err != nil {
+			return err
+		}
+	} else {
+		err = v.RetryOnConflict(func() error {
+			secret, err := v.Read(e.dependsOn)
+			if err != nil {
+				return err
+			}
+
+			ca, err := secret.X509(true)
+			if err != nil {
+				return err
+			}
+
+			if err := ca.Sign(cert, ttl); err != nil {
+				return err
+			}
+			return ca.SaveTo(v, e.dependsOn, false)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return cert.SaveTo(v, e.secret, false)
+}
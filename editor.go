@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/jhunt/go-ansi"
+)
+
+var (
+	//toShred is every secret temporary file that is still around, so that
+	// exiting on a signal doesn't leave any of them behind
+	toShred   []string
+	shredLock sync.Mutex
+)
+
+// secretTempFile creates a temporary file, readable and writable only by the
+// current user, for holding secret material.  Memory-backed locations are
+// preferred so that the contents never touch a disk; if none are available,
+// the file is created in the usual temporary directory, with a warning.  The
+// file must be got rid of with shred(), which shredTempFiles() does for any
+// that are left when safe exits on a signal.
+func secretTempFile(pattern string) (*os.File, error) {
+	dirs := []string{}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		dirs = append(dirs, dir)
+	}
+	dirs = append(dirs, "/dev/shm", os.TempDir())
+
+	var err error
+	for _, dir := range dirs {
+		if st, statErr := os.Stat(dir); statErr != nil || !st.IsDir() {
+			continue
+		}
+
+		var f *os.File
+		f, err = ioutil.TempFile(dir, pattern)
+		if err != nil {
+			continue
+		}
+		if err = f.Chmod(0600); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			continue
+		}
+
+		shredLock.Lock()
+		toShred = append(toShred, f.Name())
+		shredLock.Unlock()
+		if dir == os.TempDir() {
+			ansi.Fprintf(os.Stderr, "@Y{Warning: no memory-backed directory is available, so the secret is being written to} @C{%s}@Y{, which is probably on disk}\n", f.Name())
+		}
+		return f, nil
+	}
+
+	if err == nil {
+		err = fmt.Errorf("no suitable directory found")
+	}
+	return nil, fmt.Errorf("Unable to create temporary file: %s", err)
+}
+
+// shred overwrites the contents of the given file with zeroes before removing
+// it, so that secret material does not linger in freed blocks.
+func shred(path string) {
+	shredLock.Lock()
+	defer shredLock.Unlock()
+	for i := range toShred {
+		if toShred[i] == path {
+			toShred = append(toShred[:i], toShred[i+1:]...)
+			break
+		}
+	}
+	shredFile(path)
+}
+
+// shredTempFiles shreds every secret temporary file that is still around.
+func shredTempFiles() {
+	shredLock.Lock()
+	defer shredLock.Unlock()
+	for _, path := range toShred {
+		shredFile(path)
+	}
+	toShred = nil
+}
+
+func shredFile(path string) {
+	if f, err := os.OpenFile(path, os.O_WRONLY, 0); err == nil {
+		if st, err := f.Stat(); err == nil {
+			f.Write(make([]byte, st.Size()))
+			f.Sync()
+		}
+		f.Close()
+	}
+	os.Remove(path)
+}
+
+// runEditor opens the given file in the user's preferred editor, as named by
+// $VISUAL or $EDITOR (falling back to vi), and waits for it to exit.
+func runEditor(path string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	args := strings.Fields(editor)
+	cmd := exec.Command(args[0], append(args[1:], path)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Editor `%s' failed: %s", editor, err)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Secret temporary files", func() {
+	var dir, xdg string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "safe-editor-test")
+		Expect(err).NotTo(HaveOccurred())
+		xdg = os.Getenv("XDG_RUNTIME_DIR")
+		os.Setenv("XDG_RUNTIME_DIR", dir)
+	})
+	AfterEach(func() {
+		os.Setenv("XDG_RUNTIME_DIR", xdg)
+		os.RemoveAll(dir)
+	})
+
+	create := func() string {
+		f, err := secretTempFile("safe-edit-*.yml")
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+		_, err = f.WriteString("password: sekrit\n")
+		Expect(err).NotTo(HaveOccurred())
+		return f.Name()
+	}
+
+	It("creates them where only the current user can read them", func() {
+		path := create()
+		defer shred(path)
+		Expect(filepath.Dir(path)).To(Equal(dir))
+		st, err := os.Stat(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(st.Mode().Perm()).To(Equal(os.FileMode(0600)))
+	})
+
+	It("gets rid of the ones still around when safe exits on a signal", func() {
+		kept, shredded := create(), create()
+		shred(shredded)
+		Expect(toShred).To(Equal([]string{kept}))
+
+		shredTempFiles()
+		Expect(toShred).To(BeEmpty())
+		files, err := ioutil.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(BeEmpty())
+	})
+})
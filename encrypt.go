@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/starkandwayne/safe/prompt"
+)
+
+// encryptedExport is the envelope that `safe export --encrypt' wraps an
+// export in.  The export (in whatever format it would otherwise have been
+// written in) is encrypted with AES-256-GCM, using a key derived from a
+// passphrase with scrypt.  Everything except the ciphertext is authenticated
+// along with it, so the parameters cannot be tampered with either.
+type encryptedExport struct {
+	Version    int    `json:"safe_encrypted_export"`
+	KDF        string `json:"kdf"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       []byte `json:"salt"`
+	Cipher     string `json:"cipher"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext,omitempty"`
+}
+
+const (
+	encryptedExportVersion = 1
+	scryptN                = 1 << 15
+	scryptR                = 8
+	scryptP                = 1
+
+	//Limits on the scrypt parameters of an export being decrypted, which
+	// leave room to raise the ones above later without letting a file make
+	// safe use more than 256MiB (scrypt needs 128*N*r bytes), or spend more
+	// than a few times as long as it needs to
+	scryptMaxMemory = 256 << 20
+	scryptMaxP      = 4
+)
+
+func (e encryptedExport) additionalData() []byte {
+	e.Ciphertext = nil
+	b, _ := json.Marshal(e)
+	return b
+}
+
+func (e encryptedExport) aead(passphrase string) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), e.Salt, e.N, e.R, e.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptExport encrypts an export with the given passphrase, and returns the
+// envelope, ready to be written out.
+func encryptExport(plaintext []byte, passphrase string) ([]byte, error) {
+	e := encryptedExport{
+		Version: encryptedExportVersion,
+		KDF:     "scrypt",
+		N:       scryptN,
+		R:       scryptR,
+		P:       scryptP,
+		Salt:    make([]byte, 16),
+		Cipher:  "aes-256-gcm",
+		Nonce:   make([]byte, 12),
+	}
+	if _, err := rand.Read(e.Salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(e.Nonce); err != nil {
+		return nil, err
+	}
+
+	aead, err := e.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	e.Ciphertext = aead.Seal(nil, e.Nonce, plaintext, e.additionalData())
+	return json.Marshal(e)
+}
+
+// isEncryptedExport returns true if b looks like the output of
+// `safe export --encrypt'.
+func isEncryptedExport(b []byte) bool {
+	b = bytes.TrimSpace(b)
+	if !bytes.HasPrefix(b, []byte("{")) || !bytes.Contains(b, []byte(`"safe_encrypted_export"`)) {
+		return false
+	}
+	var e encryptedExport
+	return json.Unmarshal(b, &e) == nil && e.Version != 0
+}
+
+// decryptExport checks and decrypts an encrypted export, returning the export
+// that was inside it.
+func decryptExport(b []byte, passphrase string) ([]byte, error) {
+	var e encryptedExport
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, fmt.Errorf("Could not interpret encrypted export: %s", err)
+	}
+	if e.Version != encryptedExportVersion {
+		return nil, fmt.Errorf("Encrypted export is in version %d of the format, which this version of safe does not understand", e.Version)
+	}
+	if e.KDF != "scrypt" || e.Cipher != "aes-256-gcm" {
+		return nil, fmt.Errorf("Encrypted export uses %s and %s, which this version of safe does not support", e.KDF, e.Cipher)
+	}
+	//Keep a damaged (or malicious) file from making us use all the memory
+	if e.N < 2 || e.R < 1 || int64(e.N)*int64(e.R) > scryptMaxMemory/128 || e.P < 1 || e.P > scryptMaxP {
+		return nil, fmt.Errorf("Encrypted export has out-of-range scrypt parameters (n=%d, r=%d, p=%d)", e.N, e.R, e.P)
+	}
+
+	aead, err := e.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(e.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("Encrypted export has a malformed nonce")
+	}
+	plaintext, err := aead.Open(nil, e.Nonce, e.Ciphertext, e.additionalData())
+	if err != nil {
+		return nil, fmt.Errorf("Could not decrypt export: either the passphrase is wrong, or the file has been damaged")
+	}
+	return plaintext, nil
+}
+
+// exportPassphrase returns the passphrase for encrypting or decrypting an
+// export, from $SAFE_EXPORT_PASSPHRASE if it is set, or by asking for it on
+// the terminal otherwise.  When encrypting, the passphrase has to be typed in
+// twice.
+func exportPassphrase(encrypting bool) (string, error) {
+	if pass := os.Getenv("SAFE_EXPORT_PASSPHRASE"); pass != "" {
+		return pass, nil
+	}
+
+	pass, err := prompt.SecureTerminal("@Y{Export passphrase}: ")
+	if err != nil {
+		return "", fmt.Errorf("Unable to ask for the export passphrase (%s); try setting $SAFE_EXPORT_PASSPHRASE", err)
+	}
+	if pass == "" {
+		return "", fmt.Errorf("The export passphrase cannot be empty")
+	}
+	if encrypting {
+		confirm, err := prompt.SecureTerminal("@Y{Export passphrase} @C{[confirm]}: ")
+		if err != nil {
+			return "", err
+		}
+		if confirm != pass {
+			return "", fmt.Errorf("The passphrases did not match")
+		}
+	}
+	return pass, nil
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+// Besides its own export formats, safe can export to (and import from) the
+// formats that some other tools use.  These only ever hold the latest version
+// of each secret.
+var foreignFormats = []string{"dotenv", "k8s-secret", "vault-kv-json"}
+
+func checkForeignFormat(format string) error {
+	for _, f := range foreignFormats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unrecognized format `%s' (try one of %s)", format, strings.Join(foreignFormats, ", "))
+}
+
+// k8sPathAnnotation records which path in the Vault a Kubernetes Secret came
+// from, so that importing it puts it back in the same place.
+const k8sPathAnnotation = "safe/path"
+
+type k8sSecret struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   k8sMetadata       `yaml:"metadata"`
+	Type       string            `yaml:"type,omitempty"`
+	Data       map[string]string `yaml:"data,omitempty"`
+	StringData map[string]string `yaml:"stringData,omitempty"`
+	//For a `kind: List' of Secrets
+	Items []k8sSecret `yaml:"items,omitempty"`
+}
+
+type k8sMetadata struct {
+	Name        string            `yaml:"name"`
+	Namespace   string            `yaml:"namespace,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// vaultKVResponse is what `vault kv get -format=json' prints.  For KV v1
+// secrets, Data is the secret itself; for KV v2 secrets, it holds the secret
+// under `data', along with its `metadata'.
+type vaultKVResponse struct {
+	RequestID     string                 `json:"request_id"`
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Data          map[string]interface{} `json:"data"`
+	Warnings      []string               `json:"warnings"`
+}
+
+var (
+	k8sKeyPattern  = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+	notAlnum       = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+	notDNSLabel    = regexp.MustCompile(`[^a-z0-9.-]+`)
+	dotenvVariable = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// underRoot returns the part of path below whichever of roots it is under (or
+// an empty string, if it is one of them), and true.  If path is not under any
+// of roots, the whole of it is returned, and false.
+func underRoot(roots []string, path string) (string, bool) {
+	path = strings.Trim(path, "/")
+	for _, root := range roots {
+		root = strings.Trim(root, "/")
+		if path == root {
+			return "", true
+		}
+		if strings.HasPrefix(path, root+"/") {
+			return strings.TrimPrefix(path, root+"/"), true
+		}
+	}
+	return path, false
+}
+
+// screamingSnake turns a path or key into the SCREAMING_SNAKE_CASE that
+// environment variables are usually named in.
+func screamingSnake(s string) string {
+	return strings.Trim(strings.ToUpper(notAlnum.ReplaceAllString(s, "_")), "_")
+}
+
+// exportForeign writes the latest version of each secret out in the given
+// foreign format.  Paths are made relative to whichever of roots (the paths
+// that were exported) they came from, where the format has no room for the
+// whole path.
+func exportForeign(v *vault.Vault, format string, roots []string, secrets vault.Secrets) ([]byte, error) {
+	var out bytes.Buffer
+	switch format {
+	case "dotenv":
+		seen := map[string]string{}
+		for _, secret := range secrets {
+			data := secret.LatestVersion().Data
+			rel, _ := underRoot(roots, secret.Path)
+			prefix := screamingSnake(rel)
+			for _, key := range data.Keys() {
+				name := screamingSnake(key)
+				if prefix != "" {
+					name = prefix + "_" + name
+				}
+				if name == "" || (name[0] >= '0' && name[0] <= '9') {
+					name = "_" + name
+				}
+				if other, clash := seen[name]; clash {
+					return nil, fmt.Errorf("Both `%s' and `%s:%s' would be exported as %s", other, secret.Path, key, name)
+				}
+				seen[name] = secret.Path + ":" + key
+				fmt.Fprintf(&out, "%s=%s\n", name, dotenvQuote(data.Get(key)))
+			}
+		}
+
+	case "k8s-secret":
+		seen := map[string]string{}
+		for _, secret := range secrets {
+			name, _ := underRoot(roots, secret.Path)
+			if name == "" {
+				name = secret.Basename()
+			}
+			name = strings.Trim(notDNSLabel.ReplaceAllString(strings.ToLower(name), "-"), "-.")
+			if name == "" {
+				return nil, fmt.Errorf("Could not make a Kubernetes Secret name out of `%s'", secret.Path)
+			}
+			if other, clash := seen[name]; clash {
+				return nil, fmt.Errorf("Both `%s' and `%s' would be exported as the Kubernetes Secret %s", other, secret.Path, name)
+			}
+			seen[name] = secret.Path
+
+			s := k8sSecret{
+				APIVersion: "v1",
+				Kind:       "Secret",
+				Metadata: k8sMetadata{
+					Name:        name,
+					Annotations: map[string]string{k8sPathAnnotation: secret.Path},
+				},
+				Type: "Opaque",
+				Data: map[string]string{},
+			}
+			data := secret.LatestVersion().Data
+			for _, key := range data.Keys() {
+				if !k8sKeyPattern.MatchString(key) {
+					return nil, fmt.Errorf("`%s:%s' cannot be exported to a Kubernetes Secret; keys may only use letters, digits, `-', `_' and `.'", secret.Path, key)
+				}
+				s.Data[key] = base64.StdEncoding.EncodeToString([]byte(data.Get(key)))
+			}
+
+			b, err := yaml.Marshal(s)
+			if err != nil {
+				return nil, err
+			}
+			out.WriteString("---\n")
+			out.Write(b)
+		}
+
+	case "vault-kv-json":
+		docs := map[string]vaultKVResponse{}
+		for _, secret := range secrets {
+			latest := secret.LatestVersion()
+			data := map[string]interface{}{}
+			for _, key := range latest.Data.Keys() {
+				data[key] = latest.Data.Get(key)
+			}
+
+			doc := vaultKVResponse{Data: data}
+			mountVersion, err := v.MountVersion(secret.Path)
+			if err != nil {
+				return nil, err
+			}
+			if mountVersion == 2 {
+				meta := map[string]interface{}{
+					"created_time":    latest.CreatedTime,
+					"custom_metadata": nil,
+					"deletion_time":   latest.DeletionTime,
+					"destroyed":       false,
+					"version":         latest.Number,
+				}
+				if secret.Metadata != nil && len(secret.Metadata.CustomMetadata) > 0 {
+					meta["custom_metadata"] = secret.Metadata.CustomMetadata
+				}
+				doc.Data = map[string]interface{}{"data": data, "metadata": meta}
+			}
+			docs[secret.Path] = doc
+		}
+		b, err := json.MarshalIndent(docs, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		out.Write(b)
+
+	default:
+		return nil, checkForeignFormat(format)
+	}
+
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n")), nil
+}
+
+// importForeign reads secrets from b, in the given foreign format.  path is
+// where to put them, for formats that don't say: all of the variables in a
+// .env file go into the one secret at path, as does a single secret from
+// `vault kv get', and Kubernetes Secrets that were not exported by safe go
+// into path/NAME.
+func importForeign(format string, b []byte, path string) (map[string]*vault.Secret, error) {
+	ret := map[string]*vault.Secret{}
+	switch format {
+	case "dotenv":
+		if path == "" {
+			return nil, fmt.Errorf("Importing a .env file needs a PATH to put its variables in")
+		}
+		s, err := parseDotenv(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		ret[path] = s
+
+	case "k8s-secret":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		for {
+			var doc k8sSecret
+			err := dec.Decode(&doc)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Could not interpret Kubernetes manifest: %s", err)
+			}
+
+			items := []k8sSecret{doc}
+			if doc.Kind == "List" {
+				items = doc.Items
+			}
+			for _, item := range items {
+				if item.Kind != "Secret" {
+					continue
+				}
+				p := item.Metadata.Annotations[k8sPathAnnotation]
+				if p == "" {
+					if path == "" {
+						return nil, fmt.Errorf("Kubernetes Secret %s does not say where in the Vault it came from; give a PATH to import it under", item.Metadata.Name)
+					}
+					p = strings.TrimSuffix(path, "/") + "/" + item.Metadata.Name
+				}
+
+				s := vault.NewSecret()
+				for key, value := range item.Data {
+					decoded, err := base64.StdEncoding.DecodeString(value)
+					if err != nil {
+						return nil, fmt.Errorf("Key `%s' of Kubernetes Secret %s is not valid base64: %s", key, item.Metadata.Name, err)
+					}
+					s.Set(key, string(decoded), false)
+				}
+				//Kubernetes lets stringData win over data, too
+				for key, value := range item.StringData {
+					s.Set(key, value, false)
+				}
+				ret[p] = s
+			}
+		}
+
+	case "vault-kv-json":
+		//Either the output of one `vault kv get', or a map of paths to them
+		var probe map[string]json.RawMessage
+		if err := json.Unmarshal(b, &probe); err != nil {
+			return nil, fmt.Errorf("Could not interpret vault kv JSON: %s", err)
+		}
+		_, hasData := probe["data"]
+		_, hasLease := probe["lease_id"]
+		if hasData && hasLease {
+			if path == "" {
+				return nil, fmt.Errorf("The output of `vault kv get' does not say which path it came from; give a PATH to import it to")
+			}
+			var single vaultKVResponse
+			if err := json.Unmarshal(b, &single); err != nil {
+				return nil, fmt.Errorf("Could not interpret vault kv JSON: %s", err)
+			}
+			s, err := single.secret()
+			if err != nil {
+				return nil, err
+			}
+			ret[path] = s
+			break
+		}
+
+		var docs map[string]vaultKVResponse
+		if err := json.Unmarshal(b, &docs); err != nil {
+			return nil, fmt.Errorf("Could not interpret vault kv JSON: %s", err)
+		}
+		for p, doc := range docs {
+			s, err := doc.secret()
+			if err != nil {
+				return nil, fmt.Errorf("Could not interpret vault kv JSON for `%s': %s", p, err)
+			}
+			ret[p] = s
+		}
+
+	default:
+		return nil, checkForeignFormat(format)
+	}
+
+	return ret, nil
+}
+
+// secret returns the secret in the response, from either KV v1 or KV v2.
+// Vault can hold values that aren't strings, which safe can't, so those are
+// kept as JSON.
+func (r vaultKVResponse) secret() (*vault.Secret, error) {
+	data := r.Data
+	inner, isMap := r.Data["data"].(map[string]interface{})
+	if _, hasMeta := r.Data["metadata"].(map[string]interface{}); isMap && hasMeta {
+		data = inner
+	}
+	if data == nil {
+		return nil, fmt.Errorf("there is no data in it")
+	}
+
+	s := vault.NewSecret()
+	for key, value := range data {
+		str, isString := value.(string)
+		if !isString {
+			b, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			str = string(b)
+		}
+		s.Set(key, str, false)
+	}
+	return s, nil
+}
+
+// dotenvQuote double-quotes a value for a .env file, escaping anything that
+// most .env readers would otherwise do something with.
+func dotenvQuote(value string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "\n", `\n`, "\r", `\r`)
+	return `"` + r.Replace(value) + `"`
+}
+
+// parseDotenv reads the variables in a .env file: NAME=VALUE lines, where the
+// value may be in single quotes (taken as-is) or double quotes (where \n, \r,
+// \", \$ and \\ are unescaped).  Blank lines, comments, and the `export' in
+// front of a variable are ignored.
+func parseDotenv(in io.Reader) (*vault.Secret, error) {
+	s := vault.NewSecret()
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		kv := strings.SplitN(line, "=", 2)
+		name := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || !dotenvVariable.MatchString(name) {
+			return nil, fmt.Errorf("Line %d of the .env file is not a NAME=VALUE assignment", n)
+		}
+		value := strings.TrimSpace(kv[1])
+
+		switch {
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			var unquoted strings.Builder
+			quoted := value[1 : len(value)-1]
+			for i := 0; i < len(quoted); i++ {
+				if quoted[i] != '\\' || i == len(quoted)-1 {
+					unquoted.WriteByte(quoted[i])
+					continue
+				}
+				i++
+				switch quoted[i] {
+				case 'n':
+					unquoted.WriteByte('\n')
+				case 'r':
+					unquoted.WriteByte('\r')
+				default:
+					unquoted.WriteByte(quoted[i])
+				}
+			}
+			value = unquoted.String()
+
+		default:
+			//Unquoted values can have comments after them
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+		}
+
+		s.Set(name, value, false)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// sortedKeys returns the keys of a map of secrets, in path order.
+func sortedKeys(data map[string]*vault.Secret) []string {
+	paths := make([]string, 0, len(data))
+	for path := range data {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool { return vault.PathLessThan(paths[i], paths[j]) })
+	return paths
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cloudfoundry-community/vaultkv"
+	ansi "github.com/jhunt/go-ansi"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+// pathRebase moves imported secrets from one prefix to another, as given to
+// `safe import --rebase OLD=NEW'.
+type pathRebase struct {
+	from string
+	to   string
+}
+
+func parseRebases(args []string) ([]pathRebase, error) {
+	var ret []pathRebase
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid rebase `%s': expected OLD=NEW, like secret/old/=secret/new/", arg)
+		}
+		from := strings.Trim(vault.Canonicalize(parts[0]), "/")
+		to := strings.Trim(vault.Canonicalize(parts[1]), "/")
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("Invalid rebase `%s': neither side can be empty", arg)
+		}
+		ret = append(ret, pathRebase{from: from, to: to})
+	}
+
+	//The most specific prefix wins
+	sort.SliceStable(ret, func(i, j int) bool { return len(ret[i].from) > len(ret[j].from) })
+	return ret, nil
+}
+
+// rebase returns where the secret exported from path should be imported to.
+func (opts importOpts) rebase(path string) string {
+	trimmed := strings.Trim(path, "/")
+	for _, r := range opts.Rebase {
+		if trimmed == r.from {
+			return r.to
+		}
+		if strings.HasPrefix(trimmed, r.from+"/") {
+			return r.to + "/" + strings.TrimPrefix(trimmed, r.from+"/")
+		}
+	}
+	return path
+}
+
+// rebaseAll rebases each of paths, and says which path each of the rebased
+// paths came from.  Since the secrets are written several at once, no two of
+// them may end up in the same place.
+func (opts importOpts) rebaseAll(paths []string) ([]string, map[string]string, error) {
+	rebased := make([]string, len(paths))
+	from := make(map[string]string, len(paths))
+	for i, path := range paths {
+		rebased[i] = opts.rebase(path)
+		if other, clash := from[rebased[i]]; clash {
+			return nil, nil, fmt.Errorf("Both `%s' and `%s' would be imported to `%s'", other, path, rebased[i])
+		}
+		from[rebased[i]] = path
+	}
+	return rebased, from, nil
+}
+
+// importPlan works out what importing each secret would do to the Vault,
+// without writing anything, and prints it.  It is safe to use from more than
+// one goroutine at once.
+type importPlan struct {
+	v    *vault.Vault
+	opts importOpts
+
+	lock                                    sync.Mutex
+	creates, overwrites, unchanged, skipped int
+}
+
+// add plans the import of one secret to path.  If history is true, the secret
+// would be written the way v2 exports are, wiping whatever is at path and
+// writing every version again; otherwise (for v1 exports), the secret would
+// just be written on top of whatever is there already.
+func (p *importPlan) add(path string, secret exportSecret, history bool) error {
+	s := fromExportSecret(path, secret, p.opts)
+	if len(s.Versions) == 0 {
+		return nil
+	}
+
+	existing, err := p.v.Versions(path)
+	if err != nil && !vault.IsNotFound(err) {
+		return fmt.Errorf("Could not check `%s': %s", path, err)
+	}
+	//A v2 secret whose latest version has been destroyed still has versions,
+	// but a v2 secret that has had its metadata deleted does not
+	exists := err == nil && len(existing) > 0
+
+	var details []string
+	var same bool
+	if history {
+		writes, pads, deletes, destroys := p.versions(s)
+		if exists {
+			same, err = p.sameHistory(path, s, secret, existing, pads)
+			if err != nil {
+				return err
+			}
+			details = append(details, fmt.Sprintf("destroys all %d existing versions", len(existing)))
+		}
+		details = append(details, fmt.Sprintf("writes %s", plural(writes, "version")))
+		if len(pads) > 0 {
+			details = append(details, fmt.Sprintf("pads %s", versionList(pads)))
+		}
+		if len(deletes) > 0 {
+			details = append(details, fmt.Sprintf("deletes %s", versionList(deletes)))
+		}
+		if len(destroys) > 0 {
+			details = append(details, fmt.Sprintf("destroys %s", versionList(destroys)))
+		}
+
+	} else if exists {
+		latest := s.LatestVersion().Data
+		same, err = p.sameVersion(path, existing[len(existing)-1], latest)
+		if err != nil {
+			return err
+		}
+		if mountVersion, err := p.v.MountVersion(path); err == nil && mountVersion == 2 {
+			details = append(details, fmt.Sprintf("adds version %d", existing[len(existing)-1].Version+1))
+		} else {
+			details = append(details, "replaces it")
+		}
+	}
+
+	var about string
+	if len(details) > 0 {
+		about = " (" + strings.Join(details, "; ") + ")"
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	switch {
+	case !exists:
+		ansi.Printf("  @G{create} %s%s\n", path, about)
+		p.creates++
+	case same:
+		p.unchanged++
+	default:
+		ansi.Printf("  @Y{overwrite} %s%s\n", path, about)
+		p.overwrites++
+	}
+	return nil
+}
+
+// versions works out which version numbers importing s would write, and which
+// of them would be padding, deleted, or destroyed, the same way that
+// vault.SecretEntry.Copy does it.
+func (p *importPlan) versions(s vault.SecretEntry) (writes int, pads, deletes, destroys []uint) {
+	next := uint(1)
+	if p.opts.pad() {
+		for ; next < s.Versions[0].Number; next++ {
+			pads = append(pads, next)
+		}
+	}
+	for _, version := range s.Versions {
+		switch version.State {
+		case vault.SecretStateDeleted:
+			deletes = append(deletes, next)
+		case vault.SecretStateDestroyed:
+			destroys = append(destroys, next)
+		}
+		next++
+	}
+	return int(next) - 1, pads, deletes, destroys
+}
+
+// sameHistory returns true if the versions of the secret at path already are
+// exactly the versions that importing s would leave there.  Deleted versions
+// can't be read without undeleting them, so only their numbers are compared.
+func (p *importPlan) sameHistory(path string, s vault.SecretEntry, secret exportSecret, existing []vaultkv.KVVersion, pads []uint) (bool, error) {
+	if len(existing) != len(pads)+len(s.Versions) {
+		return false, nil
+	}
+	for i := range pads {
+		if existing[i].Version != pads[i] || !existing[i].Destroyed {
+			return false, nil
+		}
+	}
+	for i, version := range s.Versions {
+		have := existing[len(pads)+i]
+		if have.Version != uint(len(pads)+i+1) {
+			return false, nil
+		}
+		switch version.State {
+		case vault.SecretStateDestroyed:
+			if !have.Destroyed {
+				return false, nil
+			}
+		case vault.SecretStateDeleted:
+			if !have.Deleted || have.Destroyed {
+				return false, nil
+			}
+		default:
+			same, err := p.sameVersion(path, have, version.Data)
+			if err != nil || !same {
+				return false, err
+			}
+		}
+	}
+
+	if secret.Metadata != nil {
+		m, err := p.v.Metadata(path)
+		if err != nil {
+			return false, fmt.Errorf("Could not check the metadata of `%s': %s", path, err)
+		}
+		if m.MaxVersions != secret.Metadata.MaxVersions || m.CASRequired != secret.Metadata.CASRequired ||
+			!reflect.DeepEqual(m.CustomMetadata, secret.Metadata.CustomMetadata) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// sameVersion returns true if the given (existing) version of the secret at
+// path is alive, and holds exactly the data in want.
+func (p *importPlan) sameVersion(path string, have vaultkv.KVVersion, want *vault.Secret) (bool, error) {
+	if have.Deleted || have.Destroyed {
+		return false, nil
+	}
+	got, err := p.v.Read(vault.EncodePath(path, "", uint64(have.Version)))
+	if err != nil {
+		if vault.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("Could not check `%s': %s", path, err)
+	}
+	return got.JSON() == want.JSON(), nil
+}
+
+// skip notes that a secret would not be imported at all, and why.
+func (p *importPlan) skip(path, reason string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	ansi.Printf("  @R{skip} %s (%s)\n", path, reason)
+	p.skipped++
+}
+
+func (p *importPlan) print() {
+	if p.creates+p.overwrites+p.skipped == 0 {
+		ansi.Printf("@G{Nothing to do}; all %d secrets are already present.\n", p.unchanged)
+		return
+	}
+	if p.skipped > 0 {
+		ansi.Printf("\n%d to create, %d to overwrite, %d unchanged, %d skipped.\n", p.creates, p.overwrites, p.unchanged, p.skipped)
+		return
+	}
+	ansi.Printf("\n%d to create, %d to overwrite, %d unchanged.\n", p.creates, p.overwrites, p.unchanged)
+}
+
+// pad returns true if the versions that Vault had already thrown away when a
+// secret was exported are recreated (and destroyed) on import, so that the
+// version numbers stay the same.
+func (opts importOpts) pad() bool {
+	return !(opts.IgnoreDestroyed || opts.Shallow)
+}
+
+// versionList formats version numbers for people, as "version 3" or
+// "versions 1-4, 6".
+func versionList(versions []uint) string {
+	var parts []string
+	for i := 0; i < len(versions); {
+		j := i
+		for j+1 < len(versions) && versions[j+1] == versions[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, fmt.Sprintf("%d", versions[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", versions[i], versions[j]))
+		}
+		i = j + 1
+	}
+	if len(versions) == 1 {
+		return "version " + parts[0]
+	}
+	return "versions " + strings.Join(parts, ", ")
+}
+
+func plural(n int, thing string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 %s", thing)
+	}
+	return fmt.Sprintf("%d %ss", n, thing)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+// exportIncremental marks an export as only holding the secrets that changed
+// since an earlier one.  Since and ExportedAt let `safe import --incremental'
+// check that a chain of them has no gaps.
+type exportIncremental struct {
+	//Since is empty for the first export made with a (new) state file, which
+	// holds every secret
+	Since      string   `json:"since,omitempty"`
+	ExportedAt string   `json:"exported_at"`
+	Removed    []string `json:"removed,omitempty"`
+}
+
+// exportState is what `safe export --since-file' keeps between runs: when the
+// last export was made, and the latest version of every secret it saw.
+type exportState struct {
+	ExportedAt string          `json:"exported_at"`
+	Versions   map[string]uint `json:"versions"`
+}
+
+// readExportState reads the state file at path.  If there isn't one yet, it
+// returns nil, and everything gets exported.
+func readExportState(path string) (*exportState, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state exportState
+	if err = json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("Could not interpret export state file `%s': %s", path, err)
+	}
+	if state.Versions == nil {
+		state.Versions = map[string]uint{}
+	}
+	return &state, nil
+}
+
+// write replaces the state file at path.  The new state is written alongside
+// it and then renamed into place, so that an export that fails partway
+// through doesn't leave the next one with nothing to go on.
+func (s *exportState) write(path string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".safe-state")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// filterIncremental picks out the secrets that changed since the cutoff given
+// with --since, or since the export that prev was saved by.  It returns them,
+// along with the incremental marker for the export, and the state to save for
+// next time.
+//
+// Secrets in KV v1 mounts have neither versions nor timestamps, so there is
+// no telling whether they changed; they are always exported.
+func filterIncremental(secrets vault.Secrets, roots []string, since string, prev *exportState, now time.Time) (vault.Secrets, *exportIncremental, *exportState, error) {
+	incremental := &exportIncremental{Since: since, ExportedAt: now.UTC().Format(time.RFC3339)}
+	state := &exportState{ExportedAt: incremental.ExportedAt, Versions: map[string]uint{}}
+
+	var cutoff time.Time
+	if since != "" {
+		var err error
+		if cutoff, err = time.Parse(time.RFC3339, since); err != nil {
+			return nil, nil, nil, fmt.Errorf("Invalid time `%s' for --since: expected something like 2006-01-02T15:04:05Z", since)
+		}
+	}
+	if prev != nil {
+		incremental.Since = prev.ExportedAt
+		//Keep track of the secrets that weren't exported this time around
+		for path, version := range prev.Versions {
+			if _, under := underRoot(roots, path); !under {
+				state.Versions[path] = version
+			}
+		}
+	}
+
+	var changed vault.Secrets
+	for _, secret := range secrets {
+		latest := secret.LatestVersion()
+		state.Versions[secret.Path] = latest.Number
+
+		include := true
+		switch {
+		case latest.CreatedTime == "":
+			//KV v1
+		case prev != nil:
+			//A secret that was deleted and made again starts over at version 1
+			seen, ok := prev.Versions[secret.Path]
+			include = !ok || latest.Number != seen
+		case since != "":
+			created, err := time.Parse(time.RFC3339Nano, latest.CreatedTime)
+			include = err != nil || created.After(cutoff)
+		}
+		if include {
+			changed = append(changed, secret)
+		}
+	}
+
+	if prev != nil {
+		for path := range prev.Versions {
+			if _, found := state.Versions[path]; !found {
+				incremental.Removed = append(incremental.Removed, path)
+			}
+		}
+		sort.Slice(incremental.Removed, func(i, j int) bool {
+			return vault.PathLessThan(incremental.Removed[i], incremental.Removed[j])
+		})
+	}
+	return changed, incremental, state, nil
+}
+
+// chainExports reads a base export and the incremental exports made after it
+// from files, in order, and puts them together into one (V2) export that has
+// the latest of every secret, and none of the secrets that were removed.  Each
+// incremental export has to pick up no later than the one before it left off.
+// If verifyKey is given, every export in the chain has to be signed with it.
+func chainExports(files []string, verifyKey *signingKey) ([]byte, error) {
+	var passphrase string
+	chain := exportFormat{ExportVersion: 2, Data: map[string]exportSecret{}, RequiresVersioning: map[string]bool{}}
+	var last *exportIncremental
+
+	for i, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if isEncryptedExport(b) {
+			if passphrase == "" {
+				if passphrase, err = exportPassphrase(false); err != nil {
+					return nil, err
+				}
+			}
+			if b, err = decryptExport(b, passphrase); err != nil {
+				return nil, fmt.Errorf("Could not decrypt `%s': %s", file, err)
+			}
+		}
+		if b, err = unwrapSignedExport(b, verifyKey); err != nil {
+			return nil, fmt.Errorf("Could not verify `%s': %s", file, err)
+		}
+
+		export, err := readChainedExport(b)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read `%s': %s", file, err)
+		}
+		if i > 0 {
+			if export.Incremental == nil {
+				return nil, fmt.Errorf("`%s' is not an incremental export (from 'safe export --since' or 'safe export --since-file'), so it can't be applied on top of `%s'", file, files[i-1])
+			}
+			if last != nil && export.Incremental.Since != "" {
+				since, _ := time.Parse(time.RFC3339, export.Incremental.Since)
+				exportedAt, _ := time.Parse(time.RFC3339, last.ExportedAt)
+				if since.After(exportedAt) {
+					return nil, fmt.Errorf("`%s' has the changes since %s, but `%s' was exported at %s; is an incremental export missing?",
+						file, export.Incremental.Since, files[i-1], last.ExportedAt)
+				}
+			}
+		}
+
+		if export.ExportVersion > chain.ExportVersion {
+			chain.ExportVersion = export.ExportVersion
+		}
+		for mount := range export.RequiresVersioning {
+			chain.RequiresVersioning[mount] = true
+		}
+		for path, secret := range export.Data {
+			chain.Data[path] = secret
+		}
+		if export.Incremental != nil {
+			for _, path := range export.Incremental.Removed {
+				delete(chain.Data, path)
+			}
+		}
+		last = export.Incremental
+	}
+
+	return json.Marshal([]exportFormat{chain})
+}
+
+// readChainedExport reads one export in a chain.  V1 exports are turned into
+// V2 exports, with one version of each secret.
+func readChainedExport(b []byte) (*exportFormat, error) {
+	var v2 []exportFormat
+	if err := json.Unmarshal(b, &v2); err == nil {
+		if len(v2) != 1 || (v2[0].ExportVersion != 2 && v2[0].ExportVersion != 4) {
+			return nil, fmt.Errorf("only V1, V2 and V4 exports can be chained")
+		}
+		return &v2[0], nil
+	}
+
+	var v1 map[string]*vault.Secret
+	if err := json.Unmarshal(b, &v1); err != nil {
+		return nil, fmt.Errorf("Unknown export file format")
+	}
+	export := exportFormat{ExportVersion: 2, Data: map[string]exportSecret{}}
+	for path, s := range v1 {
+		version := exportVersion{Value: map[string]string{}}
+		for _, key := range s.Keys() {
+			version.Value[key] = s.Get(key)
+		}
+		export.Data[path] = exportSecret{Versions: []exportVersion{version}}
+	}
+	return &export, nil
+}
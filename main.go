@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -9,6 +10,7 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"errors"
+	"io"
 	"io/ioutil"
 	"math/big"
 	"net"
@@ -31,6 +33,7 @@ import (
 	fmt "github.com/jhunt/go-ansi"
 	"github.com/jhunt/go-cli"
 	env "github.com/jhunt/go-envirotron"
+	"github.com/mattn/go-isatty"
 	"gopkg.in/yaml.v2"
 
 	"github.com/starkandwayne/safe/prompt"
@@ -62,13 +65,21 @@ func connect(auth bool) *vault.Vault {
 		return false
 	}
 
+	command := currentCommand()
 	conf := vault.VaultConfig{
 		URL:        getVaultURL(),
 		Token:      os.Getenv("VAULT_TOKEN"),
 		Namespace:  os.Getenv("VAULT_NAMESPACE"),
 		SkipVerify: shouldSkipVerify(),
 		CACerts:    caCertPool,
+		NoRetry:    os.Getenv("SAFE_NO_RETRY") != "",
+		Context:    command.ctx,
+		Progress:   command.progress,
+
+		RequestContext: command.requestCtx,
 	}
+	conf.Workers, _ = strconv.Atoi(os.Getenv("SAFE_WORKERS"))
+	conf.RequestsPerSecond, _ = strconv.Atoi(os.Getenv("SAFE_RPS"))
 
 	if auth && conf.Token == "" {
 		fmt.Fprintf(os.Stderr, "@R{You are not authenticated to a Vault.}\n")
@@ -89,6 +100,16 @@ func connect(auth bool) *vault.Vault {
 	return v
 }
 
+//connectTo targets the given Vault alias (or the current target, if alias is
+// empty) and returns an authenticated connection to it.  This allows a single
+// command to talk to more than one Vault.
+func connectTo(alias string) *vault.Vault {
+	os.Unsetenv("VAULT_NAMESPACE")
+	os.Unsetenv("VAULT_CACERT")
+	rc.Apply(alias)
+	return connect(true)
+}
+
 //Exits program with error if no Vault targeted
 func getVaultURL() string {
 	ret := os.Getenv("VAULT_ADDR")
@@ -107,7 +128,11 @@ type Options struct {
 	Help         bool `cli:"-h, --help"`
 	Clobber      bool `cli:"--clobber, --no-clobber"`
 	SkipIfExists bool
-	Quiet        bool `cli:"--quiet"`
+	Quiet        bool   `cli:"--quiet"`
+	Retry        bool   `cli:"--retry, --no-retry"`
+	Workers      int    `cli:"--workers"`
+	RPS          int    `cli:"--rps"`
+	Timeout      string `cli:"--timeout" env:"SAFE_TIMEOUT"`
 
 	// Behavour of -T must chain through -- separated commands.  There is code
 	// that relies on this.  Will default to $SAFE_TARGET if it exists, or
@@ -144,6 +169,7 @@ type Options struct {
 	Ask    struct{} `cli:"ask"`
 	Set    struct{} `cli:"set, write"`
 	Paste  struct{} `cli:"paste"`
+	Edit   struct{} `cli:"edit"`
 	Exists struct{} `cli:"exists, check"`
 
 	Local struct {
@@ -177,6 +203,10 @@ type Options struct {
 
 	Versions struct{} `cli:"versions,revisions"`
 
+	Meta struct {
+		Recurse bool `cli:"-R, -r, --recurse"`
+	} `cli:"meta, metadata"`
+
 	List struct {
 		Single bool `cli:"-1"`
 		Quick  bool `cli:"-q, --quick"`
@@ -193,6 +223,25 @@ type Options struct {
 		Quick      bool `cli:"-q, --quick"`
 	} `cli:"tree"`
 
+	Grep struct {
+		Recurse   bool `cli:"-R, -r, --recurse"`
+		KeysOnly  bool `cli:"--keys-only"`
+		PathsOnly bool `cli:"--paths-only"`
+		Values    bool `cli:"--values"`
+		Invert    bool `cli:"--invert"`
+	} `cli:"grep"`
+
+	Diff struct {
+		Reveal bool `cli:"--reveal"`
+	} `cli:"diff"`
+
+	Sync struct {
+		All     bool `cli:"-a, --all"`
+		Deleted bool `cli:"-d, --deleted"`
+		Prune   bool `cli:"-p, --prune"`
+		Yes     bool `cli:"-y, --yes"`
+	} `cli:"sync"`
+
 	Target struct {
 		JSON        bool     `cli:"--json"`
 		Interactive bool     `cli:"-i, --interactive"`
@@ -211,7 +260,9 @@ type Options struct {
 	} `cli:"delete, rm"`
 
 	Undelete struct {
-		All bool `cli:"-a, --all"`
+		Recurse bool `cli:"-R, -r, --recurse"`
+		Force   bool `cli:"-f, --force"`
+		All     bool `cli:"-a, --all"`
 	} `cli:"undelete, unrm, urm"`
 
 	Revert struct {
@@ -219,34 +270,73 @@ type Options struct {
 	} `cli:"revert"`
 
 	Export struct {
-		All     bool `cli:"-a, --all"`
-		Deleted bool `cli:"-d, --deleted"`
+		All       bool   `cli:"-a, --all"`
+		Deleted   bool   `cli:"-d, --deleted"`
+		Encrypt   bool   `cli:"-e, --encrypt"`
+		Stream    bool   `cli:"-S, --stream"`
+		Metadata  bool   `cli:"-m, --metadata"`
+		Format    string `cli:"--format"`
+		Since     string `cli:"--since"`
+		SinceFile string `cli:"--since-file"`
+		Sign      string `cli:"--sign"`
 		//These do nothing but are kept for backwards-compat
 		OnlyAlive bool `cli:"-o, --only-alive"`
 		Shallow   bool `cli:"-s, --shallow"`
 	} `cli:"export"`
 
 	Import struct {
-		IgnoreDestroyed bool `cli:"-I, --ignore-destroyed"`
-		IgnoreDeleted   bool `cli:"-i, --ignore-deleted"`
-		Shallow         bool `cli:"-s, --shallow"`
+		IgnoreDestroyed bool     `cli:"-I, --ignore-destroyed"`
+		IgnoreDeleted   bool     `cli:"-i, --ignore-deleted"`
+		Shallow         bool     `cli:"-s, --shallow"`
+		ResumeFrom      string   `cli:"--resume-from"`
+		Plan            bool     `cli:"--plan"`
+		Rebase          []string `cli:"--rebase"`
+		Format          string   `cli:"--format"`
+		From            string   `cli:"--from"`
+		Incremental     bool     `cli:"--incremental"`
+		Verify          string   `cli:"--verify"`
 	} `cli:"import"`
 
+	VerifyExport struct {
+		Key string `cli:"--key"`
+	} `cli:"verify-export"`
+
 	Move struct {
-		Recurse bool `cli:"-R, -r, --recurse"`
-		Force   bool `cli:"-f, --force"`
-		Deep    bool `cli:"-d, --deep"`
+		Recurse bool   `cli:"-R, -r, --recurse"`
+		Force   bool   `cli:"-f, --force"`
+		Deep    bool   `cli:"-d, --deep"`
+		History string `cli:"--history"`
 	} `cli:"move, rename, mv"`
 
 	Copy struct {
-		Recurse bool `cli:"-R, -r, --recurse"`
-		Force   bool `cli:"-f, --force"`
-		Deep    bool `cli:"-d, --deep"`
+		Recurse bool   `cli:"-R, -r, --recurse"`
+		Force   bool   `cli:"-f, --force"`
+		Deep    bool   `cli:"-d, --deep"`
+		History string `cli:"--history"`
 	} `cli:"copy, cp"`
 
+	KV struct {
+		Upgrade struct {
+			Force bool `cli:"-f, --force"`
+		} `cli:"upgrade"`
+	} `cli:"kv"`
+
 	Gen struct {
-		Policy string `cli:"-p, --policy"`
-		Length int    `cli:"-l, --length"`
+		Policy     string `cli:"-p, --policy"`
+		Length     int    `cli:"-l, --length"`
+		Preset     string `cli:"-P, --preset"`
+		MinLower   int    `cli:"--min-lower"`
+		MinUpper   int    `cli:"--min-upper"`
+		MinDigits  int    `cli:"--min-digits"`
+		MinSymbols int    `cli:"--min-symbols"`
+		NotFirst   string `cli:"--not-first"`
+		Ambiguous  bool   `cli:"--ambiguous, --no-ambiguous"`
+
+		Passphrase bool   `cli:"--passphrase"`
+		Words      int    `cli:"-w, --words"`
+		Separator  string `cli:"-s, --separator"`
+		Capitalize bool   `cli:"--capitalize"`
+		Digit      bool   `cli:"--digit"`
 	} `cli:"gen, auto, generate"`
 
 	SSH     struct{} `cli:"ssh"`
@@ -254,8 +344,16 @@ type Options struct {
 	DHParam struct{} `cli:"dhparam, dhparams, dh"`
 	Prompt  struct{} `cli:"prompt"`
 	Vault   struct{} `cli:"vault!"`
+	Exec    struct{} `cli:"exec!"`
 	Fmt     struct{} `cli:"fmt"`
 
+	Template struct{} `cli:"template"`
+
+	Apply struct {
+		Plan   bool     `cli:"--plan"`
+		Rotate []string `cli:"--rotate"`
+	} `cli:"apply"`
+
 	Curl struct {
 		DataOnly bool `cli:"--data-only"`
 	} `cli:"curl"`
@@ -320,9 +418,11 @@ type Options struct {
 
 func main() {
 	var opt Options
-	opt.Gen.Policy = "a-zA-Z0-9"
+	opt.Gen.Ambiguous = true
+	opt.Gen.Separator = " "
 
 	opt.Clobber = true
+	opt.Retry = true
 
 	opt.X509.Issue.Bits = 4096
 
@@ -361,6 +461,15 @@ func main() {
 	r.Dispatch("envvars", nil, func(command string, args ...string) error {
 		fmt.Printf(`@G{[SCRIPTING]}
   @B{SAFE_TARGET}    The vault alias which requests are sent to.
+  @B{SAFE_TIMEOUT}   How long a command may run (like 90s, or 10m) before
+                 it stops. Same as --timeout.
+
+@G{[PERFORMANCE]}
+  @B{SAFE_WORKERS}   How many requests to make at once when walking a tree
+                 of secrets (e.g. for 'safe export' or 'safe tree').
+                 Defaults to one per CPU. Same as --workers.
+  @B{SAFE_RPS}       The most requests to send to the Vault each second.
+                 Unlimited by default. Same as --rps.
 
 @G{[PROXYING]}
   @B{HTTP_PROXY}     The proxy to use for HTTP requests.
@@ -1313,6 +1422,9 @@ Vault will remain sealed).
 		const attemptInterval = 500 * time.Millisecond
 
 		for len(toSeal) > 0 {
+			if err := v.Stopped(); err != nil {
+				return err
+			}
 			for i, addr := range toSeal {
 				v.SetURL(addr)
 				err := v.Client().Client.Health(false)
@@ -1648,6 +1760,7 @@ Flags:
 		}
 		exists := (err == nil)
 		clobberKeys := []string{}
+		values := map[string]string{}
 		for _, arg := range args {
 			k, v, missing, err := parseKeyVal(arg, opt.Quiet)
 			if err != nil {
@@ -1667,19 +1780,37 @@ Flags:
 			if err != nil {
 				return err
 			}
-			err = s.Set(k, v, opt.SkipIfExists)
-			if err != nil {
-				return err
-			}
+			values[k] = v
 		}
-		if len(clobberKeys) > 0 {
+		refuse := func(keys []string) {
 			if !opt.Quiet {
 				fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to update} @C{%s}@R{, as the following keys would be clobbered:} @C{%s}\n",
-					path, strings.Join(clobberKeys, ", "))
+					path, strings.Join(keys, ", "))
 			}
+		}
+		if len(clobberKeys) > 0 {
+			refuse(clobberKeys)
 			return nil
 		}
-		return v.Write(path, s)
+
+		//Apply the values to the latest copy of the secret, in case it
+		// changed while we were prompting for them.
+		return v.Update(path, func(s *vault.Secret) error {
+			for k := range values {
+				if opt.SkipIfExists && s.Has(k) {
+					clobberKeys = append(clobberKeys, k)
+				}
+			}
+			if len(clobberKeys) > 0 {
+				sort.Strings(clobberKeys)
+				refuse(clobberKeys)
+				return vault.SkipWrite
+			}
+			for k, v := range values {
+				s.Set(k, v, false)
+			}
+			return nil
+		})
 	}
 
 	r.Dispatch("ask", &Help{
@@ -1752,6 +1883,111 @@ like 1password or Lastpass.
 		return writeHelper(false, true, "paste", args...)
 	})
 
+	r.Dispatch("edit", &Help{
+		Summary: "Edit a secret in your text editor",
+		Usage:   "safe edit PATH",
+		Type:    DestructiveCommand,
+		Description: `
+Opens the secret at PATH, as YAML, in your preferred text editor (as set by
+$VISUAL or $EDITOR, falling back to vi).  When the editor exits, the edited
+secret is written back to the Vault, unless nothing was changed.  If PATH does
+not exist yet, it will be created.
+
+The secret is stored in a temporary file, readable only by you, that lives in
+memory-backed storage ($XDG_RUNTIME_DIR or /dev/shm) whenever possible.  The
+file is overwritten and removed once safe is done with it.
+
+If the edited YAML cannot be parsed, you will be asked whether you want to go
+back into the editor to fix it.
+
+On KV v2 mounts, the write uses check-and-set, so if someone else changes the
+secret while you are editing it, your changes will not be written and safe
+will tell you so, rather than silently overwriting theirs.
+`,
+	}, func(command string, args ...string) error {
+		rc.Apply(opt.UseTarget)
+		if len(args) != 1 {
+			r.ExitWithUsage("edit")
+		}
+		path := args[0]
+		if vault.PathHasKey(path) {
+			return fmt.Errorf("Cannot edit path with key (%s)", path)
+		}
+		if vault.PathHasVersion(path) {
+			return fmt.Errorf("Cannot edit path with version (%s)", path)
+		}
+
+		v := connect(true)
+		original, version, err := v.ReadForUpdate(path)
+		if err != nil {
+			return err
+		}
+
+		f, err := secretTempFile("safe-edit-*.yml")
+		if err != nil {
+			return err
+		}
+		defer shred(f.Name())
+
+		if !original.Empty() {
+			_, err = f.WriteString(original.YAML())
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		edited := vault.NewSecret()
+		for {
+			if err := runEditor(f.Name()); err != nil {
+				return err
+			}
+
+			b, err := ioutil.ReadFile(f.Name())
+			if err != nil {
+				return err
+			}
+
+			var data map[string]string
+			err = yaml.Unmarshal(b, &data)
+			if err == nil {
+				edited = vault.NewSecret()
+				for k, val := range data {
+					edited.Set(k, val, false)
+				}
+				break
+			}
+
+			fmt.Fprintf(os.Stderr, "@R{!! Could not parse the edited secret as YAML:} %s\n", err)
+			y := prompt.Normal("Re-open the editor to fix it? @Y{(y/n)} ")
+			if y = strings.TrimSpace(y); y != "y" && y != "yes" {
+				return fmt.Errorf("Aborting edit; `%s' was not changed", path)
+			}
+		}
+
+		if edited.JSON() == original.JSON() {
+			if !opt.Quiet {
+				fmt.Fprintf(os.Stderr, "No changes made to @C{%s}\n", path)
+			}
+			return nil
+		}
+		if edited.Empty() {
+			return fmt.Errorf("Refusing to write an empty secret to `%s'; use `safe delete' to remove it", path)
+		}
+
+		err = v.CheckAndSet(path, edited, version)
+		if vault.IsCASConflict(err) {
+			return fmt.Errorf("%s; your changes were not saved", err)
+		}
+		if err != nil {
+			return err
+		}
+		if !opt.Quiet {
+			fmt.Fprintf(os.Stderr, "Saved changes to @C{%s}\n", path)
+		}
+		return nil
+	})
+
 	r.Dispatch("exists", &Help{
 		Summary: "Check to see if a secret exists in the Vault",
 		Usage:   "safe exists PATH",
@@ -1937,6 +2173,12 @@ paths/keys.
 		Summary: "Print information about the versions of one or more paths",
 		Usage:   "safe versions PATH [PATHS...]",
 		Type:    NonDestructiveCommand,
+		Description: `
+Lists every version of each PATH, along with whether it is alive, deleted or
+destroyed, and when it was created.  For secrets in KV v2 mounts whose metadata
+has been changed from the defaults (see 'safe meta'), that metadata is shown
+as well.
+`,
 	}, func(command string, args ...string) error {
 		rc.Apply(opt.UseTarget)
 		v := connect(true)
@@ -1992,6 +2234,18 @@ paths/keys.
 
 			table.print()
 
+			//Only bother showing metadata that somebody has actually set
+			if mountVersion, err := v.MountVersion(args[i]); err == nil && mountVersion == 2 {
+				meta, err := v.Metadata(args[i])
+				if err != nil {
+					return err
+				}
+				if !meta.IsDefault() {
+					fmt.Printf("\n")
+					printMetadataTable(meta)
+				}
+			}
+
 			if len(args) > 1 && i != len(args)-1 {
 				fmt.Printf("\n")
 			}
@@ -2000,6 +2254,138 @@ paths/keys.
 		return nil
 	})
 
+	r.Dispatch("meta", &Help{
+		Summary: "Show or change the KV v2 metadata of one or more secrets",
+		Usage:   "safe meta [-r] PATH [FIELD=VALUE ...]",
+		Type:    DestructiveCommand,
+		Description: `
+Without any FIELD=VALUE arguments, prints the KV v2 metadata of the secret at
+PATH, as YAML.  Otherwise, updates the metadata with the given values.  The
+following fields can be set:
+
+  max_versions=N            How many versions of the secret to keep.  0 means
+                            to use the setting of the mount.
+
+  cas_required=BOOL         Whether writes to the secret must use
+                            check-and-set.
+
+  delete_version_after=DUR  How long to keep each version before deleting it,
+                            as a Go duration like 720h.  0s means forever.
+
+  custom.KEY=VALUE          Set the custom metadata annotation KEY to VALUE,
+                            e.g. custom.owner=team-a.  Leave VALUE empty to
+                            remove the annotation.
+
+If -r is given, every secret underneath PATH is shown or updated.
+
+For example:
+
+    safe meta -r secret/team-a max_versions=10 custom.owner=team-a
+`,
+	}, func(command string, args ...string) error {
+		rc.Apply(opt.UseTarget)
+		if len(args) < 1 {
+			r.ExitWithUsage("meta")
+		}
+		path, assignments := args[0], args[1:]
+		if vault.PathHasKey(path) || vault.PathHasVersion(path) {
+			return fmt.Errorf("Cannot get or set metadata of a specific key or version (%s)", path)
+		}
+
+		var updates []func(*vault.SecretMetadata)
+		for _, arg := range assignments {
+			kv := strings.SplitN(arg, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("Invalid metadata assignment `%s': expected FIELD=VALUE", arg)
+			}
+			field, value := kv[0], kv[1]
+
+			var fn func(*vault.SecretMetadata)
+			switch {
+			case field == "max_versions":
+				n, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					return fmt.Errorf("Invalid max_versions `%s': must be a non-negative integer", value)
+				}
+				fn = func(m *vault.SecretMetadata) { m.MaxVersions = uint(n) }
+
+			case field == "cas_required":
+				b, err := strconv.ParseBool(value)
+				if err != nil {
+					return fmt.Errorf("Invalid cas_required `%s': must be true or false", value)
+				}
+				fn = func(m *vault.SecretMetadata) { m.CASRequired = b }
+
+			case field == "delete_version_after":
+				d, err := time.ParseDuration(value)
+				if err != nil {
+					return fmt.Errorf("Invalid delete_version_after `%s': %s", value, err)
+				}
+				fn = func(m *vault.SecretMetadata) { m.DeleteVersionAfter = d.String() }
+
+			case strings.HasPrefix(field, "custom.") && len(field) > len("custom."):
+				key := strings.TrimPrefix(field, "custom.")
+				fn = func(m *vault.SecretMetadata) {
+					if m.CustomMetadata == nil {
+						m.CustomMetadata = map[string]string{}
+					}
+					if value == "" {
+						delete(m.CustomMetadata, key)
+					} else {
+						m.CustomMetadata[key] = value
+					}
+				}
+
+			default:
+				return fmt.Errorf("Unknown metadata field `%s'", field)
+			}
+
+			updates = append(updates, fn)
+		}
+
+		v := connect(true)
+		paths := []string{path}
+		if opt.Meta.Recurse {
+			secrets, err := v.ConstructSecrets(path, vault.TreeOpts{SkipVersionInfo: true, AllowDeletedSecrets: true})
+			if err != nil {
+				return err
+			}
+			paths = secrets.Paths()
+		}
+
+		out := yaml.MapSlice{}
+		for _, p := range paths {
+			m, err := v.Metadata(p)
+			if err != nil {
+				return err
+			}
+
+			if len(assignments) == 0 {
+				out = append(out, yaml.MapItem{Key: p, Value: metadataYAML(m)})
+				continue
+			}
+
+			for _, fn := range updates {
+				fn(m)
+			}
+			if err = v.SetMetadata(p, *m); err != nil {
+				return err
+			}
+			if !opt.Quiet {
+				fmt.Fprintf(os.Stderr, "updated metadata of @C{%s}\n", p)
+			}
+		}
+
+		if len(assignments) == 0 {
+			b, err := yaml.Marshal(out)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s", string(b))
+		}
+		return nil
+	})
+
 	r.Dispatch("ls", &Help{
 		Summary: "Print the keys and sub-directories at one or more paths",
 		Usage:   "safe ls [-1|-q] [PATH ...]",
@@ -2110,6 +2496,9 @@ will not inspect each key in a v1 v2 mount backend to see if it has been marked
 as deleted. This may cause keys which would 404 in an attempt to read them to
 appear in the tree, but is often considerably quicker for larger vaults. This
 flag does nothing for kv v1 mounts.
+
+Each branch of the tree is printed as soon as all of it has been found, so the
+tree starts printing before the whole of it has been walked.
 `,
 	}, func(command string, args ...string) error {
 		rc.Apply(opt.UseTarget)
@@ -2123,26 +2512,34 @@ flag does nothing for kv v1 mounts.
 		r2, _ := regexp.Compile("^└")
 		v := connect(true)
 		for i, path := range args {
-			secrets, err := v.ConstructSecrets(path, vault.TreeOpts{
+			//Draw each branch as soon as the walk has found all of it, rather
+			// than waiting for the whole tree
+			first := true
+			drawer := vault.NewTreeDrawer(path, fmt.CanColorize(os.Stdout), !opt.Tree.HideLeaves, func(line string) {
+				if first && i > 0 {
+					first = false
+					return // Drop root '.' from subsequent paths
+				}
+				first = false
+				if i < len(args)-1 {
+					line = r1.ReplaceAllString(r2.ReplaceAllString(line, "├"), "│")
+				}
+				fmt.Printf("%s\n", line)
+			})
+			err := v.Walk(path, vault.TreeOpts{
 				FetchKeys:           opt.Tree.ShowKeys,
 				AllowDeletedSecrets: opt.Tree.Quick,
+				Ordered:             true,
+			}, func(secret vault.SecretEntry) error {
+				drawer.Add(secret)
+				return nil
 			})
-
 			if err != nil {
 				return err
 			}
-			lines := strings.Split(secrets.Draw(path, fmt.CanColorize(os.Stdout), !opt.Tree.HideLeaves), "\n")
-			if i > 0 {
-				lines = lines[1:] // Drop root '.' from subsequent paths
-			}
-			if i < len(args)-1 {
-				lines = lines[:len(lines)-1]
-			}
-			for _, line := range lines {
-				if i < len(args)-1 {
-					line = r1.ReplaceAllString(r2.ReplaceAllString(line, "├"), "│")
-				}
-				fmt.Printf("%s\n", line)
+			drawer.Close()
+			if i == len(args)-1 {
+				fmt.Printf("\n")
 			}
 		}
 		return nil
@@ -2159,6 +2556,9 @@ safe will not inspect each key in a v1 v2 mount backend to see if it has been
 marked as deleted. This may cause keys which would 404 in an attempt to read
 them to appear in the tree, but is often considerably quicker for larger
 vaults. This flag does nothing for kv v1 mounts.
+
+Paths are printed in order as soon as they are found, so large trees start
+printing straight away.
 `}, func(command string, args ...string) error {
 		rc.Apply(opt.UseTarget)
 		if len(args) < 1 {
@@ -2166,72 +2566,473 @@ vaults. This flag does nothing for kv v1 mounts.
 		}
 		v := connect(true)
 		for _, path := range args {
-			secrets, err := v.ConstructSecrets(path, vault.TreeOpts{
+			//Print each path as soon as everything before it has been found,
+			// rather than waiting for the whole tree
+			found := 0
+			err := v.Walk(path, vault.TreeOpts{
 				FetchKeys:           opt.Paths.ShowKeys,
 				AllowDeletedSecrets: opt.Paths.Quick,
 				SkipVersionInfo:     !opt.Paths.ShowKeys,
+				Ordered:             true,
+			}, func(secret vault.SecretEntry) error {
+				for _, p := range (vault.Secrets{secret}).Paths() {
+					fmt.Printf("%s\n", p)
+					found++
+				}
+				return nil
 			})
 			if err != nil {
 				return err
 			}
-
-			fmt.Printf(strings.Join(secrets.Paths(), "\n"))
-			fmt.Printf("\n")
+			if found == 0 {
+				fmt.Printf("\n")
+			}
 		}
 		return nil
 	})
 
-	r.Dispatch("delete", &Help{
-		Summary: "Remove one or more path from the Vault",
-		Usage:   "safe delete [-rfDa] PATH [PATH ...]",
-		Type:    DestructiveCommand,
+	r.Dispatch("grep", &Help{
+		Summary: "Search secrets for paths, keys or values matching a pattern",
+		Usage:   "safe grep [-r] [--keys-only|--paths-only|--values] [--invert] PATH [PATH ...] PATTERN",
+		Type:    NonDestructiveCommand,
 		Description: `
--d (--destroy) will cause KV v2 secrets to be destroyed instead of
-being marked as deleted. For KV v1 backends, this would do nothing.
--a (--all) will delete (or destroy) all versions of the secret instead
-of just the specified (or latest if unspecified) version.
-`}, func(command string, args ...string) error {
+Searches the secrets at each PATH for keys whose path, name or value matches
+PATTERN, a regular expression, and prints the matching keys as path:key, one
+per line.  Only the latest version of each secret is searched.
+
+If -r is given, each PATH is searched recursively.  Otherwise, each PATH must
+be a secret.
+
+The following options are recognized:
+
+  -r, --recurse  Search every secret underneath each PATH.
+
+  --keys-only    Only match PATTERN against the names of keys.
+
+  --paths-only   Only match PATTERN against the paths of secrets, and print
+                 the matching paths instead of their keys.
+
+  --values       Only match PATTERN against the values of keys, and print
+                 those values alongside the keys.  Everything but the parts
+                 of each value that matched PATTERN is masked out.
+
+  --invert       Print the keys (or paths) that do not match, instead of
+                 the ones that do.
+
+safe grep exits 0 if anything was selected, and 1 otherwise.
+`,
+	}, func(command string, args ...string) error {
 		rc.Apply(opt.UseTarget)
+		if len(args) < 2 {
+			r.ExitWithUsage("grep")
+		}
 
-		if len(args) < 1 {
-			r.ExitWithUsage("delete")
+		modes := 0
+		for _, set := range []bool{opt.Grep.KeysOnly, opt.Grep.PathsOnly, opt.Grep.Values} {
+			if set {
+				modes++
+			}
+		}
+		if modes > 1 {
+			return fmt.Errorf("Only one of --keys-only, --paths-only and --values can be specified")
 		}
-		v := connect(true)
 
-		verb := "delete"
-		if opt.Delete.Destroy {
-			verb = "destroy"
+		pattern, err := regexp.Compile(args[len(args)-1])
+		if err != nil {
+			return fmt.Errorf("Invalid pattern `%s': %s", args[len(args)-1], err)
 		}
+		args = args[:len(args)-1]
 
+		v := connect(true)
+		secrets := vault.Secrets{}
 		for _, path := range args {
-			_, key, version := vault.ParsePath(path)
+			if vault.PathHasKey(path) {
+				return fmt.Errorf("Cannot grep path with key (%s)", path)
+			}
+			if vault.PathHasVersion(path) {
+				return fmt.Errorf("Cannot grep path with version (%s)", path)
+			}
 
-			//Ignore -r if path has a version or key because that seems like a mistake
-			if opt.Delete.Recurse && (key == "" || version > 0) {
-				if !opt.Delete.Force && !recursively(verb, path) {
-					continue /* skip this command, process the next */
-				}
-				if err := v.DeleteTree(path, vault.DeleteOpts{
-					Destroy: opt.Delete.Destroy,
-					All:     opt.Delete.All,
-				}); err != nil && !(vault.IsNotFound(err) && opt.Delete.Force) {
-					return err
-				}
-			} else {
-				if err := v.Delete(path, vault.DeleteOpts{
-					Destroy: opt.Delete.Destroy,
-					All:     opt.Delete.All,
-				}); err != nil && !(vault.IsNotFound(err) && opt.Delete.Force) {
-					return err
-				}
+			theseSecrets, err := v.ConstructSecrets(path, vault.TreeOpts{
+				FetchKeys: true,
+				GetOnly:   !opt.Grep.Recurse,
+			})
+			if err != nil {
+				return err
 			}
+			secrets = secrets.Merge(theseSecrets)
 		}
-		return nil
-	})
 
-	r.Dispatch("undelete", &Help{
-		Summary: "Undelete a soft-deleted secret from a V2 backend",
-		Usage:   "safe undelete PATH [PATH ...]",
+		found := false
+		if opt.Grep.PathsOnly {
+			for _, s := range secrets {
+				if pattern.MatchString(s.Path) != opt.Grep.Invert {
+					fmt.Printf("%s\n", s.Path)
+					found = true
+				}
+			}
+		} else {
+			matches := secrets.Grep(pattern, vault.GrepOpts{
+				Paths:  modes == 0,
+				Keys:   modes == 0 || opt.Grep.KeysOnly,
+				Values: modes == 0 || opt.Grep.Values,
+				Invert: opt.Grep.Invert,
+			})
+			for _, m := range matches {
+				if opt.Grep.Values {
+					fmt.Printf("%s:%s: %s\n", m.Path, m.Key, m.Mask())
+				} else {
+					fmt.Printf("%s:%s\n", m.Path, m.Key)
+				}
+			}
+			found = len(matches) > 0
+		}
+
+		if !found {
+			os.Exit(1)
+		}
+		return nil
+	})
+
+	r.Dispatch("diff", &Help{
+		Summary: "Compare two secrets or subtrees, possibly on different targets",
+		Usage:   "safe diff [--reveal] [TARGET:]PATH [TARGET:]PATH",
+		Type:    NonDestructiveCommand,
+		Description: `
+Compares the secrets under the first PATH with the secrets under the second,
+and shows which paths and keys were added, removed or changed.  Paths are
+matched up relative to the PATH given on each side, so this can compare two
+single secrets, like secret/staging/db and secret/prod/db, or two entire
+subtrees.
+
+Either PATH can be prefixed with the alias of a Vault target, followed by a
+colon, to read it from that Vault instead of the current target.  This makes it
+possible to compare the same subtree on two different Vaults:
+
+    safe diff staging:secret/app prod:secret/app
+
+Paths in the output are relative to the PATHs being compared; the secret at
+PATH itself is shown as '.'.  Values are masked by default, so that only the
+names of the changed keys are shown.
+
+The following options are recognized:
+
+  --reveal   Show the values of added, removed and changed keys.
+
+safe diff exits 0 if there are no differences, and 1 if there are.
+`,
+	}, func(command string, args ...string) error {
+		cfg := rc.Apply(opt.UseTarget)
+		if len(args) != 2 {
+			r.ExitWithUsage("diff")
+		}
+
+		var roots [2]string
+		var sides [2]vault.Secrets
+		missing := 0
+		for i := range args {
+			target, path := opt.UseTarget, args[i]
+			if alias, p := splitTargetPath(cfg, args[i]); alias != "" {
+				target, path = alias, p
+			}
+
+			if vault.PathHasKey(path) {
+				return fmt.Errorf("Cannot diff path with key (%s)", path)
+			}
+			if vault.PathHasVersion(path) {
+				return fmt.Errorf("Cannot diff path with version (%s)", path)
+			}
+
+			v := connectTo(target)
+			secrets, err := v.ConstructSecrets(path, vault.TreeOpts{FetchKeys: true})
+			if err != nil {
+				if !vault.IsNotFound(err) {
+					return err
+				}
+				missing++
+				if missing == len(args) {
+					return err
+				}
+			}
+
+			roots[i], sides[i] = path, secrets
+		}
+
+		diffs := sides[0].Diff(roots[0], sides[1], roots[1], vault.DiffOpts{})
+
+		fmt.Printf("@R{--- %s}\n", args[0])
+		fmt.Printf("@G{+++ %s}\n", args[1])
+		for _, d := range diffs {
+			name := d.Path
+			if name == "" {
+				name = "."
+			}
+
+			switch d.State {
+			case vault.DiffAdded:
+				fmt.Printf("@G{+ %s}\n", name)
+			case vault.DiffRemoved:
+				fmt.Printf("@R{- %s}\n", name)
+			default:
+				fmt.Printf("@Y{~ %s}\n", name)
+			}
+
+			for _, k := range d.Keys {
+				switch {
+				case k.State == vault.DiffAdded && opt.Diff.Reveal:
+					fmt.Printf("    @G{+ %s:} %s\n", k.Key, k.Right)
+				case k.State == vault.DiffAdded:
+					fmt.Printf("    @G{+ %s}\n", k.Key)
+				case k.State == vault.DiffRemoved && opt.Diff.Reveal:
+					fmt.Printf("    @R{- %s:} %s\n", k.Key, k.Left)
+				case k.State == vault.DiffRemoved:
+					fmt.Printf("    @R{- %s}\n", k.Key)
+				case k.State == vault.DiffChanged && opt.Diff.Reveal:
+					fmt.Printf("    @R{- %s:} %s\n", k.Key, k.Left)
+					fmt.Printf("    @G{+ %s:} %s\n", k.Key, k.Right)
+				case k.State == vault.DiffChanged:
+					fmt.Printf("    @Y{~ %s}\n", k.Key)
+				}
+			}
+		}
+
+		if len(diffs) > 0 {
+			os.Exit(1)
+		}
+		return nil
+	})
+
+	r.Dispatch("sync", &Help{
+		Summary: "Replicate a subtree from one Vault to another",
+		Usage:   "safe sync [-adpy] [TARGET:]SRC-PATH [TARGET:]DST-PATH",
+		Type:    DestructiveCommand,
+		Description: `
+Makes the secrets under DST-PATH look like the secrets under SRC-PATH.  Either
+path can be prefixed with the alias of a Vault target, followed by a colon, to
+use that Vault instead of the current target:
+
+    safe sync staging:secret/app prod:secret/app
+
+Before anything is written, safe prints a plan of the secrets it will create,
+update and delete at the destination, and asks for confirmation.
+
+Normally, only the latest version of each secret is replicated, and it is
+written as a new version of the destination secret.
+
+Both subtrees are walked side by side, so only the secrets that need to be
+written are held in memory, rather than either subtree as a whole.
+
+The following options are recognized:
+
+  -a, --all      Replicate every version of each secret, replacing the
+                 history of the secret at the destination.  The destination
+                 must be a KV v2 mount.
+
+  -d, --deleted  With --all, undelete, read, and then redelete deleted
+                 versions at the source, so that their values can be
+                 replicated.  Without this, deleted versions are replicated
+                 as destroyed ones.
+
+  -p, --prune    Delete secrets under DST-PATH that do not exist under
+                 SRC-PATH.  With --all, these are destroyed.
+
+  -y, --yes      Apply the plan without asking for confirmation.
+`,
+	}, func(command string, args ...string) error {
+		cfg := rc.Apply(opt.UseTarget)
+		if len(args) != 2 {
+			r.ExitWithUsage("sync")
+		}
+		if opt.Sync.Deleted && !opt.Sync.All {
+			return fmt.Errorf("--deleted only makes sense with --all")
+		}
+
+		var dst *vault.Vault
+		var roots [2]string
+		var sides [2]vault.DiffTree
+		for i := range args {
+			target, path := opt.UseTarget, args[i]
+			if alias, p := splitTargetPath(cfg, args[i]); alias != "" {
+				target, path = alias, p
+			}
+
+			if vault.PathHasKey(path) {
+				return fmt.Errorf("Cannot sync path with key (%s)", path)
+			}
+			if vault.PathHasVersion(path) {
+				return fmt.Errorf("Cannot sync path with version (%s)", path)
+			}
+
+			v := connectTo(target)
+			roots[i], sides[i] = vault.Canonicalize(path), vault.DiffTree{
+				Vault: v,
+				Root:  path,
+				Opts: vault.TreeOpts{
+					FetchKeys:           true,
+					FetchAllVersions:    opt.Sync.All,
+					GetDeletedVersions:  opt.Sync.Deleted && i == 0,
+					AllowDeletedSecrets: opt.Sync.All,
+				},
+				//A missing source is an error, but a missing destination
+				// just means everything needs to be created
+				AllowMissing: i == 1,
+			}
+			dst = v
+		}
+
+		if opt.Sync.All {
+			mountVersion, err := dst.MountVersion(roots[1])
+			if err != nil {
+				return fmt.Errorf("Could not determine existing mount version: %s", err)
+			}
+			if mountVersion != 2 {
+				return fmt.Errorf("Cannot sync all versions to `%s': the mount does not support versioning", roots[1])
+			}
+		}
+
+		diffs := []vault.SecretDiff{}
+		err := vault.WalkDiff(sides[1], sides[0], vault.DiffOpts{
+			AllVersions:        opt.Sync.All,
+			DeletedAsDestroyed: opt.Sync.All && !opt.Sync.Deleted,
+		}, func(d vault.SecretDiff) error {
+			if d.State == vault.DiffRemoved && !opt.Sync.Prune {
+				return nil
+			}
+			//Only the source side is needed to apply the plan
+			d.Left, d.Keys = nil, nil
+			diffs = append(diffs, d)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		destination := func(d vault.SecretDiff) string {
+			if d.Path == "" {
+				return roots[1]
+			}
+			return roots[1] + "/" + d.Path
+		}
+
+		var creates, updates, deletes int
+		fmt.Printf("Plan for syncing @C{%s} to @C{%s}:\n", args[0], args[1])
+		for _, d := range diffs {
+			switch d.State {
+			case vault.DiffAdded:
+				fmt.Printf("  @G{create} %s\n", destination(d))
+				creates++
+			case vault.DiffChanged:
+				fmt.Printf("  @Y{update} %s\n", destination(d))
+				updates++
+			case vault.DiffRemoved:
+				fmt.Printf("  @R{delete} %s\n", destination(d))
+				deletes++
+			}
+		}
+		if creates+updates+deletes == 0 {
+			fmt.Printf("@G{Nothing to do}; @C{%s} is already in sync.\n", args[1])
+			return nil
+		}
+		fmt.Printf("\n%d to create, %d to update, %d to delete.\n", creates, updates, deletes)
+
+		if !opt.Sync.Yes {
+			y := prompt.Normal("Apply these changes to @C{%s}? @Y{(y/n)} ", args[1])
+			y = strings.TrimSpace(y)
+			if y != "y" && y != "yes" {
+				return fmt.Errorf("Aborting sync; no changes were made")
+			}
+		}
+
+		for _, d := range diffs {
+			switch d.State {
+			case vault.DiffAdded, vault.DiffChanged:
+				entry := *d.Right
+				if opt.Sync.All && !opt.Sync.Deleted {
+					destroyDeletedVersions(vault.Secrets{entry})
+				}
+				if !opt.Sync.All {
+					latest := entry.LatestVersion()
+					latest.State = vault.SecretStateAlive
+					entry.Versions = []vault.SecretVersion{latest}
+				}
+				err := entry.Copy(dst, destination(d), vault.TreeCopyOpts{
+					Clear: opt.Sync.All,
+					Pad:   opt.Sync.All,
+				})
+				if err != nil {
+					return err
+				}
+
+			case vault.DiffRemoved:
+				err := dst.Delete(destination(d), vault.DeleteOpts{
+					Destroy: opt.Sync.All,
+					All:     opt.Sync.All,
+				})
+				if err != nil && !vault.IsNotFound(err) {
+					return err
+				}
+			}
+		}
+		if !opt.Quiet {
+			fmt.Fprintf(os.Stderr, "Synced @C{%s} to @C{%s}: %d created, %d updated, %d deleted.\n", args[0], args[1], creates, updates, deletes)
+		}
+		return nil
+	})
+
+	r.Dispatch("delete", &Help{
+		Summary: "Remove one or more path from the Vault",
+		Usage:   "safe delete [-rfDa] PATH [PATH ...]",
+		Type:    DestructiveCommand,
+		Description: `
+-d (--destroy) will cause KV v2 secrets to be destroyed instead of
+being marked as deleted. For KV v1 backends, this would do nothing.
+-a (--all) will delete (or destroy) all versions of the secret instead
+of just the specified (or latest if unspecified) version.
+`}, func(command string, args ...string) error {
+		rc.Apply(opt.UseTarget)
+
+		if len(args) < 1 {
+			r.ExitWithUsage("delete")
+		}
+		v := connect(true)
+
+		verb := "delete"
+		if opt.Delete.Destroy {
+			verb = "destroy"
+		}
+
+		for _, path := range args {
+			_, key, version := vault.ParsePath(path)
+
+			//Ignore -r if path has a version or key because that seems like a mistake
+			if opt.Delete.Recurse && (key == "" || version > 0) {
+				if !opt.Delete.Force && !recursively(verb, path) {
+					continue /* skip this command, process the next */
+				}
+				if err := gracefully(func() error {
+					defer showProgress("delete", opt.Quiet)()
+					return v.DeleteTree(path, vault.DeleteOpts{
+						Destroy: opt.Delete.Destroy,
+						All:     opt.Delete.All,
+					})
+				}); err != nil && !(vault.IsNotFound(err) && opt.Delete.Force) {
+					return err
+				}
+			} else {
+				if err := v.Delete(path, vault.DeleteOpts{
+					Destroy: opt.Delete.Destroy,
+					All:     opt.Delete.All,
+				}); err != nil && !(vault.IsNotFound(err) && opt.Delete.Force) {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	r.Dispatch("undelete", &Help{
+		Summary: "Undelete a soft-deleted secret from a V2 backend",
+		Usage:   "safe undelete [-rfa] PATH [PATH ...]",
 		Type:    DestructiveCommand,
 		Description: `
 If no version is specified, this attempts to undelete the newest version of the secret
@@ -2240,6 +3041,11 @@ This errors if the secret or version does not exist, of if the particular versio
 been irrevocably destroyed. An error also occurs if a key is specified.
 
 -a (--all) undeletes all versions of the given secret.
+
+-r (--recurse) undeletes every secret under the given path whose newest version
+is deleted (or, with -a, every deleted version of every secret under it).
+Secrets that are not deleted, and versions that have been destroyed, are left
+alone. -f (--force) skips asking for confirmation.
 `}, func(command string, args ...string) error {
 		rc.Apply(opt.UseTarget)
 
@@ -2250,7 +3056,16 @@ been irrevocably destroyed. An error also occurs if a key is specified.
 
 		for _, path := range args {
 			var err error
-			if opt.Undelete.All {
+			_, key, version := vault.ParsePath(path)
+			if opt.Undelete.Recurse && key == "" && version == 0 {
+				if !opt.Undelete.Force && !recursively("undelete", path) {
+					continue /* skip this command, process the next */
+				}
+				err = gracefully(func() error {
+					defer showProgress("undelete", opt.Quiet)()
+					return v.UndeleteTree(path, opt.Undelete.All)
+				})
+			} else if opt.Undelete.All {
 				secret, key, version := vault.ParsePath(path)
 				if key != "" {
 					return fmt.Errorf("Cannot undelete specific key (%s)", path)
@@ -2378,7 +3193,7 @@ redeleting them.
 
 	r.Dispatch("export", &Help{
 		Summary: "Export one or more subtrees for migration / backup purposes",
-		Usage:   "safe export [-ad] PATH [PATH ...]",
+		Usage:   "safe export [-adeSm] [--format FORMAT] [--since TIME | --since-file FILE] [--sign KEY] PATH [PATH ...]",
 		Type:    NonDestructiveCommand,
 		Description: `
 Normally, the export will get only the latest version of each secret, and encode it in a format that is backwards-
@@ -2387,11 +3202,79 @@ compatible with pre-1.0.0 versions of safe (and newer versions).
 incompatible with versions of safe prior to v1.0.0
 -d (--deleted) will cause safe to undelete, read, and then redelete deleted secrets in order to encode them in the
 backup. Without this, deleted versions will be ignored.
+-e (--encrypt) will encrypt the export with a passphrase (using scrypt and AES-256-GCM), taken from
+$SAFE_EXPORT_PASSPHRASE if it is set, or asked for otherwise. 'safe import' recognizes encrypted exports, and
+decrypts them with the same passphrase.
+--sign KEY adds a manifest with the SHA-256 digest of each secret, and of the whole export, signed with KEY, so
+that a damaged or tampered-with export can be found out ('safe verify-export', 'safe import --verify'). KEY
+is either a path and key in the Vault (secret/backups:signing-key) or a local file (@path/to/key), holding an
+Ed25519 private key (PEM or OpenSSH), or anything else to use as an HMAC-SHA256 secret. It cannot be combined
+with --stream or --format.
+-S (--stream) will write the V3 format instead: one line of JSON per secret, written out as soon as each secret has
+been read, so that the whole Vault never has to be held in memory. It cannot be combined with --encrypt.
+-m (--metadata) will also export the KV v2 metadata of each secret (max_versions, cas_required,
+delete_version_after and custom_metadata), and when each version was created and deleted. This uses the V4
+format, which is the V2 format with these added, and is incompatible with versions of safe that do not know it.
+'import' restores the metadata; the times are kept for the record only, since Vault sets them itself.
+
+--format FORMAT exports the latest version of each secret in a format that other tools use, instead:
+  dotenv         NAME="value" lines for a .env file. Each variable is named after the key, and the path of the
+                 secret under the PATH being exported, in SCREAMING_SNAKE_CASE, so secret/app/db:password,
+                 exported from secret/app, becomes DB_PASSWORD.
+  k8s-secret     A Kubernetes Secret manifest for each secret, with the values base64-encoded under data.
+  vault-kv-json  What 'vault kv get -format=json' prints for each secret, in a map of paths to secrets.
+
+--since TIME only exports the secrets whose latest version was written after TIME (like 2026-10-01T00:00:00Z).
+--since-file FILE does the same for the secrets that have changed since the export that last used FILE, and
+then updates FILE with the latest version of each secret. If FILE doesn't exist yet, everything is exported.
+Exports made this way also list the secrets that have been removed since, and can be applied on top of a full
+export with 'safe import --incremental'. There is no telling when secrets in KV v1 mounts were last changed,
+so they are always exported.
 `}, func(command string, args ...string) error {
 		rc.Apply(opt.UseTarget)
 		if len(args) < 1 {
 			args = append(args, "secret")
 		}
+		if opt.Export.Stream && opt.Export.Encrypt {
+			return fmt.Errorf("--stream and --encrypt cannot be used together")
+		}
+		if opt.Export.Format != "" {
+			if err := checkForeignFormat(opt.Export.Format); err != nil {
+				return err
+			}
+			if opt.Export.All || opt.Export.Stream || opt.Export.Metadata {
+				return fmt.Errorf("--format %s only exports the latest version of each secret, so it cannot be used with --all, --stream or --metadata", opt.Export.Format)
+			}
+		}
+		incremental := opt.Export.Since != "" || opt.Export.SinceFile != ""
+		if incremental {
+			if opt.Export.Since != "" && opt.Export.SinceFile != "" {
+				return fmt.Errorf("--since and --since-file cannot be used together")
+			}
+			if opt.Export.Stream || opt.Export.Format != "" {
+				return fmt.Errorf("--since and --since-file cannot be used with --stream or --format")
+			}
+		}
+
+		var signKey *signingKey
+		if opt.Export.Sign != "" {
+			if opt.Export.Stream || opt.Export.Format != "" {
+				return fmt.Errorf("--sign cannot be used with --stream or --format")
+			}
+			var err error
+			if signKey, err = loadSigningKey(opt.Export.Sign); err != nil {
+				return err
+			}
+		}
+
+		var passphrase string
+		if opt.Export.Encrypt {
+			var err error
+			if passphrase, err = exportPassphrase(true); err != nil {
+				return err
+			}
+		}
+
 		v := connect(true)
 
 		var toExport interface{}
@@ -2424,22 +3307,66 @@ backup. Without this, deleted versions will be ignored.
 			}
 		}
 
+		treeOpts := vault.TreeOpts{
+			FetchKeys:           true,
+			FetchAllVersions:    opt.Export.All,
+			GetDeletedVersions:  opt.Export.Deleted,
+			AllowDeletedSecrets: opt.Export.Deleted,
+			FetchMetadata:       opt.Export.Metadata || opt.Export.Format == "vault-kv-json",
+		}
+		//Keep out of the way of the export, if that is going to the terminal too
+		stopProgress := showProgress("export", opt.Quiet || isatty.IsTerminal(os.Stdout.Fd()))
+		defer stopProgress()
+		if opt.Export.Stream {
+			return streamExport(v, args, treeOpts, opt.Export.Shallow, os.Stdout)
+		}
+
+		var previous *exportState
+		if opt.Export.SinceFile != "" {
+			var err error
+			if previous, err = readExportState(opt.Export.SinceFile); err != nil {
+				return err
+			}
+		}
+		startedAt := time.Now()
+
 		secrets := vault.Secrets{}
 		for _, path := range args {
-			theseSecrets, err := v.ConstructSecrets(path, vault.TreeOpts{
-				FetchKeys:           true,
-				FetchAllVersions:    opt.Export.All,
-				GetDeletedVersions:  opt.Export.Deleted,
-				AllowDeletedSecrets: opt.Export.Deleted,
-			})
+			theseSecrets, err := v.ConstructSecrets(path, treeOpts)
 			if err != nil {
 				return err
 			}
 
 			secrets = secrets.Merge(theseSecrets)
 		}
+		stopProgress()
 
-		var mustV2Export bool
+		if opt.Export.Format != "" {
+			b, err := exportForeign(v, opt.Export.Format, args, secrets)
+			if err != nil {
+				return err
+			}
+			if opt.Export.Encrypt {
+				if b, err = encryptExport(b, passphrase); err != nil {
+					return err
+				}
+			}
+			fmt.Printf("%s\n", string(b))
+			return nil
+		}
+
+		var changes *exportIncremental
+		var state *exportState
+		if incremental {
+			var err error
+			secrets, changes, state, err = filterIncremental(secrets, args, opt.Export.Since, previous, startedAt)
+			if err != nil {
+				return err
+			}
+		}
+
+		//The v1 format has nowhere to put metadata, or incremental exports
+		mustV2Export := opt.Export.Metadata || incremental
 		//Determine if we can get away with a v1 export
 		for _, s := range secrets {
 			if len(s.Versions) > 1 {
@@ -2459,7 +3386,10 @@ backup. Without this, deleted versions will be ignored.
 		}
 
 		v2Export := func() error {
-			export := exportFormat{ExportVersion: 2, Data: map[string]exportSecret{}, RequiresVersioning: map[string]bool{}}
+			export := exportFormat{ExportVersion: 2, Data: map[string]exportSecret{}, RequiresVersioning: map[string]bool{}, Incremental: changes}
+			if opt.Export.Metadata {
+				export.ExportVersion = 4
+			}
 
 			for _, secret := range secrets {
 				if len(secret.Versions) > 1 {
@@ -2467,32 +3397,12 @@ backup. Without this, deleted versions will be ignored.
 					export.RequiresVersioning[mount] = true
 				}
 
-				thisSecret := exportSecret{FirstVersion: secret.Versions[0].Number}
-				//We want to omit the `first` key in the json if it's 1
-				if thisSecret.FirstVersion == 1 || opt.Export.Shallow {
-					thisSecret.FirstVersion = 0
-				}
-
-				for _, version := range secret.Versions {
-					thisVersion := exportVersion{
-						Deleted:   version.State == vault.SecretStateDeleted && opt.Export.Deleted,
-						Destroyed: version.State == vault.SecretStateDestroyed || (version.State == vault.SecretStateDeleted && !opt.Export.Deleted),
-						Value:     map[string]string{},
-					}
-
-					for _, key := range version.Data.Keys() {
-						thisVersion.Value[key] = version.Data.Get(key)
-					}
-
-					thisSecret.Versions = append(thisSecret.Versions, thisVersion)
-				}
-
-				export.Data[secret.Path] = thisSecret
-
-				//Wrap export in array so that older versions of safe don't try to import this improperly.
-				toExport = []exportFormat{export}
+				export.Data[secret.Path] = toExportSecret(secret, opt.Export.Deleted, opt.Export.Shallow)
 			}
 
+			//Wrap export in array so that older versions of safe don't try to import this improperly.
+			toExport = []exportFormat{export}
+
 			return nil
 		}
 
@@ -2510,53 +3420,241 @@ backup. Without this, deleted versions will be ignored.
 		if err != nil {
 			return err
 		}
+		if signKey != nil {
+			if b, err = signExport(b, signKey); err != nil {
+				return err
+			}
+		}
+		if opt.Export.Encrypt {
+			if b, err = encryptExport(b, passphrase); err != nil {
+				return err
+			}
+		}
 		fmt.Printf("%s\n", string(b))
 
+		//Only once the export is out the door is it safe to move on
+		if state != nil && opt.Export.SinceFile != "" {
+			return state.write(opt.Export.SinceFile)
+		}
 		return nil
 	})
 
 	r.Dispatch("import", &Help{
 		Summary: "Import name/value pairs into the current Vault",
-		Usage:   "safe import <backup/file.json",
+		Usage:   "safe import [--plan] [--rebase OLD=NEW] [--format FORMAT [PATH]] <backup/file.json\n       safe import [--plan] --from keepass|bitwarden|pass FILE PATH\n       safe import [--plan] [--rebase OLD=NEW] --incremental BASE INCREMENTAL...",
 		Type:    DestructiveCommand,
 		Description: `
+Exports made with 'safe export --encrypt' are decrypted automatically, with the passphrase taken from
+$SAFE_EXPORT_PASSPHRASE if it is set, or asked for on the terminal otherwise.
+Exports made with 'safe export --sign' are always checked against their manifest before anything is written.
+--verify KEY checks the signature as well, and refuses to import exports that are not signed with KEY (or, for
+Ed25519, with the private half of it). KEY is given the same way as for 'safe export --sign'.
 -I (--ignore-destroyed) will keep destroyed versions from being replicated in the import by
 rting garbage data and then destroying it (which is originally done to preserve version numbering).
 -i (--ignore-deleted) will ignore deleted versions from being written during the import.
 -s (--shallow) will write only the latest version for each secret.
+
+Exports in the V3 format (from 'safe export --stream') are read and written one secret at a time, by several
+writers at once.
+--workers N (or $SAFE_WORKERS) sets how many secrets are written at once. Defaults to 4.
+--resume-from FILE keeps track of which secrets have been written in FILE. If the import fails partway through,
+running it again with the same FILE skips the secrets that were already written.
+
+--plan will not write anything, but instead compares the export with the Vault, and prints which secrets would be
+created or overwritten (and so have all of their existing versions destroyed), along with which versions would be
+written as padding (to keep the version numbers the same), deleted, or destroyed. Secrets that are already exactly
+as the export has them are only counted.
+--rebase OLD=NEW imports secrets exported from under OLD to the same place under NEW instead, e.g.
+--rebase secret/staging/=secret/production/. Can be given more than once; the longest OLD that matches wins.
+
+--format FORMAT imports secrets in a format that other tools use, instead (see 'safe export'). Like V1 exports,
+these are written on top of whatever is already there.
+  dotenv         Every variable in the .env file becomes a key of the secret at PATH.
+  k8s-secret     Kubernetes Secret manifests (and Lists of them). Secrets exported by safe go back where they
+                 came from; others go in PATH/NAME.
+  vault-kv-json  A map of paths to what 'vault kv get -format=json' prints, or what it prints for one secret,
+                 which goes to PATH.
+
+--incremental imports a full export, BASE, with the incremental exports made after it (by 'safe export --since'
+or 'safe export --since-file') applied on top, in order. The latest copy of each secret is imported, and
+secrets that were removed along the way are left out.
+
+--from MANAGER imports everything in FILE, an export from a password manager, to PATH. Folders (or groups)
+become paths under PATH, and each entry becomes a secret, with username, password, url and notes keys, plus
+any custom fields it has. --plan works here too, and --no-clobber leaves alone any key that is already set.
+  keepass    A KeePass 2.x XML export. The recycle bin, and the history of each entry, are left out.
+  bitwarden  An unencrypted Bitwarden JSON export (of a vault or an organization).
+  pass       The password store itself (e.g. ~/.password-store). Each entry is decrypted with gpg; the first
+             line is the password, lines like 'login: jhunt' become keys, and the rest become the notes.
 `}, func(command string, args ...string) error {
 		rc.Apply(opt.UseTarget)
-		b, err := ioutil.ReadAll(os.Stdin)
-		if err != nil {
+		if opt.Import.From != "" {
+			if len(args) != 2 {
+				r.ExitWithUsage("import")
+			}
+			entries, err := readPasswordManager(opt.Import.From, args[0])
+			if err != nil {
+				return err
+			}
+
+			v := connect(true)
+			var plan *importPlan
+			if opt.Import.Plan {
+				plan = &importPlan{v: v}
+				fmt.Printf("Plan for importing:\n")
+			}
+			err = importPasswordEntries(v, vault.Canonicalize(args[1]), entries, plan, opt.SkipIfExists, opt.Quiet)
+			if err == nil && plan != nil {
+				plan.print()
+			}
 			return err
 		}
+		if opt.SkipIfExists {
+			fmt.Fprintf(os.Stderr, "@R{!!} @C{--no-clobber} @R{is incompatible with} @C{safe import}\n")
+			r.ExitWithUsage("import")
+		}
+		if opt.Import.Format != "" {
+			if err := checkForeignFormat(opt.Import.Format); err != nil {
+				return err
+			}
+			if len(args) > 1 {
+				r.ExitWithUsage("import")
+			}
+			if opt.Import.Verify != "" {
+				return fmt.Errorf("--verify cannot be used with --format")
+			}
+		}
+
+		importOptions := importOpts{
+			IgnoreDestroyed: opt.Import.IgnoreDestroyed,
+			IgnoreDeleted:   opt.Import.IgnoreDeleted,
+			Shallow:         opt.Import.Shallow,
+			Quiet:           opt.Quiet,
+		}
+		rebases, err := parseRebases(opt.Import.Rebase)
 		if err != nil {
 			return err
 		}
+		importOptions.Rebase = rebases
+		if opt.Import.Plan {
+			importOptions.Plan = &importPlan{opts: importOptions}
+		}
+		var verifyKey *signingKey
+		if opt.Import.Verify != "" {
+			if verifyKey, err = loadSigningKey(opt.Import.Verify); err != nil {
+				return err
+			}
+		}
 
-		if opt.SkipIfExists {
-			fmt.Fprintf(os.Stderr, "@R{!!} @C{--no-clobber} @R{is incompatible with} @C{safe import}\n")
-			r.ExitWithUsage("import")
+		var b []byte
+		if opt.Import.Incremental {
+			if len(args) == 0 || opt.Import.Format != "" {
+				r.ExitWithUsage("import")
+			}
+			if opt.Import.ResumeFrom != "" {
+				return fmt.Errorf("--resume-from can only be used when importing a V3 export (from 'safe export --stream')")
+			}
+			if b, err = chainExports(args, verifyKey); err != nil {
+				return err
+			}
+		} else {
+			//V3 exports announce themselves on the first line, and are read a
+			// secret at a time from there on. Anything else is read in whole.
+			in := bufio.NewReader(os.Stdin)
+			b, err = in.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if isStreamedExport(b) && opt.Import.Format == "" {
+				if verifyKey != nil {
+					return fmt.Errorf("V3 exports (from 'safe export --stream') cannot be signed, so they cannot be verified")
+				}
+				v := connect(true)
+				checkpoint, err := openImportCheckpoint(opt.Import.ResumeFrom)
+				if err != nil {
+					return err
+				}
+				defer checkpoint.Close()
+				if importOptions.Plan != nil {
+					importOptions.Plan.v = v
+					fmt.Printf("Plan for importing:\n")
+				}
+				//Unlike walking a tree, this doesn't default to a worker per CPU
+				workers, _ := strconv.Atoi(os.Getenv("SAFE_WORKERS"))
+				if workers < 1 {
+					workers = 4
+				}
+				return gracefully(func() error {
+					defer showProgress("import", opt.Quiet)()
+					return streamImport(v, in, importOptions, workers, checkpoint)
+				})
+			}
+			if opt.Import.ResumeFrom != "" {
+				return fmt.Errorf("--resume-from can only be used when importing a V3 export (from 'safe export --stream')")
+			}
+
+			rest, err := ioutil.ReadAll(in)
+			if err != nil {
+				return err
+			}
+			b = append(b, rest...)
+
+			if isEncryptedExport(b) {
+				passphrase, err := exportPassphrase(false)
+				if err != nil {
+					return err
+				}
+				if b, err = decryptExport(b, passphrase); err != nil {
+					return err
+				}
+			}
+			if opt.Import.Format == "" {
+				if b, err = unwrapSignedExport(b, verifyKey); err != nil {
+					return err
+				}
+			}
 		}
 
 		v := connect(true)
 
 		type importFunc func([]byte) error
 
-		v1Import := func(input []byte) error {
-			var data map[string]*vault.Secret
-			err := json.Unmarshal(input, &data)
+		//Writes each secret on top of whatever is there, several at once
+		writeSecrets := func(data map[string]*vault.Secret) error {
+			paths, from, err := importOptions.rebaseAll(sortedKeys(data))
 			if err != nil {
 				return err
 			}
-			for path, s := range data {
-				err = v.Write(path, s)
-				if err != nil {
+			if importOptions.Plan != nil {
+				for _, path := range paths {
+					s := data[from[path]]
+					exported := exportSecret{Versions: []exportVersion{{Value: map[string]string{}}}}
+					for _, key := range s.Keys() {
+						exported.Versions[0].Value[key] = s.Get(key)
+					}
+					if err := importOptions.Plan.add(path, exported, false); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+
+			return v.ForEachPath(paths, func(path string) error {
+				if err := v.Write(path, data[from[path]]); err != nil {
 					return err
 				}
-				fmt.Fprintf(os.Stderr, "wrote %s\n", path)
+				notef("wrote %s\n", path)
+				return nil
+			})
+		}
+
+		v1Import := func(input []byte) error {
+			var data map[string]*vault.Secret
+			err := json.Unmarshal(input, &data)
+			if err != nil {
+				return err
 			}
-			return nil
+			return writeSecrets(data)
 		}
 
 		v2Import := func(input []byte) error {
@@ -2571,82 +3669,76 @@ rting garbage data and then destroying it (which is originally done to preserve
 			}
 
 			data := unmarshalTarget[0]
+			paths := make([]string, 0, len(data.Data))
+			for path := range data.Data {
+				paths = append(paths, path)
+			}
+			sort.Slice(paths, func(i, j int) bool { return vault.PathLessThan(paths[i], paths[j]) })
 
 			if !opt.Import.Shallow {
-				//Verify that the mounts that require versioning actually support it. We
-				//can't really detect if v1 mounts exist at this stage unless we assume
-				//the token given has mount listing privileges. Not a big deal, because
-				//it will become very apparent once we start trying to put secrets in it
-				for mount, needsVersioning := range data.RequiresVersioning {
-					if needsVersioning {
-						mountVersion, err := v.MountVersion(mount)
-						if err != nil {
-							return fmt.Errorf("Could not determine existing mount version: %s", err)
-						}
-
-						if mountVersion != 2 {
-							return fmt.Errorf("Export for mount `%s' has secrets with multiple versions, but the mount either\n"+
-								"does not exist or does not support versioning", mount)
+				//Verify that the mounts that require versioning actually support it,
+				//before anything is written. The export says which mounts those were
+				//when it was made, but --rebase can put secrets in other mounts, so
+				//look at where each secret with more than one version is going.
+				mounts := newVersioningCheck(v)
+				for _, path := range paths {
+					if len(data.Data[path].Versions) > 1 {
+						if err := mounts.check(importOptions.rebase(path)); err != nil {
+							return err
 						}
 					}
 				}
 			}
 
-			//Put the secrets in the places, writing the versions in the correct order and deleting/destroying secrets that
-			// need to be deleted/destroyed.
-			for path, secret := range data.Data {
-				s := vault.SecretEntry{
-					Path: path,
-				}
-
-				firstVersion := secret.FirstVersion
-				if firstVersion == 0 {
-					firstVersion = 1
-				}
-
-				if opt.Import.Shallow {
-					secret.Versions = secret.Versions[len(secret.Versions)-1:]
-				}
-				for i := range secret.Versions {
-					state := vault.SecretStateAlive
-					if secret.Versions[i].Destroyed {
-						if opt.Import.IgnoreDestroyed {
-							continue
-						}
-						state = vault.SecretStateDestroyed
-					} else if secret.Versions[i].Deleted {
-						if opt.Import.IgnoreDeleted {
-							continue
-						}
-						state = vault.SecretStateDeleted
-					}
-					data := vault.NewSecret()
-					for k, v := range secret.Versions[i].Value {
-						data.Set(k, v, false)
+			rebased, from, err := importOptions.rebaseAll(paths)
+			if err != nil {
+				return err
+			}
+			if importOptions.Plan != nil {
+				for _, path := range rebased {
+					if err := importOptions.Plan.add(path, data.Data[from[path]], true); err != nil {
+						return err
 					}
-					s.Versions = append(s.Versions, vault.SecretVersion{
-						Number: firstVersion + uint(i),
-						State:  state,
-						Data:   data,
-					})
 				}
+				return nil
+			}
 
+			//Put the secrets in the places, several at once, writing the versions of each in the correct order and
+			// deleting/destroying secrets that need to be deleted/destroyed.
+			return v.ForEachPath(rebased, func(path string) error {
+				secret := data.Data[from[path]]
+				s := fromExportSecret(path, secret, importOptions)
 				err := s.Copy(v, s.Path, vault.TreeCopyOpts{
 					Clear: true,
-					Pad:   !(opt.Import.IgnoreDestroyed || opt.Import.Shallow),
+					Pad:   importOptions.pad(),
 				})
 				if err != nil {
 					return err
 				}
-			}
+				return restoreMetadata(v, path, secret.Metadata)
+			})
+		}
 
-			return nil
+		foreignImport := func(input []byte) error {
+			var path string
+			if len(args) == 1 {
+				path = vault.Canonicalize(args[0])
+			}
+			data, err := importForeign(opt.Import.Format, input, path)
+			if err != nil {
+				return err
+			}
+			return writeSecrets(data)
 		}
 
 		var fn importFunc
 		//determine which version of the export format this is
 		var typeTest interface{}
-		json.Unmarshal(b, &typeTest)
+		if opt.Import.Format != "" {
+			fn = foreignImport
+		} else {
+			json.Unmarshal(b, &typeTest)
+		}
 		switch v := typeTest.(type) {
 		case map[string]interface{}:
 			fn = v1Import
@@ -2654,7 +3746,8 @@ rting garbage data and then destroying it (which is originally done to preserve
 			if len(v) == 1 {
 				if meta, isMap := (v[0]).(map[string]interface{}); isMap {
 					version, isFloat64 := meta["export_version"].(float64)
-					if isFloat64 && version == 2 {
+					//v4 is v2 with metadata
+					if isFloat64 && (version == 2 || version == 4) {
 						fn = v2Import
 					}
 				}
@@ -2665,25 +3758,120 @@ rting garbage data and then destroying it (which is originally done to preserve
 			return fmt.Errorf("Unknown export file format - aborting")
 		}
 
-		return fn(b)
+		if importOptions.Plan != nil {
+			importOptions.Plan.v = v
+			fmt.Printf("Plan for importing:\n")
+			if err = fn(b); err != nil {
+				return err
+			}
+			importOptions.Plan.print()
+			return nil
+		}
+		return gracefully(func() error {
+			defer showProgress("import", opt.Quiet)()
+			return fn(b)
+		})
+	})
+
+	r.Dispatch("verify-export", &Help{
+		Summary: "Check a signed export for damage or tampering",
+		Usage:   "safe verify-export [--key KEY] FILE",
+		Type:    NonDestructiveCommand,
+		Description: `
+Checks each secret in FILE, an export made with 'safe export --sign', against the manifest, and the export as a
+whole against its digest. Encrypted exports are decrypted first, with the passphrase taken from
+$SAFE_EXPORT_PASSPHRASE, or asked for.
+
+--key KEY checks the signature on the manifest, as well. KEY is given the same way as for 'safe export --sign';
+for Ed25519, the public key is enough (as a PEM file, or an ssh-ed25519 line), so exports can be checked
+without a Vault at all.
+`}, func(command string, args ...string) error {
+		rc.Apply(opt.UseTarget)
+		if len(args) != 1 {
+			r.ExitWithUsage("verify-export")
+		}
+
+		var key *signingKey
+		if opt.VerifyExport.Key != "" {
+			var err error
+			if key, err = loadSigningKey(opt.VerifyExport.Key); err != nil {
+				return err
+			}
+		}
+
+		b, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		if isEncryptedExport(b) {
+			passphrase, err := exportPassphrase(false)
+			if err != nil {
+				return err
+			}
+			if b, err = decryptExport(b, passphrase); err != nil {
+				return err
+			}
+		}
+		if !isSignedExport(b) {
+			return fmt.Errorf("`%s' is not a signed export (from 'safe export --sign')", args[0])
+		}
+
+		_, manifest, err := verifyExport(b, key)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("@G{%s is intact}: %d secrets, sha256 digest %s\n", args[0], len(manifest.Secrets), manifest.Digest)
+		if key == nil {
+			fmt.Printf("@Y{The signature was not checked}; give --key to check it, too.\n")
+		} else {
+			fmt.Printf("@G{The signature is valid} (%s).\n", manifest.Algorithm)
+		}
+		return nil
 	})
 
 	r.Dispatch("move", &Help{
 		Summary: "Move a secret from one path to another",
-		Usage:   "safe move [-rfd] OLD-PATH NEW-PATH",
+		Usage:   "safe move [-rfd] [--history MODE] OLD-PATH NEW-PATH",
 		Type:    DestructiveCommand,
 		Description: `
 Specifying the --deep (-d) flag will cause versions to be grabbed from the source
 and overwrite all versions of the secret at the destination.
+
+--history MODE says what to do with the older versions of secrets in KV v2 mounts:
+
+  collapse  only the latest version is moved (the default, without --deep)
+  preserve  every version is moved, and version numbers are kept (the same as --deep);
+            the destination has to be in a KV v2 mount too
+  refuse    only the latest version is moved, and secrets with older versions are not
+            moved at all, so that no history is lost
+
+As moving a secret deletes it from OLD-PATH, secrets with older versions are not moved
+into a KV v1 mount, which cannot keep them, unless --history collapse is given.
+
+The KV version of the mounts on each side is checked before anything is written, so
+history is never dropped or mangled by accident when moving between a KV v1 and a KV v2
+mount.
 `}, func(command string, args ...string) error {
 		rc.Apply(opt.UseTarget)
 		if len(args) != 2 {
 			r.ExitWithUsage("move")
 		}
 
+		history, err := vault.ParseHistoryMode(opt.Move.History)
+		if err != nil {
+			return err
+		}
+		deep := opt.Move.Deep || history == vault.HistoryPreserve
+		//Unlike a copy, a move leaves nothing behind, so it doesn't drop older
+		// versions into a KV v1 mount, which can't hold them, unless it is told
+		// to
+		if history == vault.HistoryDefault && !deep {
+			history = vault.HistoryRefuseIntoV1
+		}
+
 		v := connect(true)
 		if vault.PathHasKey(args[0]) || vault.PathHasKey(args[1]) {
-			if opt.Move.Deep {
+			if deep {
 				return fmt.Errorf("Cannot deep copy a specific key")
 			}
 
@@ -2702,15 +3890,18 @@ and overwrite all versions of the secret at the destination.
 			if !opt.Move.Force && !recursively("move", args...) {
 				return nil /* skip this command, process the next */
 			}
-			err := v.MoveCopyTree(args[0], args[1], v.Move, vault.MoveCopyOpts{
-				SkipIfExists: opt.SkipIfExists, Quiet: opt.Quiet, Deep: opt.Move.Deep, DeletedVersions: opt.Move.Deep,
+			err := gracefully(func() error {
+				defer showProgress("move", opt.Quiet)()
+				return v.MoveCopyTree(args[0], args[1], v.Move, vault.MoveCopyOpts{
+					SkipIfExists: opt.SkipIfExists, Quiet: opt.Quiet, Deep: deep, DeletedVersions: deep, History: history,
+				})
 			})
 			if err != nil && !(vault.IsNotFound(err) && opt.Move.Force) {
 				return err
 			}
 		} else {
 			err := v.Move(args[0], args[1], vault.MoveCopyOpts{
-				SkipIfExists: opt.SkipIfExists, Quiet: opt.Quiet, Deep: opt.Move.Deep, DeletedVersions: opt.Move.Deep,
+				SkipIfExists: opt.SkipIfExists, Quiet: opt.Quiet, Deep: deep, DeletedVersions: deep, History: history,
 			})
 			if err != nil && !(vault.IsNotFound(err) && opt.Move.Force) {
 				return err
@@ -2721,21 +3912,40 @@ and overwrite all versions of the secret at the destination.
 
 	r.Dispatch("copy", &Help{
 		Summary: "Copy a secret from one path to another",
-		Usage:   "safe copy [-rfd] OLD-PATH NEW-PATH",
+		Usage:   "safe copy [-rfd] [--history MODE] OLD-PATH NEW-PATH",
 		Type:    DestructiveCommand,
 		Description: `
 Specifying the --deep (-d) flag will cause all living versions to be grabbed from the source
 and overwrite all versions of the secret at the destination.
+
+--history MODE says what to do with the older versions of secrets in KV v2 mounts:
+
+  collapse  only the latest version is copied (the default, without --deep)
+  preserve  every version is copied, and version numbers are kept (the same as --deep);
+            the destination has to be in a KV v2 mount too
+  refuse    only the latest version is copied, and secrets with older versions are not
+            copied at all, so that no history is lost
+
+The KV version of the mounts on each side is checked before anything is written, so
+history is never dropped or mangled by accident when moving between a KV v1 and a KV v2
+mount.
 `}, func(command string, args ...string) error {
 		rc.Apply(opt.UseTarget)
 
 		if len(args) != 2 {
 			r.ExitWithUsage("copy")
 		}
+
+		history, err := vault.ParseHistoryMode(opt.Copy.History)
+		if err != nil {
+			return err
+		}
+		deep := opt.Copy.Deep || history == vault.HistoryPreserve
+
 		v := connect(true)
 
 		if vault.PathHasKey(args[0]) || vault.PathHasKey(args[1]) {
-			if opt.Copy.Deep {
+			if deep {
 				return fmt.Errorf("Cannot deep copy a specific key")
 			}
 
@@ -2758,11 +3968,15 @@ and overwrite all versions of the secret at the destination.
 			if !opt.Copy.Force && !recursively("copy", args...) {
 				return nil /* skip this command, process the next */
 			}
-			err := v.MoveCopyTree(args[0], args[1], v.Copy, vault.MoveCopyOpts{
-				SkipIfExists:    opt.SkipIfExists,
-				Quiet:           opt.Quiet,
-				Deep:            opt.Copy.Deep,
-				DeletedVersions: opt.Copy.Deep,
+			err := gracefully(func() error {
+				defer showProgress("copy", opt.Quiet)()
+				return v.MoveCopyTree(args[0], args[1], v.Copy, vault.MoveCopyOpts{
+					SkipIfExists:    opt.SkipIfExists,
+					Quiet:           opt.Quiet,
+					Deep:            deep,
+					DeletedVersions: deep,
+					History:         history,
+				})
 			})
 			if err != nil && !(vault.IsNotFound(err) && opt.Copy.Force) {
 				return err
@@ -2771,8 +3985,9 @@ and overwrite all versions of the secret at the destination.
 			err := v.Copy(args[0], args[1], vault.MoveCopyOpts{
 				SkipIfExists:    opt.SkipIfExists,
 				Quiet:           opt.Quiet,
-				Deep:            opt.Copy.Deep,
-				DeletedVersions: opt.Copy.Deep,
+				Deep:            deep,
+				DeletedVersions: deep,
+				History:         history,
 			})
 			if err != nil && !(vault.IsNotFound(err) && opt.Copy.Force) {
 				return err
@@ -2782,8 +3997,8 @@ and overwrite all versions of the secret at the destination.
 	})
 
 	r.Dispatch("gen", &Help{
-		Summary: "Generate a random password",
-		Usage:   "safe gen [-l <length>] [-p] PATH:KEY [PATH:KEY ...]",
+		Summary: "Generate a random password or passphrase",
+		Usage:   "safe gen [-l <length>] [-p <policy>] [-P <preset>] [--passphrase [-w <words>]] PATH:KEY [PATH:KEY ...]",
 		Type:    DestructiveCommand,
 		Description: `
 LENGTH defaults to 64 characters.
@@ -2793,6 +4008,44 @@ The following options are recognized:
   -l, --length  Specify the length of the random string to generate
 	-p, --policy  Specify a regex character grouping for limiting characters used
 	              to generate the password (e.g --policy a-z0-9)
+  -P, --preset  Start from a named password policy, instead of a-zA-Z0-9.
+                Any of the other options given override parts of it.
+                Presets are:
+
+                  alphanumeric  a-zA-Z0-9
+                  strong        any printable character, with at least one
+                                of each kind
+                  mysql-safe    a-zA-Z0-9 and !#%*+=?^_~- with at least
+                                one of each kind
+                  url-safe      a-zA-Z0-9 and ._~- with at least one
+                                lowercase, uppercase and digit
+                  human         a-zA-Z0-9 without look-alikes, with at
+                                least one of each kind, and not starting
+                                with a digit
+
+  --min-lower N, --min-upper N, --min-digits N, --min-symbols N
+                Require at least N lowercase letters, uppercase letters,
+                digits, or other characters.
+
+  --no-ambiguous
+                Leave out characters that look alike (0, O, o, 1, l, I, |).
+
+  --not-first CLASS
+                Do not start the password with any character matching the
+                regex character grouping CLASS (e.g. --not-first 0-9-).
+
+With --passphrase, a diceware-style passphrase of words from the EFF large
+wordlist (7776 words) is generated instead, and LENGTH is the number of words,
+which defaults to 6.  The estimated entropy of the passphrase is printed on
+standard error.  The following options are recognized:
+
+  -w, --words      How many words to use.
+
+  -s, --separator  What to put between the words.  Defaults to a space.
+
+  --capitalize     Capitalize the first letter of each word.
+
+  --digit          Add a random digit to the end of one of the words.
 `,
 	}, func(command string, args ...string) error {
 		rc.Apply(opt.UseTarget)
@@ -2802,14 +4055,52 @@ The following options are recognized:
 		}
 
 		length := 64
+		if opt.Gen.Passphrase {
+			length = 6
+		}
 
 		if opt.Gen.Length != 0 {
 			length = opt.Gen.Length
+		} else if opt.Gen.Passphrase && opt.Gen.Words != 0 {
+			length = opt.Gen.Words
 		} else if u, err := strconv.ParseUint(args[0], 10, 16); err == nil {
 			length = int(u)
 			args = args[1:]
 		}
 
+		passphrase := vault.PassphrasePolicy{
+			Words:      length,
+			Separator:  opt.Gen.Separator,
+			Capitalize: opt.Gen.Capitalize,
+			Digit:      opt.Gen.Digit,
+		}
+		if opt.Gen.Passphrase && length < 1 {
+			return fmt.Errorf("Passphrases need at least one word")
+		}
+
+		policy := vault.PasswordPolicy{Chars: "a-zA-Z0-9"}
+		if opt.Gen.Preset != "" {
+			var err error
+			if policy, err = vault.PasswordPreset(opt.Gen.Preset); err != nil {
+				return err
+			}
+		}
+		policy = policy.Override(vault.PasswordPolicy{
+			Chars:       opt.Gen.Policy,
+			MinLower:    opt.Gen.MinLower,
+			MinUpper:    opt.Gen.MinUpper,
+			MinDigits:   opt.Gen.MinDigits,
+			MinSymbols:  opt.Gen.MinSymbols,
+			NoAmbiguous: !opt.Gen.Ambiguous,
+			NotFirst:    opt.Gen.NotFirst,
+		})
+		//Catch policies that can never be satisfied before touching the Vault
+		if !opt.Gen.Passphrase {
+			if _, err := policy.Generate(length); err != nil {
+				return err
+			}
+		}
+
 		v := connect(true)
 
 		for len(args) > 0 {
@@ -2829,24 +4120,26 @@ The following options are recognized:
 				}
 				args = args[2:]
 			}
-			s, err := v.Read(path)
-			if err != nil && !vault.IsNotFound(err) {
-				return err
-			}
-			exists := (err == nil)
-			if opt.SkipIfExists && exists && s.Has(key) {
-				if !opt.Quiet {
-					fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to update} @C{%s:%s} @R{as it is already present in Vault}\n", path, key)
+			generated := false
+			err := v.Update(path, func(s *vault.Secret) error {
+				if opt.SkipIfExists && s.Has(key) {
+					if !opt.Quiet {
+						fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to update} @C{%s:%s} @R{as it is already present in Vault}\n", path, key)
+					}
+					return vault.SkipWrite
 				}
-				continue
-			}
-			err = s.Password(key, length, opt.Gen.Policy, opt.SkipIfExists)
+				generated = true
+				if opt.Gen.Passphrase {
+					return s.Passphrase(key, passphrase, opt.SkipIfExists)
+				}
+				return s.PasswordWithPolicy(key, length, policy, opt.SkipIfExists)
+			})
 			if err != nil {
 				return err
 			}
-
-			if err = v.Write(path, s); err != nil {
-				return err
+			if generated && opt.Gen.Passphrase && !opt.Quiet {
+				fmt.Fprintf(os.Stderr, "Generated a %d-word passphrase at @C{%s:%s}, with about @G{%.0f bits} of entropy\n",
+					passphrase.Words, path, key, passphrase.Entropy())
 			}
 		}
 		return nil
@@ -2883,27 +4176,15 @@ The following options are recognized:
 			}
 
 		}
-		s, err := v.Read(path)
-		if err != nil && !vault.IsNotFound(err) {
-			return err
-		}
-		exists := (err == nil)
-		if opt.SkipIfExists && exists && s.Has(key) {
-			if !opt.Quiet {
-				fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to update} @C{%s:%s} @R{as it is already present in Vault}\n", path, key)
+		return v.Update(path, func(s *vault.Secret) error {
+			if opt.SkipIfExists && s.Has(key) {
+				if !opt.Quiet {
+					fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to update} @C{%s:%s} @R{as it is already present in Vault}\n", path, key)
+				}
+				return vault.SkipWrite
 			}
-			return err
-		}
-		err = s.Set(key, stringuuid, opt.SkipIfExists)
-		if err != nil {
-			return err
-		}
-
-		if err = v.Write(path, s); err != nil {
-			return err
-		}
-
-		return nil
+			return s.Set(key, stringuuid, opt.SkipIfExists)
+		})
 	})
 
 	r.Dispatch("option", &Help{
@@ -3008,21 +4289,23 @@ public key, formatted for use in an SSH authorized_keys file, under 'public'.
 
 		v := connect(true)
 		for _, path := range args {
-			s, err := v.Read(path)
-			if err != nil && !vault.IsNotFound(err) {
-				return err
-			}
-			exists := (err == nil)
-			if opt.SkipIfExists && exists && (s.Has("private") || s.Has("public") || s.Has("fingerprint")) {
-				if !opt.Quiet {
-					fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to generate an SSH key at} @C{%s} @R{as it is already present in Vault}\n", path)
+			var key *vault.Secret
+			err := v.Update(path, func(s *vault.Secret) error {
+				if opt.SkipIfExists && (s.Has("private") || s.Has("public") || s.Has("fingerprint")) {
+					if !opt.Quiet {
+						fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to generate an SSH key at} @C{%s} @R{as it is already present in Vault}\n", path)
+					}
+					return vault.SkipWrite
 				}
-				continue
-			}
-			if err = s.SSHKey(bits, opt.SkipIfExists); err != nil {
-				return err
-			}
-			if err = v.Write(path, s); err != nil {
+				if key == nil {
+					key = vault.NewSecret()
+					if err := key.SSHKey(bits, false); err != nil {
+						return err
+					}
+				}
+				return mergeSecret(s, key)
+			})
+			if err != nil {
 				return err
 			}
 		}
@@ -3055,21 +4338,23 @@ be PEM-encoded.
 
 		v := connect(true)
 		for _, path := range args {
-			s, err := v.Read(path)
-			if err != nil && !vault.IsNotFound(err) {
-				return err
-			}
-			exists := (err == nil)
-			if opt.SkipIfExists && exists && (s.Has("private") || s.Has("public")) {
-				if !opt.Quiet {
-					fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to generate an RSA key at} @C{%s} @R{as it is already present in Vault}\n", path)
+			var key *vault.Secret
+			err := v.Update(path, func(s *vault.Secret) error {
+				if opt.SkipIfExists && (s.Has("private") || s.Has("public")) {
+					if !opt.Quiet {
+						fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to generate an RSA key at} @C{%s} @R{as it is already present in Vault}\n", path)
+					}
+					return vault.SkipWrite
 				}
-				continue
-			}
-			if err = s.RSAKey(bits, opt.SkipIfExists); err != nil {
-				return err
-			}
-			if err = v.Write(path, s); err != nil {
+				if key == nil {
+					key = vault.NewSecret()
+					if err := key.RSAKey(bits, false); err != nil {
+						return err
+					}
+				}
+				return mergeSecret(s, key)
+			})
+			if err != nil {
 				return err
 			}
 		}
@@ -3100,21 +4385,24 @@ NBITS defaults to 2048.
 
 		path := args[0]
 		v := connect(true)
-		s, err := v.Read(path)
-		if err != nil && !vault.IsNotFound(err) {
-			return err
-		}
-		exists := (err == nil)
-		if opt.SkipIfExists && exists && s.Has("dhparam-pem") {
-			if !opt.Quiet {
-				fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to generate a Diffie-Hellman key exchange parameter set at} @C{%s} @R{as it is already present in Vault}\n", path)
+		var params *vault.Secret
+		return v.Update(path, func(s *vault.Secret) error {
+			if opt.SkipIfExists && s.Has("dhparam-pem") {
+				if !opt.Quiet {
+					fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to generate a Diffie-Hellman key exchange parameter set at} @C{%s} @R{as it is already present in Vault}\n", path)
+				}
+				return vault.SkipWrite
 			}
-			return nil
-		}
-		if err = s.DHParam(bits, opt.SkipIfExists); err != nil {
-			return err
-		}
-		return v.Write(path, s)
+			//These take a long time to generate, so only do it once, no
+			// matter how many times we have to retry the write
+			if params == nil {
+				params = vault.NewSecret()
+				if err := params.DHParam(bits, false); err != nil {
+					return err
+				}
+			}
+			return mergeSecret(s, params)
+		})
 	})
 
 	r.Dispatch("prompt", &Help{
@@ -3146,11 +4434,6 @@ NBITS defaults to 2048.
 			return err
 		}
 
-		cmd := exec.Command("vault", args...)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-
 		//If the command is vault status, we don't want to expose the VAULT_NAMESPACE envvar
 		for _, arg := range args {
 			if !strings.HasPrefix(arg, "-") {
@@ -3160,7 +4443,7 @@ NBITS defaults to 2048.
 				break
 			}
 		}
-		cmd.Env = os.Environ()
+		cmd := passthroughCommand(os.Environ(), "vault", args...)
 
 		//Make sure we don't accidentally specify a http_proxy and a HTTP_PROXY
 		for i := range cmd.Env {
@@ -3192,6 +4475,289 @@ NBITS defaults to 2048.
 		return nil
 	})
 
+	r.Dispatch("exec", &Help{
+		Summary: "Run a command with secrets in its environment",
+		Usage:   "safe exec [--env NAME=PATH:KEY ...] [--env-from PATH ...] -- COMMAND [ARGS ...]",
+		Type:    NonDestructiveCommand,
+		Description: `
+Reads secrets from the Vault and runs COMMAND with them set as environment
+variables, so that they never have to appear on a command line, in the process
+table, or in shell traces.
+
+The following options are recognized, and can be given more than once:
+
+  --env NAME=PATH:KEY   Set the environment variable NAME to the value of
+                        KEY in the secret at PATH.
+
+  --env-from PATH       Set an environment variable for every key in the
+                        secret at PATH.  Key names are upper-cased, and any
+                        characters that are not letters, digits or
+                        underscores are replaced with underscores, so that
+                        a key named 'api-key' becomes API_KEY.
+
+Variables set with --env take precedence over those from --env-from, and both
+take precedence over the environment that safe was run with.  The Vault
+credentials of the current target are not passed to COMMAND.
+
+Signals sent to safe while COMMAND is running are passed on to it, and safe
+exits with the same exit code as COMMAND.
+
+For example:
+
+    safe exec --env DB_PASS=secret/db:password --env-from secret/app -- ./server
+`,
+	}, func(command string, args ...string) error {
+		//Snapshot the environment before rc.Apply() puts our Vault credentials in it
+		env := os.Environ()
+		rc.Apply(opt.UseTarget)
+
+		var envs, envFroms []string
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+			arg := args[0]
+			args = args[1:]
+			if arg == "--" {
+				break
+			}
+
+			var flag, value string
+			if idx := strings.Index(arg, "="); idx > 0 {
+				flag, value = arg[:idx], arg[idx+1:]
+			} else {
+				if len(args) == 0 {
+					r.ExitWithUsage("exec")
+				}
+				flag, value = arg, args[0]
+				args = args[1:]
+			}
+
+			switch flag {
+			case "--env":
+				envs = append(envs, value)
+			case "--env-from":
+				envFroms = append(envFroms, value)
+			default:
+				fmt.Fprintf(os.Stderr, "@R{!! Unrecognized option} @C{%s}\n", flag)
+				r.ExitWithUsage("exec")
+			}
+		}
+		if len(args) == 0 {
+			r.ExitWithUsage("exec")
+		}
+
+		v := connect(true)
+		vars := map[string]string{}
+		for _, path := range envFroms {
+			if vault.PathHasKey(path) {
+				return fmt.Errorf("Cannot use path with key for --env-from (%s)", path)
+			}
+			s, err := v.Read(path)
+			if err != nil {
+				return err
+			}
+			for _, key := range s.Keys() {
+				vars[envVarName(key)] = s.Get(key)
+			}
+		}
+		for _, spec := range envs {
+			kv := strings.SplitN(spec, "=", 2)
+			if len(kv) != 2 || kv[0] == "" || !vault.PathHasKey(kv[1]) {
+				return fmt.Errorf("Invalid --env `%s': expected NAME=PATH:KEY", spec)
+			}
+			_, key, _ := vault.ParsePath(kv[1])
+			s, err := v.Read(kv[1])
+			if err != nil {
+				return err
+			}
+			vars[kv[0]] = s.Get(key)
+		}
+
+		for name, value := range vars {
+			env = append(env, name+"="+value)
+		}
+
+		code, err := runForwardingSignals(passthroughCommand(env, args[0], args[1:]...))
+		if err != nil {
+			return err
+		}
+		os.Exit(code)
+		return nil
+	})
+
+	r.Dispatch("template", &Help{
+		Summary: "Render a template with values from the Vault",
+		Usage:   "safe template FILE",
+		Type:    NonDestructiveCommand,
+		Description: `
+Renders FILE, a Go text/template, and prints the result to standard output.
+If FILE is '-', the template is read from standard input instead.  Templates
+can use the following functions to pull values out of the Vault:
+
+  secret "PATH:KEY"     The value of KEY in the secret at PATH.
+
+  secretMap "PATH"      All of the keys in the secret at PATH, as a map,
+                        suitable for use with range or index.
+
+  x509cert "PATH"       The X.509 certificate stored at PATH (as generated
+                        by 'safe x509 issue').  Its parsed form is available
+                        as .Certificate, so you can use things like
+                        {{ (x509cert "secret/ca").Certificate.NotAfter }}.
+
+  b64enc STRING         The base64 encoding of STRING.
+
+Each secret is only read once, no matter how many times it is referred to,
+and all of the secrets that a template needs are read in parallel.  Nothing
+is printed if any of them cannot be read.
+
+For example:
+
+    upstream backend {
+      server {{ secret "secret/app/db:host" }};
+    }
+    {{ range $k, $v := secretMap "secret/app/env" }}
+    env {{ $k }}={{ $v | b64enc }};
+    {{ end }}
+`,
+	}, func(command string, args ...string) error {
+		rc.Apply(opt.UseTarget)
+		if len(args) != 1 {
+			r.ExitWithUsage("template")
+		}
+
+		var b []byte
+		var err error
+		if args[0] == "-" {
+			b, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			b, err = ioutil.ReadFile(args[0])
+		}
+		if err != nil {
+			return err
+		}
+
+		v := connect(true)
+		t, err := newSecretTemplate(v, args[0], string(b))
+		if err != nil {
+			return err
+		}
+
+		return t.Render(os.Stdout)
+	})
+
+	r.Dispatch("apply", &Help{
+		Summary: "Generate the secrets listed in a spec file",
+		Usage:   "safe apply [--plan] [--rotate PATH ...] SPEC-FILE",
+		Type:    DestructiveCommand,
+		Description: `
+Reads a YAML file listing the secrets that something needs, and generates
+any of them that do not exist yet.  Secrets that already exist are left
+alone, so it is safe to run over and over again.  Give - as the SPEC-FILE
+to read the spec from standard input.
+
+The spec looks like this:
+
+    secrets:
+      - path: secret/app/db:password
+        type: password
+        length: 32                # default: 64
+        policy: a-z0-9            # default: a-zA-Z0-9
+      - path: secret/app/db:crypted
+        type: fmt
+        format: crypt-sha512      # any format that 'safe fmt' supports
+        from: password            # key in the same secret
+      - path: secret/app/db:id
+        type: uuid
+      - path: secret/app/ssh
+        type: ssh                 # or rsa, or dhparam
+        bits: 4096                # default: 2048
+      - path: secret/app/ca
+        type: x509
+        ca: true
+        names: [ca.example.com]
+      - path: secret/app/tls
+        type: x509
+        signed_by: secret/app/ca
+        names: [app.example.com, 10.0.0.5]
+        ttl: 90d
+
+Passwords also accept preset, min_lower, min_upper, min_digits, min_symbols,
+no_ambiguous and not_first, with the same meanings as the options to 'safe
+gen'.  Entries of type passphrase accept words, separator, capitalize and
+digit, like 'safe gen --passphrase'.  Certificates also accept subject,
+bits, key_usage and sig_algorithm, with the same meanings and defaults as
+the options to 'safe x509 issue'.
+
+Before anything is written, safe prints a plan of what it is going to
+generate.  Anything that is derived from a secret that is being generated
+(formatted values, and certificates signed by a new CA) is regenerated
+along with it.
+
+The following options are recognized:
+
+  --plan         Print the plan, but do not generate anything.
+
+  --rotate PATH  Regenerate the secret at PATH, even though it exists.  PATH
+                 is either the path of an entry in the spec, or the path of
+                 a secret, to regenerate all of its entries.  Can be given
+                 more than once.
+`,
+	}, func(command string, args ...string) error {
+		rc.Apply(opt.UseTarget)
+		if len(args) != 1 {
+			r.ExitWithUsage("apply")
+		}
+
+		var b []byte
+		var err error
+		if args[0] == "-" {
+			b, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			b, err = ioutil.ReadFile(args[0])
+		}
+		if err != nil {
+			return err
+		}
+
+		spec, err := parseSecretSpec(b)
+		if err != nil {
+			return fmt.Errorf("Invalid spec in %s: %s", args[0], err)
+		}
+
+		v := connect(true)
+		actions, unchanged, err := spec.Plan(v, opt.Apply.Rotate)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Plan for applying @C{%s}:\n", args[0])
+		if len(actions) == 0 {
+			fmt.Printf("@G{Nothing to do}; all %d secrets are already present.\n", unchanged)
+			return nil
+		}
+
+		var creates, rotates int
+		for _, a := range actions {
+			if a.rotate {
+				fmt.Printf("  @Y{rotate} %s (%s; %s)\n", a.entry.Path, a.entry.Type, a.reason)
+				rotates++
+			} else {
+				fmt.Printf("  @G{create} %s (%s)\n", a.entry.Path, a.entry.Type)
+				creates++
+			}
+		}
+		fmt.Printf("\n%d to create, %d to rotate, %d already present.\n", creates, rotates, unchanged)
+
+		if opt.Apply.Plan {
+			return nil
+		}
+
+		for _, a := range actions {
+			if err := a.Apply(v); err != nil {
+				return fmt.Errorf("Unable to generate %s: %s", a.entry.Path, err)
+			}
+		}
+		return nil
+	})
+
 	r.Dispatch("rekey", &Help{
 		Summary: "Re-key your Vault with new unseal keys",
 		Usage:   "safe rekey [--gpg email@address ...] [--keys #] [--threshold #]",
@@ -3315,24 +4881,24 @@ Supported formats:
 		newKey := args[3]
 
 		v := connect(true)
-		s, err := v.Read(path)
-		if err != nil {
-			return err
-		}
-		if opt.SkipIfExists && s.Has(newKey) {
-			if !opt.Quiet {
-				fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to reformat} @C{%s:%s} @R{to} @C{%s} @R{as it is already present in Vault}\n", path, oldKey, newKey)
+		return v.Update(path, func(s *vault.Secret) error {
+			if s.Empty() {
+				return vault.NewSecretNotFoundError(path)
 			}
-			return nil
-		}
-		if err = s.Format(oldKey, newKey, fmtType, opt.SkipIfExists); err != nil {
-			if vault.IsNotFound(err) {
-				return fmt.Errorf("%s:%s does not exist, cannot create %s encoded copy at %s:%s", path, oldKey, fmtType, path, newKey)
+			if opt.SkipIfExists && s.Has(newKey) {
+				if !opt.Quiet {
+					fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to reformat} @C{%s:%s} @R{to} @C{%s} @R{as it is already present in Vault}\n", path, oldKey, newKey)
+				}
+				return vault.SkipWrite
 			}
-			return fmt.Errorf("Error encoding %s:%s as %s: %s", path, oldKey, fmtType, err)
-		}
-
-		return v.Write(path, s)
+			if err := s.Format(oldKey, newKey, fmtType, opt.SkipIfExists); err != nil {
+				if vault.IsNotFound(err) {
+					return fmt.Errorf("%s:%s does not exist, cannot create %s encoded copy at %s:%s", path, oldKey, fmtType, path, newKey)
+				}
+				return fmt.Errorf("Error encoding %s:%s as %s: %s", path, oldKey, fmtType, err)
+			}
+			return nil
+		})
 	})
 
 	r.Dispatch("curl", &Help{
@@ -3396,6 +4962,66 @@ sent as DATA.
 		return nil
 	})
 
+	r.Dispatch("kv", &Help{
+		Summary: "Manage KV secrets engine mounts",
+		Usage:   "safe kv <command> [OPTIONS]",
+		Type:    HiddenCommand,
+		Description: `
+kv provides sub-commands for looking after the KV secrets engine mounts
+that safe keeps secrets in.
+
+Here are the supported commands:
+
+  @G{kv upgrade} [-f] path/to/mount
+
+    Upgrades a KV v1 mount to KV v2, so that its secrets keep a history
+    of versions, and checks that every secret made it through intact.
+`,
+	}, func(command string, args ...string) error {
+		r.Help(os.Stdout, "kv")
+		return nil
+	})
+
+	r.Dispatch("kv upgrade", &Help{
+		Summary: "Upgrade a KV v1 mount to KV v2",
+		Usage:   "safe kv upgrade [-f] MOUNT",
+		Type:    DestructiveCommand,
+		Description: `
+Converts the KV v1 mount at MOUNT (like secret/) to KV v2.  Vault moves the
+secrets over in the background, and refuses requests for the mount until it
+is done; safe waits for that, and then reads every secret again and compares
+it against what was there beforehand, listing anything that went missing or
+changed along the way.
+
+The upgrade cannot be undone, so you will be asked to confirm it, unless
+the --force (-f) flag is given.
+
+The following options are recognized:
+
+  -f, --force   Do not prompt for confirmation.
+`,
+	}, func(command string, args ...string) error {
+		rc.Apply(opt.UseTarget)
+		if len(args) != 1 {
+			r.ExitWithUsage("kv upgrade")
+		}
+
+		v := connect(true)
+		if !opt.KV.Upgrade.Force {
+			y := prompt.Normal("Upgrade @C{%s} to @R{KV v2}? This cannot be undone @Y{(y/n)} ", args[0])
+			if y = strings.TrimSpace(y); y != "y" && y != "yes" {
+				return nil
+			}
+		}
+
+		n, err := v.UpgradeMount(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "upgraded @C{%s} to KV v2; all %d secrets came through intact\n", args[0], n)
+		return nil
+	})
+
 	r.Dispatch("x509", &Help{
 		Summary: "Issue / Revoke X.509 Certificates and Certificate Authorities",
 		Usage:   "safe x509 <command> [OPTIONS]",
@@ -3666,8 +5292,6 @@ The following options are recognized:
 	}, func(command string, args ...string) error {
 		rc.Apply(opt.UseTarget)
 
-		var ca *vault.X509
-
 		if len(args) != 1 || len(opt.X509.Issue.Name) == 0 {
 			r.ExitWithUsage("x509 issue")
 		}
@@ -3679,23 +5303,11 @@ The following options are recognized:
 		v := connect(true)
 		if opt.SkipIfExists {
 			if _, err := v.Read(args[0]); err == nil {
-				if !opt.Quiet {
-					fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to create a new certificate in} @C{%s} @R{as it is already present in Vault}\n", args[0])
-				}
-				return nil
-			} else if err != nil && !vault.IsNotFound(err) {
-				return err
-			}
-		}
-
-		if opt.X509.Issue.SignedBy != "" {
-			secret, err := v.Read(opt.X509.Issue.SignedBy)
-			if err != nil {
-				return err
-			}
-
-			ca, err = secret.X509(true)
-			if err != nil {
+				if !opt.Quiet {
+					fmt.Fprintf(os.Stderr, "@R{Cowardly refusing to create a new certificate in} @C{%s} @R{as it is already present in Vault}\n", args[0])
+				}
+				return nil
+			} else if err != nil && !vault.IsNotFound(err) {
 				return err
 			}
 		}
@@ -3728,16 +5340,30 @@ The following options are recognized:
 		if err != nil {
 			return err
 		}
-		if ca == nil {
+		if opt.X509.Issue.SignedBy == "" {
 			if err := cert.Sign(cert, ttl); err != nil {
 				return err
 			}
 		} else {
-			if err := ca.Sign(cert, ttl); err != nil {
-				return err
-			}
+			//Signing bumps the serial number of the CA, so read, sign and
+			// save it in one go, starting over if someone else got there first
+			err = v.RetryOnConflict(func() error {
+				secret, err := v.Read(opt.X509.Issue.SignedBy)
+				if err != nil {
+					return err
+				}
+
+				ca, err := secret.X509(true)
+				if err != nil {
+					return err
+				}
+
+				if err := ca.Sign(cert, ttl); err != nil {
+					return err
+				}
 
-			err = ca.SaveTo(v, opt.X509.Issue.SignedBy, opt.SkipIfExists)
+				return ca.SaveTo(v, opt.X509.Issue.SignedBy, opt.SkipIfExists)
+			})
 			if err != nil {
 				return err
 			}
@@ -3829,105 +5455,111 @@ The following options are recognized:
 
 		v := connect(true)
 
-		/* find the Certificate that we want to renew */
-		s, err := v.Read(args[0])
-		if err != nil {
-			return err
-		}
-		cert, err := s.X509(true)
-		if err != nil {
-			return err
-		}
-
-		if len(opt.X509.Reissue.Name) > 0 {
-			ips, dns, email := vault.CategorizeSANs(uniq(opt.X509.Renew.Name))
-			cert.Certificate.IPAddresses = ips
-			cert.Certificate.DNSNames = dns
-			cert.Certificate.EmailAddresses = email
-		}
-
-		if opt.X509.Reissue.Subject != "" {
-			cert.Certificate.Subject, err = vault.ParseSubject(opt.X509.Reissue.Subject)
+		var newKey *rsa.PrivateKey
+		return v.RetryOnConflict(func() error {
+			/* find the Certificate that we want to renew */
+			s, err := v.Read(args[0])
 			if err != nil {
 				return err
 			}
-
-			cert.Certificate.RawSubject, err = asn1.Marshal(cert.Certificate.Subject.ToRDNSequence())
+			cert, err := s.X509(true)
 			if err != nil {
 				return err
 			}
-		}
 
-		if len(opt.X509.Reissue.KeyUsage) > 0 {
-			keyUsage, extKeyUsage, err := vault.HandleJointKeyUsages(opt.X509.Reissue.KeyUsage)
-			if err != nil {
-				return err
+			if len(opt.X509.Reissue.Name) > 0 {
+				ips, dns, email := vault.CategorizeSANs(uniq(opt.X509.Renew.Name))
+				cert.Certificate.IPAddresses = ips
+				cert.Certificate.DNSNames = dns
+				cert.Certificate.EmailAddresses = email
 			}
 
-			cert.Certificate.KeyUsage = keyUsage
-			cert.Certificate.ExtKeyUsage = extKeyUsage
-		}
+			if opt.X509.Reissue.Subject != "" {
+				cert.Certificate.Subject, err = vault.ParseSubject(opt.X509.Reissue.Subject)
+				if err != nil {
+					return err
+				}
 
-		if opt.X509.Reissue.SigAlgorithm != "" {
-			sigAlgo, err := vault.TranslateSignatureAlgorithm(opt.X509.Reissue.SigAlgorithm)
-			if err != nil {
-				return err
+				cert.Certificate.RawSubject, err = asn1.Marshal(cert.Certificate.Subject.ToRDNSequence())
+				if err != nil {
+					return err
+				}
 			}
 
-			cert.Certificate.SignatureAlgorithm = sigAlgo
-		}
+			if len(opt.X509.Reissue.KeyUsage) > 0 {
+				keyUsage, extKeyUsage, err := vault.HandleJointKeyUsages(opt.X509.Reissue.KeyUsage)
+				if err != nil {
+					return err
+				}
 
-		/* find the CA */
-		ca, caPath, err := v.FindSigningCA(cert, args[0], opt.X509.Reissue.SignedBy)
-		if err != nil {
-			return err
-		}
+				cert.Certificate.KeyUsage = keyUsage
+				cert.Certificate.ExtKeyUsage = extKeyUsage
+			}
 
-		// Get new expiry date
-		var ttl time.Duration
-		if opt.X509.Reissue.TTL == "" {
-			ttl = cert.Certificate.NotAfter.Sub(cert.Certificate.NotBefore)
-		} else {
-			ttl, err = duration(opt.X509.Reissue.TTL)
+			if opt.X509.Reissue.SigAlgorithm != "" {
+				sigAlgo, err := vault.TranslateSignatureAlgorithm(opt.X509.Reissue.SigAlgorithm)
+				if err != nil {
+					return err
+				}
+
+				cert.Certificate.SignatureAlgorithm = sigAlgo
+			}
+
+			/* find the CA */
+			ca, caPath, err := v.FindSigningCA(cert, args[0], opt.X509.Reissue.SignedBy)
 			if err != nil {
 				return err
 			}
-		}
 
-		// Get signing key bit length
-		if opt.X509.Reissue.Bits == 0 {
-			opt.X509.Reissue.Bits = cert.PrivateKey.N.BitLen()
-		}
-		if opt.X509.Reissue.Bits != 1024 && opt.X509.Reissue.Bits != 2048 && opt.X509.Reissue.Bits != 4096 {
-			return fmt.Errorf("Bits must be one of 1024, 2048 or 4096")
-		}
+			// Get new expiry date
+			var ttl time.Duration
+			if opt.X509.Reissue.TTL == "" {
+				ttl = cert.Certificate.NotAfter.Sub(cert.Certificate.NotBefore)
+			} else {
+				ttl, err = duration(opt.X509.Reissue.TTL)
+				if err != nil {
+					return err
+				}
+			}
 
-		// Generate new key with same bit length.
-		fmt.Printf("\nGenerating new %d-bit key...\n", opt.X509.Reissue.Bits)
-		newKey, err := rsa.GenerateKey(rand.Reader, opt.X509.Reissue.Bits)
-		if err != nil {
-			return err
-		}
-		cert.PrivateKey = newKey
-		err = ca.Sign(cert, ttl)
-		if err != nil {
-			return err
-		}
-		if caPath != args[0] {
-			err = ca.SaveTo(v, caPath, false)
+			// Get signing key bit length
+			if opt.X509.Reissue.Bits == 0 {
+				opt.X509.Reissue.Bits = cert.PrivateKey.N.BitLen()
+			}
+			if opt.X509.Reissue.Bits != 1024 && opt.X509.Reissue.Bits != 2048 && opt.X509.Reissue.Bits != 4096 {
+				return fmt.Errorf("Bits must be one of 1024, 2048 or 4096")
+			}
+
+			// Generate new key with same bit length, but only once, even if
+			// we have to retry the write
+			if newKey == nil {
+				fmt.Printf("\nGenerating new %d-bit key...\n", opt.X509.Reissue.Bits)
+				newKey, err = rsa.GenerateKey(rand.Reader, opt.X509.Reissue.Bits)
+				if err != nil {
+					return err
+				}
+			}
+			cert.PrivateKey = newKey
+			err = ca.Sign(cert, ttl)
 			if err != nil {
 				return err
 			}
-		}
+			if caPath != args[0] {
+				err = ca.SaveTo(v, caPath, false)
+				if err != nil {
+					return err
+				}
+			}
 
-		err = cert.SaveTo(v, args[0], false)
-		if err != nil {
-			return err
-		}
+			err = cert.SaveTo(v, args[0], false)
+			if err != nil {
+				return err
+			}
 
-		fmt.Printf("Reissued x509 certificate at %s - expiry set to %s\n\n", args[0], cert.ExpiryString())
+			fmt.Printf("Reissued x509 certificate at %s - expiry set to %s\n\n", args[0], cert.ExpiryString())
 
-		return nil
+			return nil
+		})
 	})
 
 	r.Dispatch("x509 renew", &Help{
@@ -4002,89 +5634,91 @@ The following options are recognized:
 
 		v := connect(true)
 
-		/* find the Certificate that we want to renew */
-		s, err := v.Read(args[0])
-		if err != nil {
-			return err
-		}
-		cert, err := s.X509(true)
-		if err != nil {
-			return err
-		}
-
-		if len(opt.X509.Renew.Name) > 0 {
-			ips, dns, email := vault.CategorizeSANs(uniq(opt.X509.Renew.Name))
-			cert.Certificate.IPAddresses = ips
-			cert.Certificate.DNSNames = dns
-			cert.Certificate.EmailAddresses = email
-		}
-
-		if opt.X509.Renew.Subject != "" {
-			cert.Certificate.Subject, err = vault.ParseSubject(opt.X509.Renew.Subject)
+		return v.RetryOnConflict(func() error {
+			/* find the Certificate that we want to renew */
+			s, err := v.Read(args[0])
 			if err != nil {
 				return err
 			}
-
-			cert.Certificate.RawSubject, err = asn1.Marshal(cert.Certificate.Subject.ToRDNSequence())
+			cert, err := s.X509(true)
 			if err != nil {
 				return err
 			}
-		}
 
-		if len(opt.X509.Renew.KeyUsage) > 0 {
-			keyUsage, extKeyUsage, err := vault.HandleJointKeyUsages(opt.X509.Renew.KeyUsage)
-			if err != nil {
-				return err
+			if len(opt.X509.Renew.Name) > 0 {
+				ips, dns, email := vault.CategorizeSANs(uniq(opt.X509.Renew.Name))
+				cert.Certificate.IPAddresses = ips
+				cert.Certificate.DNSNames = dns
+				cert.Certificate.EmailAddresses = email
 			}
 
-			cert.Certificate.KeyUsage = keyUsage
-			cert.Certificate.ExtKeyUsage = extKeyUsage
-		}
+			if opt.X509.Renew.Subject != "" {
+				cert.Certificate.Subject, err = vault.ParseSubject(opt.X509.Renew.Subject)
+				if err != nil {
+					return err
+				}
 
-		if opt.X509.Renew.SigAlgorithm != "" {
-			sigAlgo, err := vault.TranslateSignatureAlgorithm(opt.X509.Renew.SigAlgorithm)
-			if err != nil {
-				return err
+				cert.Certificate.RawSubject, err = asn1.Marshal(cert.Certificate.Subject.ToRDNSequence())
+				if err != nil {
+					return err
+				}
 			}
 
-			cert.Certificate.SignatureAlgorithm = sigAlgo
-		}
+			if len(opt.X509.Renew.KeyUsage) > 0 {
+				keyUsage, extKeyUsage, err := vault.HandleJointKeyUsages(opt.X509.Renew.KeyUsage)
+				if err != nil {
+					return err
+				}
 
-		/* find the CA */
-		ca, caPath, err := v.FindSigningCA(cert, args[0], opt.X509.Renew.SignedBy)
-		if err != nil {
-			return err
-		}
+				cert.Certificate.KeyUsage = keyUsage
+				cert.Certificate.ExtKeyUsage = extKeyUsage
+			}
 
-		// Get new expiry date
-		var ttl time.Duration
-		if opt.X509.Renew.TTL == "" {
-			ttl = cert.Certificate.NotAfter.Sub(cert.Certificate.NotBefore)
-		} else {
-			ttl, err = duration(opt.X509.Renew.TTL)
+			if opt.X509.Renew.SigAlgorithm != "" {
+				sigAlgo, err := vault.TranslateSignatureAlgorithm(opt.X509.Renew.SigAlgorithm)
+				if err != nil {
+					return err
+				}
+
+				cert.Certificate.SignatureAlgorithm = sigAlgo
+			}
+
+			/* find the CA */
+			ca, caPath, err := v.FindSigningCA(cert, args[0], opt.X509.Renew.SignedBy)
 			if err != nil {
 				return err
 			}
-		}
 
-		err = ca.Sign(cert, ttl)
-		if err != nil {
-			return err
-		}
-		if caPath != args[0] {
-			err = ca.SaveTo(v, caPath, false)
+			// Get new expiry date
+			var ttl time.Duration
+			if opt.X509.Renew.TTL == "" {
+				ttl = cert.Certificate.NotAfter.Sub(cert.Certificate.NotBefore)
+			} else {
+				ttl, err = duration(opt.X509.Renew.TTL)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = ca.Sign(cert, ttl)
 			if err != nil {
 				return err
 			}
-		}
+			if caPath != args[0] {
+				err = ca.SaveTo(v, caPath, false)
+				if err != nil {
+					return err
+				}
+			}
 
-		err = cert.SaveTo(v, args[0], false)
-		if err != nil {
-			return err
-		}
+			err = cert.SaveTo(v, args[0], false)
+			if err != nil {
+				return err
+			}
 
-		fmt.Printf("\nRenewed x509 certificate at %s - expiry set to %s\n\n", args[0], cert.ExpiryString())
-		return nil
+			fmt.Printf("\nRenewed x509 certificate at %s - expiry set to %s\n\n", args[0], cert.ExpiryString())
+			return nil
+		})
 	})
 
 	r.Dispatch("x509 revoke", &Help{
@@ -4107,40 +5741,42 @@ The following options are recognized:
 		rc.Apply(opt.UseTarget)
 		v := connect(true)
 
-		/* find the CA */
-		s, err := v.Read(opt.X509.Revoke.SignedBy)
-		if err != nil {
-			return err
-		}
-		ca, err := s.X509(true)
-		if err != nil {
-			return err
-		}
+		return v.RetryOnConflict(func() error {
+			/* find the CA */
+			s, err := v.Read(opt.X509.Revoke.SignedBy)
+			if err != nil {
+				return err
+			}
+			ca, err := s.X509(true)
+			if err != nil {
+				return err
+			}
 
-		/* find the Certificate */
-		s, err = v.Read(args[0])
-		if err != nil {
-			return err
-		}
-		cert, err := s.X509(true)
-		if err != nil {
-			return err
-		}
+			/* find the Certificate */
+			s, err = v.Read(args[0])
+			if err != nil {
+				return err
+			}
+			cert, err := s.X509(true)
+			if err != nil {
+				return err
+			}
 
-		/* revoke the Certificate */
-		/* FIXME make sure the CA signed this cert */
-		ca.Revoke(cert)
-		s, err = ca.Secret(false) // SkipIfExists doesnt make sense in the context of revoke
-		if err != nil {
-			return err
-		}
+			/* revoke the Certificate */
+			/* FIXME make sure the CA signed this cert */
+			ca.Revoke(cert)
+			s, err = ca.Secret(false) // SkipIfExists doesnt make sense in the context of revoke
+			if err != nil {
+				return err
+			}
 
-		err = v.Write(opt.X509.Revoke.SignedBy, s)
-		if err != nil {
-			return err
-		}
+			err = v.Write(opt.X509.Revoke.SignedBy, s)
+			if err != nil {
+				return err
+			}
 
-		return nil
+			return nil
+		})
 	})
 
 	r.Dispatch("x509 show", &Help{
@@ -4366,30 +6002,32 @@ Currently, only the --renew option is supported, and it is required:
 		rc.Apply(opt.UseTarget)
 		v := connect(true)
 
-		s, err := v.Read(args[0])
-		if err != nil {
-			return err
-		}
-		ca, err := s.X509(true)
-		if err != nil {
-			return err
-		}
+		return v.RetryOnConflict(func() error {
+			s, err := v.Read(args[0])
+			if err != nil {
+				return err
+			}
+			ca, err := s.X509(true)
+			if err != nil {
+				return err
+			}
 
-		if !ca.IsCA() {
-			return fmt.Errorf("%s is not a certificate authority", args[0])
-		}
+			if !ca.IsCA() {
+				return fmt.Errorf("%s is not a certificate authority", args[0])
+			}
 
-		/* simply re-saving the CA X509 object regens the CRL */
-		s, err = ca.Secret(false) // SkipIfExists doesn't make sense in the context of crl regeneration
-		if err != nil {
-			return err
-		}
-		err = v.Write(args[0], s)
-		if err != nil {
-			return err
-		}
+			/* simply re-saving the CA X509 object regens the CRL */
+			s, err = ca.Secret(false) // SkipIfExists doesn't make sense in the context of crl regeneration
+			if err != nil {
+				return err
+			}
+			err = v.Write(args[0], s)
+			if err != nil {
+				return err
+			}
 
-		return nil
+			return nil
+		})
 	})
 
 	env.Override(&opt)
@@ -4433,9 +6071,33 @@ Currently, only the --renew option is supported, and it is required:
 			os.Setenv("SAFE_SKIP_VERIFY", "1")
 		}
 
+		os.Unsetenv("SAFE_NO_RETRY")
+		if !opt.Retry {
+			os.Setenv("SAFE_NO_RETRY", "1")
+		}
+
+		//These are left alone if they were set in the environment, and not on
+		// the command line
+		if opt.Workers > 0 {
+			os.Setenv("SAFE_WORKERS", strconv.Itoa(opt.Workers))
+		}
+		if opt.RPS > 0 {
+			os.Setenv("SAFE_RPS", strconv.Itoa(opt.RPS))
+		}
+
+		timeout, err := parseTimeout(opt.Timeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "@R{!! %s}\n", err)
+			os.Exit(1)
+		}
+		startCommand(timeout)
+
 		defer rc.Cleanup()
 		err = r.Execute(p.Command, p.Args...)
 		if err != nil {
+			if interrupted, ok := err.(*vault.InterruptedError); ok {
+				reportInterrupted(interrupted)
+			}
 			if strings.HasPrefix(err.Error(), "USAGE") {
 				fmt.Fprintf(os.Stderr, "@Y{%s}\n", err)
 			} else {
@@ -4463,6 +6125,57 @@ func recursively(cmd string, args ...string) bool {
 	return y == "y" || y == "yes"
 }
 
+//destroyDeletedVersions marks deleted versions of the given secrets as
+// destroyed, for when their values were not fetched and cannot be replicated.
+func destroyDeletedVersions(secrets vault.Secrets) {
+	for i := range secrets {
+		for j := range secrets[i].Versions {
+			if secrets[i].Versions[j].State == vault.SecretStateDeleted {
+				secrets[i].Versions[j].State = vault.SecretStateDestroyed
+			}
+		}
+	}
+}
+
+//metadataYAML lays out the metadata of a secret for printing as YAML, in a
+// stable order.
+func metadataYAML(m *vault.SecretMetadata) yaml.MapSlice {
+	custom := m.CustomMetadata
+	if custom == nil {
+		custom = map[string]string{}
+	}
+
+	return yaml.MapSlice{
+		{Key: "max_versions", Value: m.MaxVersions},
+		{Key: "cas_required", Value: m.CASRequired},
+		{Key: "delete_version_after", Value: m.DeleteVersionAfter},
+		{Key: "current_version", Value: m.CurrentVersion},
+		{Key: "oldest_version", Value: m.OldestVersion},
+		{Key: "created_time", Value: m.CreatedTime},
+		{Key: "updated_time", Value: m.UpdatedTime},
+		{Key: "custom_metadata", Value: custom},
+	}
+}
+
+//printMetadataTable prints the changeable metadata of a secret as a table.
+func printMetadataTable(m *vault.SecretMetadata) {
+	t := table{}
+	t.setHeader("metadata", "value")
+	t.addRow("max_versions", fmt.Sprintf("%d", m.MaxVersions))
+	t.addRow("cas_required", fmt.Sprintf("%t", m.CASRequired))
+	t.addRow("delete_version_after", m.DeleteVersionAfter)
+
+	keys := make([]string, 0, len(m.CustomMetadata))
+	for k := range m.CustomMetadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		t.addRow("custom."+k, m.CustomMetadata[k])
+	}
+	t.print()
+}
+
 //For versions of safe 0.10+
 // Older versions just use a map[string]map[string]string
 type exportFormat struct {
@@ -4470,15 +6183,42 @@ type exportFormat struct {
 	//map from path string to map from version number to version info
 	Data               map[string]exportSecret `json:"data"`
 	RequiresVersioning map[string]bool         `json:"requires_versioning"`
+	//Only in exports made with --since or --since-file
+	Incremental *exportIncremental `json:"incremental,omitempty"`
 }
 
 type exportSecret struct {
 	FirstVersion uint            `json:"first,omitempty"`
 	Versions     []exportVersion `json:"versions"`
+	//Only in version 4 exports (and streamed exports made with --metadata)
+	Metadata *exportMetadata `json:"metadata,omitempty"`
 }
 
 type exportVersion struct {
 	Deleted   bool              `json:"deleted,omitempty"`
 	Destroyed bool              `json:"destroyed,omitempty"`
 	Value     map[string]string `json:"value,omitempty"`
+	//Vault sets these itself when versions are written, so they can't be
+	// restored, but they are kept for the record
+	CreatedTime  string `json:"created_time,omitempty"`
+	DeletionTime string `json:"deletion_time,omitempty"`
+}
+
+//The KV v2 metadata settings of a secret, which import restores
+type exportMetadata struct {
+	MaxVersions        uint              `json:"max_versions,omitempty"`
+	CASRequired        bool              `json:"cas_required,omitempty"`
+	DeleteVersionAfter string            `json:"delete_version_after,omitempty"`
+	CustomMetadata     map[string]string `json:"custom_metadata,omitempty"`
+}
+
+//mergeSecret copies all of the keys in src into dst, overwriting any that
+// dst already has.
+func mergeSecret(dst, src *vault.Secret) error {
+	for _, key := range src.Keys() {
+		if err := dst.Set(key, src.Get(key), false); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// passthroughCommand sets up a child process that shares our standard input,
+// output and error, and starts out with the given environment.
+func passthroughCommand(env []string, name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = env
+	return cmd
+}
+
+// runForwardingSignals starts the given command, relays any terminating
+// signals that we receive to it, and waits for it to exit.  The exit code of
+// the child is returned; if it was killed by a signal, the exit code follows
+// the shell convention of 128 plus the signal number.
+func runForwardingSignals(cmd *exec.Cmd) (int, error) {
+	forwarded := []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP}
+
+	//Take these over from Signals() for as long as the child runs, so that
+	// we stick around to report its exit code.
+	signal.Reset(forwarded...)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, forwarded...)
+	defer signal.Stop(sigs)
+
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := cmd.Wait()
+	if err == nil {
+		return 0, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal()), nil
+		}
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
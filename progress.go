@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhunt/go-ansi"
+	"github.com/mattn/go-isatty"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+const (
+	progressRedrawInterval = 250 * time.Millisecond
+	progressLogInterval    = 10 * time.Second
+)
+
+var (
+	activeProgress *progressReporter
+	progressLock   sync.Mutex
+)
+
+// progressReporter shows how far along a recursive command is, on standard
+// error.  If that is a terminal, it keeps a status line up to date; if not, it
+// logs a line every so often instead, so that long runs under cron or CI
+// don't look stuck.
+type progressReporter struct {
+	command  string
+	progress *vault.Progress
+	out      io.Writer
+	tty      bool
+	//drawn is true while there is a status line on the terminal, and, when
+	// logging, once anything has been logged
+	drawn bool
+	done  chan struct{}
+	wg    sync.WaitGroup
+	once  sync.Once
+}
+
+// showProgress starts showing how far along command is, unless --quiet was
+// given, and returns a function that stops it.
+func showProgress(command string, quiet bool) func() {
+	if quiet {
+		return func() {}
+	}
+
+	r := &progressReporter{
+		command:  command,
+		progress: currentCommand().progress,
+		out:      os.Stderr,
+		tty:      isatty.IsTerminal(os.Stderr.Fd()),
+		done:     make(chan struct{}),
+	}
+	interval := progressLogInterval
+	if r.tty {
+		interval = progressRedrawInterval
+	}
+
+	progressLock.Lock()
+	activeProgress = r
+	progressLock.Unlock()
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				progressLock.Lock()
+				r.show()
+				progressLock.Unlock()
+			case <-r.done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		r.once.Do(func() {
+			close(r.done)
+			r.wg.Wait()
+
+			progressLock.Lock()
+			defer progressLock.Unlock()
+			if r.tty {
+				r.clear()
+			} else if r.drawn {
+				r.show()
+			}
+			activeProgress = nil
+		})
+	}
+}
+
+// show draws the status line, or logs a line, on r.out.  progressLock must be
+// held.
+func (r *progressReporter) show() {
+	c := r.progress.Counts()
+	if !r.tty {
+		line := fmt.Sprintf("time=%s level=info msg=progress command=%s discovered=%d fetched=%d written=%d",
+			time.Now().UTC().Format(time.RFC3339), r.command, c.Discovered, c.Fetched, c.Written)
+		if c.ToWrite > 0 {
+			line += fmt.Sprintf(" to_write=%d", c.ToWrite)
+		}
+		line += fmt.Sprintf(" rate=%.1f", c.Rate)
+		if left := c.Left.Round(time.Second); left > 0 {
+			line += fmt.Sprintf(" eta=%s", left)
+		}
+		fmt.Fprintln(r.out, line)
+		r.drawn = true
+		return
+	}
+
+	parts := []string{
+		fmt.Sprintf("%d discovered", c.Discovered),
+		fmt.Sprintf("%d fetched", c.Fetched),
+	}
+	if c.ToWrite > 0 {
+		parts = append(parts, fmt.Sprintf("%d/%d written", c.Written, c.ToWrite))
+	} else if c.Written > 0 {
+		parts = append(parts, fmt.Sprintf("%d written", c.Written))
+	}
+	if c.Rate > 0 {
+		parts = append(parts, fmt.Sprintf("%.1f/s", c.Rate))
+	}
+	if left := c.Left.Round(time.Second); left > 0 {
+		parts = append(parts, fmt.Sprintf("about %s left", left))
+	}
+	ansi.Fprintf(r.out, "\r\033[K@C{%s}: %s", r.command, strings.Join(parts, ", "))
+	r.drawn = true
+}
+
+// clear takes the status line off of the terminal.  progressLock must be held.
+func (r *progressReporter) clear() {
+	if r.tty && r.drawn {
+		fmt.Fprint(r.out, "\r\033[K")
+		r.drawn = false
+	}
+}
+
+// notef prints a line to standard error, out of the way of the progress line,
+// which is drawn again next time around.
+func notef(format string, args ...interface{}) {
+	progressLock.Lock()
+	defer progressLock.Unlock()
+	if activeProgress != nil {
+		activeProgress.clear()
+	}
+	ansi.Fprintf(os.Stderr, format, args...)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+var _ = Describe("Showing progress", func() {
+	var (
+		out      *bytes.Buffer
+		progress *vault.Progress
+	)
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		progress = vault.NewProgress()
+	})
+
+	Context("when standard error is not a terminal", func() {
+		It("logs a line with the counts so far", func() {
+			progress.AddDiscovered(10)
+			progress.AddFetched(4)
+			r := &progressReporter{command: "export", progress: progress, out: out}
+			r.show()
+			Expect(out.String()).To(MatchRegexp(`^time=\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ level=info msg=progress command=export discovered=10 fetched=4 written=0 rate=\d+\.\d( eta=\w+)?\n$`))
+			Expect(r.drawn).To(BeTrue())
+		})
+
+		It("logs how many secrets there are to write, once that is known", func() {
+			progress.AddDiscovered(3)
+			progress.AddFetched(3)
+			progress.WillWrite(3)
+			progress.AddWritten(1)
+			r := &progressReporter{command: "copy", progress: progress, out: out}
+			r.show()
+			Expect(out.String()).To(MatchRegexp(` msg=progress command=copy discovered=3 fetched=3 written=1 to_write=3 rate=\d+\.\d( eta=\w+)?\n$`))
+		})
+
+		It("doesn't leave a status line to clear", func() {
+			r := &progressReporter{command: "export", progress: progress, out: out}
+			r.show()
+			out.Reset()
+			r.clear()
+			Expect(out.String()).To(BeEmpty())
+		})
+	})
+
+	Context("when standard error is a terminal", func() {
+		It("keeps a status line up to date, and clears it", func() {
+			progress.AddDiscovered(10)
+			progress.AddFetched(4)
+			r := &progressReporter{command: "export", progress: progress, out: out, tty: true}
+			r.show()
+			Expect(out.String()).To(HavePrefix("\r\033[K"))
+			Expect(out.String()).To(ContainSubstring("10 discovered, 4 fetched"))
+			Expect(out.String()).NotTo(HaveSuffix("\n"))
+
+			out.Reset()
+			r.clear()
+			Expect(out.String()).To(Equal("\r\033[K"))
+			Expect(r.drawn).To(BeFalse())
+		})
+	})
+})
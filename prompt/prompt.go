@@ -36,3 +36,22 @@ func Secure(label string, args ...interface{}) string {
 	ansi.Fprintf(os.Stderr, "\n")
 	return string(b)
 }
+
+//SecureTerminal is like Secure, but always reads from the terminal, even if
+// standard input has been redirected (say, to read a file from it).
+func SecureTerminal(label string, args ...interface{}) (string, error) {
+	if isatty.IsTerminal(os.Stdin.Fd()) {
+		return Secure(label, args...), nil
+	}
+
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return "", err
+	}
+	defer tty.Close()
+
+	ansi.Fprintf(os.Stderr, label, args...)
+	b, err := terminal.ReadPassword(int(tty.Fd()))
+	ansi.Fprintf(os.Stderr, "\n")
+	return string(b), err
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	ansi "github.com/jhunt/go-ansi"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+// A passwordEntry is one entry from a password manager, on its way to
+// becoming a secret.  Folder is the folders (or groups) it was in, outermost
+// first.
+type passwordEntry struct {
+	Folder []string
+	Name   string
+	Data   *vault.Secret
+}
+
+var passwordManagers = []string{"bitwarden", "keepass", "pass"}
+
+// readPasswordManager reads all of the entries out of an export from (or, for
+// pass, the store of) the given password manager.
+func readPasswordManager(from, file string) ([]passwordEntry, error) {
+	switch from {
+	case "keepass":
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return readKeePass(b)
+
+	case "bitwarden":
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return readBitwarden(b)
+
+	case "pass":
+		return readPassStore(file)
+	}
+	return nil, fmt.Errorf("Unrecognized password manager `%s' (try one of %s)", from, strings.Join(passwordManagers, ", "))
+}
+
+// setIfPresent sets key in s, unless value is empty; password managers are
+// full of empty fields.
+func setIfPresent(s *vault.Secret, key, value string) {
+	if value != "" {
+		s.Set(key, value, false)
+	}
+}
+
+var pathUnsafe = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// pathSegment turns the name of a folder or an entry into something that can
+// go between the slashes of a path, without needing to be quoted in a shell.
+func pathSegment(name string) string {
+	return strings.Trim(pathUnsafe.ReplaceAllString(strings.TrimSpace(name), "-"), "-.")
+}
+
+// passwordEntryPaths works out where under root each entry goes.  Entries that
+// would end up at the same path are told apart with -2, -3, and so on.
+func passwordEntryPaths(root string, entries []passwordEntry) []string {
+	seen := map[string]bool{}
+	paths := make([]string, len(entries))
+	for i, e := range entries {
+		parts := []string{strings.TrimSuffix(root, "/")}
+		for _, folder := range e.Folder {
+			if segment := pathSegment(folder); segment != "" {
+				parts = append(parts, segment)
+			}
+		}
+		name := pathSegment(e.Name)
+		if name == "" {
+			name = "untitled"
+		}
+		parts = append(parts, name)
+
+		path := strings.Join(parts, "/")
+		for n := 2; seen[path]; n++ {
+			path = fmt.Sprintf("%s-%d", strings.Join(parts, "/"), n)
+		}
+		seen[path] = true
+		paths[i] = path
+	}
+	return paths
+}
+
+// importPasswordEntries writes each entry to its own secret under root, or, if
+// plan is set, tells the plan what would be written.  With noClobber, entries
+// are merged into any secret already at their path, unless that would change
+// any of its keys, in which case the entry is skipped.
+func importPasswordEntries(v *vault.Vault, root string, entries []passwordEntry, plan *importPlan, noClobber, quiet bool) error {
+	clobbered := func(existing, entry *vault.Secret) []string {
+		var keys []string
+		for _, key := range entry.Keys() {
+			if existing.Has(key) {
+				keys = append(keys, key)
+			}
+		}
+		return keys
+	}
+	refuse := func(path string, keys []string) {
+		if !quiet {
+			ansi.Fprintf(os.Stderr, "@R{Cowardly refusing to update} @C{%s}@R{, as the following keys would be clobbered:} @C{%s}\n",
+				path, strings.Join(keys, ", "))
+		}
+	}
+
+	for i, path := range passwordEntryPaths(root, entries) {
+		data := entries[i].Data
+		if plan != nil {
+			if noClobber {
+				existing, err := v.Read(path)
+				if err != nil && !vault.IsNotFound(err) {
+					return err
+				}
+				if err == nil {
+					if keys := clobbered(existing, data); len(keys) > 0 {
+						plan.skip(path, fmt.Sprintf("would clobber %s", strings.Join(keys, ", ")))
+						continue
+					}
+					if err = mergeSecret(existing, data); err != nil {
+						return err
+					}
+					data = existing
+				}
+			}
+
+			exported := exportSecret{Versions: []exportVersion{{Value: map[string]string{}}}}
+			for _, key := range data.Keys() {
+				exported.Versions[0].Value[key] = data.Get(key)
+			}
+			if err := plan.add(path, exported, false); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !noClobber {
+			if err := v.Write(path, data); err != nil {
+				return err
+			}
+		} else {
+			skipped := false
+			err := v.Update(path, func(existing *vault.Secret) error {
+				if keys := clobbered(existing, data); len(keys) > 0 {
+					refuse(path, keys)
+					skipped = true
+					return vault.SkipWrite
+				}
+				return mergeSecret(existing, data)
+			})
+			if err != nil {
+				return err
+			}
+			if skipped {
+				continue
+			}
+		}
+		if !quiet {
+			notef("wrote %s\n", path)
+		}
+	}
+	return nil
+}
+
+/* KeePass (2.x) XML exports */
+
+type keePassFile struct {
+	Meta struct {
+		RecycleBinUUID string `xml:"RecycleBinUUID"`
+	} `xml:"Meta"`
+	Root struct {
+		Groups []keePassGroup `xml:"Group"`
+	} `xml:"Root"`
+}
+
+type keePassGroup struct {
+	UUID    string         `xml:"UUID"`
+	Name    string         `xml:"Name"`
+	Entries []keePassEntry `xml:"Entry"`
+	Groups  []keePassGroup `xml:"Group"`
+}
+
+// History holds old copies of the entry, which we don't want, so it is left
+// out on purpose
+type keePassEntry struct {
+	Strings []struct {
+		Key   string `xml:"Key"`
+		Value string `xml:"Value"`
+	} `xml:"String"`
+}
+
+func readKeePass(b []byte) ([]passwordEntry, error) {
+	var f keePassFile
+	if err := xml.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("Could not interpret KeePass XML export: %s", err)
+	}
+
+	var entries []passwordEntry
+	var walk func(g keePassGroup, folder []string)
+	walk = func(g keePassGroup, folder []string) {
+		if f.Meta.RecycleBinUUID != "" && g.UUID == f.Meta.RecycleBinUUID {
+			return
+		}
+		for _, e := range g.Entries {
+			entry := passwordEntry{Folder: folder, Data: vault.NewSecret()}
+			for _, str := range e.Strings {
+				switch str.Key {
+				case "Title":
+					entry.Name = str.Value
+				case "UserName":
+					setIfPresent(entry.Data, "username", str.Value)
+				case "Password":
+					setIfPresent(entry.Data, "password", str.Value)
+				case "URL":
+					setIfPresent(entry.Data, "url", str.Value)
+				case "Notes":
+					setIfPresent(entry.Data, "notes", str.Value)
+				default:
+					setIfPresent(entry.Data, str.Key, str.Value)
+				}
+			}
+			entries = append(entries, entry)
+		}
+		for _, sub := range g.Groups {
+			walk(sub, append(append([]string{}, folder...), sub.Name))
+		}
+	}
+	//The top group is the database itself, which isn't a folder anybody made
+	for _, g := range f.Root.Groups {
+		walk(g, nil)
+	}
+	return entries, nil
+}
+
+/* Bitwarden (unencrypted) JSON exports */
+
+type bitwardenExport struct {
+	Encrypted bool `json:"encrypted"`
+	Folders   []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"folders"`
+	//Organization exports have collections instead of folders
+	Collections []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"collections"`
+	Items []struct {
+		FolderID      string   `json:"folderId"`
+		CollectionIDs []string `json:"collectionIds"`
+		Type          int      `json:"type"`
+		Name          string   `json:"name"`
+		Notes         string   `json:"notes"`
+		Login         *struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			TOTP     string `json:"totp"`
+			URIs     []struct {
+				URI string `json:"uri"`
+			} `json:"uris"`
+		} `json:"login"`
+		Card     map[string]interface{} `json:"card"`
+		Identity map[string]interface{} `json:"identity"`
+		Fields   []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"fields"`
+	} `json:"items"`
+}
+
+func readBitwarden(b []byte) ([]passwordEntry, error) {
+	var export bitwardenExport
+	if err := json.Unmarshal(b, &export); err != nil {
+		return nil, fmt.Errorf("Could not interpret Bitwarden JSON export: %s", err)
+	}
+	if export.Encrypted {
+		return nil, fmt.Errorf("This Bitwarden export is encrypted; export the vault again as (unencrypted) JSON")
+	}
+
+	folders := map[string]string{}
+	for _, f := range export.Folders {
+		folders[f.ID] = f.Name
+	}
+	for _, c := range export.Collections {
+		folders[c.ID] = c.Name
+	}
+
+	var entries []passwordEntry
+	for _, item := range export.Items {
+		entry := passwordEntry{Name: item.Name, Data: vault.NewSecret()}
+		folder := folders[item.FolderID]
+		if folder == "" && len(item.CollectionIDs) > 0 {
+			folder = folders[item.CollectionIDs[0]]
+		}
+		//Bitwarden nests folders by putting slashes in their names
+		if folder != "" {
+			entry.Folder = strings.Split(folder, "/")
+		}
+
+		if item.Login != nil {
+			setIfPresent(entry.Data, "username", item.Login.Username)
+			setIfPresent(entry.Data, "password", item.Login.Password)
+			setIfPresent(entry.Data, "totp", item.Login.TOTP)
+			if len(item.Login.URIs) > 0 {
+				setIfPresent(entry.Data, "url", item.Login.URIs[0].URI)
+			}
+		}
+		for _, details := range []map[string]interface{}{item.Card, item.Identity} {
+			for key, value := range details {
+				if str, ok := value.(string); ok {
+					setIfPresent(entry.Data, key, str)
+				}
+			}
+		}
+		setIfPresent(entry.Data, "notes", item.Notes)
+		for _, field := range item.Fields {
+			setIfPresent(entry.Data, field.Name, field.Value)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+/* pass (password-store) directories */
+
+func readPassStore(dir string) ([]passwordEntry, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && strings.HasPrefix(info.Name(), ".") && path != dir {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && strings.HasSuffix(path, ".gpg") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not read password store `%s': %s", dir, err)
+	}
+	sort.Strings(files)
+
+	var entries []passwordEntry
+	for _, file := range files {
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return nil, err
+		}
+		parts := strings.Split(filepath.ToSlash(strings.TrimSuffix(rel, ".gpg")), "/")
+
+		cmd := exec.Command("gpg", "--quiet", "--batch", "--decrypt", file)
+		cmd.Stderr = os.Stderr
+		plaintext, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("Could not decrypt `%s' with gpg: %s", file, err)
+		}
+
+		entries = append(entries, passwordEntry{
+			Folder: parts[:len(parts)-1],
+			Name:   parts[len(parts)-1],
+			Data:   parsePassEntry(plaintext),
+		})
+	}
+	return entries, nil
+}
+
+// parsePassEntry follows the usual convention for pass entries: the password
+// is on the first line, and it can be followed by `key: value' lines.
+// Anything else is kept as notes.
+func parsePassEntry(b []byte) *vault.Secret {
+	s := vault.NewSecret()
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	if scanner.Scan() {
+		setIfPresent(s, "password", scanner.Text())
+	}
+
+	var notes []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		kv := strings.SplitN(line, ":", 2)
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		//Leave URLs on lines of their own (https://...) in the notes, too
+		if len(kv) != 2 || key == "" || strings.ContainsAny(key, " \t") || strings.HasPrefix(kv[1], "//") || (key == "password" && s.Has(key)) {
+			notes = append(notes, line)
+			continue
+		}
+		switch key {
+		case "user", "login":
+			key = "username"
+		case "website", "site":
+			key = "url"
+		}
+		setIfPresent(s, key, strings.TrimSpace(kv[1]))
+	}
+	setIfPresent(s, "notes", strings.TrimSpace(strings.Join(notes, "\n")))
+	return s
+}
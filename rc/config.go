@@ -181,7 +181,7 @@ func writeTempCACerts(certs []string) (string, error) {
 	toCleanup = append(toCleanup, caFile.Name())
 
 	go func() {
-		sigChan := make(chan os.Signal)
+		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, os.Interrupt)
 		<-sigChan
 		Cleanup()
@@ -1,13 +1,112 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/jhunt/go-ansi"
 	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+// A runningCommand is what the command being run talks to the Vault under,
+// and how it is stopped.  Each command gets its own, from startCommand, and
+// nothing else changes which one is running.
+type runningCommand struct {
+	//ctx runs out when --timeout does, and is cancelled by the first Ctrl-C
+	// while the command is running gracefully()
+	ctx context.Context
+	//requestCtx is what each request to the Vault is made under.  It only
+	// runs out when --timeout does, so that a Ctrl-C lets the requests in
+	// flight finish, but a timeout cuts them off too
+	requestCtx context.Context
+	//progress is kept up to date by everything that the command does through
+	// a *vault.Vault from connect()
+	progress *vault.Progress
+
+	interrupt, stop func()
+
+	lock                 sync.Mutex
+	gracefully, stopping bool
+}
+
+var (
+	running     = newRunningCommand(0)
+	runningLock sync.Mutex
 )
 
+func newRunningCommand(timeout time.Duration) *runningCommand {
+	c := &runningCommand{progress: vault.NewProgress()}
+	c.requestCtx = context.Background()
+	stopRequests := func() {}
+	if timeout > 0 {
+		c.requestCtx, stopRequests = context.WithTimeout(c.requestCtx, timeout)
+	}
+	var interrupt context.CancelFunc
+	c.ctx, interrupt = context.WithCancel(c.requestCtx)
+	c.interrupt = interrupt
+	c.stop = func() {
+		interrupt()
+		stopRequests()
+	}
+	return c
+}
+
+// startCommand stops the command that was running, if any, and starts the
+// next one, with a deadline if timeout is given.
+func startCommand(timeout time.Duration) *runningCommand {
+	runningLock.Lock()
+	defer runningLock.Unlock()
+	running.stop()
+	running = newRunningCommand(timeout)
+	return running
+}
+
+// currentCommand is the command being run.
+func currentCommand() *runningCommand {
+	runningLock.Lock()
+	defer runningLock.Unlock()
+	return running
+}
+
+// gracefully runs fn, which must keep an eye on the context of the command
+// being run (as everything working through a *vault.Vault from connect()
+// does).  While it runs, the first SIGINT or SIGTERM cancels that context
+// instead of exiting, so that fn can stop cleanly; a second one exits straight
+// away, as usual.
+func gracefully(fn func() error) error {
+	c := currentCommand()
+	c.lock.Lock()
+	c.gracefully = true
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		c.gracefully = false
+		c.lock.Unlock()
+	}()
+	return fn()
+}
+
+// interruptedGracefully cancels the context of the command being run, and
+// returns true, if it can stop cleanly and hasn't been asked to already.
+func (c *runningCommand) interruptedGracefully() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.gracefully || c.stopping {
+		return false
+	}
+	c.stopping = true
+	c.interrupt()
+	return true
+}
+
 func Signals() {
 	prev, err := terminal.GetState(int(os.Stdin.Fd()))
 	if err != nil {
@@ -15,9 +114,55 @@ func Signals() {
 	}
 
 	s := make(chan os.Signal, 1)
-	signal.Notify(s, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
-	for range s {
+	signal.Notify(s, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGHUP)
+	for sig := range s {
+		if (sig == syscall.SIGTERM || sig == syscall.SIGINT) && currentCommand().interruptedGracefully() {
+			ansi.Fprintf(os.Stderr, "\n@Y{Interrupted; stopping once the requests in flight are done (interrupt again to quit right away)}\n")
+			continue
+		}
 		terminal.Restore(int(os.Stdin.Fd()), prev)
+		//Deferred clean-up doesn't get to run, so anything secret that was
+		// written out has to be got rid of here
+		shredTempFiles()
 		os.Exit(1)
 	}
 }
+
+// parseTimeout reads the --timeout option, which is either a duration (like
+// 90s or 1h30m), or a number of seconds.
+func parseTimeout(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Invalid --timeout `%s': expected a duration (like 90s or 1h30m) or a number of seconds", s)
+	}
+	return d, nil
+}
+
+// reportInterrupted lists the paths that a recursive operation did, failed
+// to do, and did not get to before it was stopped.
+func reportInterrupted(err *vault.InterruptedError) {
+	if len(err.Done) > 0 {
+		ansi.Fprintf(os.Stderr, "@G{Done:}\n")
+		for _, path := range err.Done {
+			ansi.Fprintf(os.Stderr, "  @G{%s}\n", path)
+		}
+	}
+	if len(err.Failed) > 0 {
+		ansi.Fprintf(os.Stderr, "@R{Failed:}\n")
+		for _, failed := range err.Failed {
+			ansi.Fprintf(os.Stderr, "  @R{%s}: %s\n", failed.Path, failed.Err)
+		}
+	}
+	if len(err.NotDone) > 0 {
+		ansi.Fprintf(os.Stderr, "@Y{Not done:}\n")
+		for _, path := range err.NotDone {
+			ansi.Fprintf(os.Stderr, "  @Y{%s}\n", path)
+		}
+	}
+}
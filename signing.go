@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+// signedExport is the envelope that `safe export --sign' wraps an export in.
+// The manifest has the SHA-256 digest of each secret in the export, and of
+// the export as a whole; the signature covers the manifest (as JSON).  If the
+// export is encrypted as well, it is signed first, and the signed envelope is
+// what gets encrypted.
+type signedExport struct {
+	Version   int             `json:"safe_signed_export"`
+	Manifest  exportManifest  `json:"manifest"`
+	Signature []byte          `json:"signature"`
+	Export    json.RawMessage `json:"export"`
+}
+
+type exportManifest struct {
+	Algorithm string            `json:"algorithm"`
+	Digest    string            `json:"digest"`
+	Secrets   map[string]string `json:"secrets"`
+}
+
+const (
+	signedExportVersion = 1
+	ed25519Signing      = "ed25519"
+	hmacSigning         = "hmac-sha256"
+)
+
+// A signingKey is either an Ed25519 key (of which only the public half is
+// needed to verify), or a shared HMAC secret.
+type signingKey struct {
+	Algorithm string
+	private   ed25519.PrivateKey
+	public    ed25519.PublicKey
+	secret    []byte
+}
+
+// loadSigningKey finds the key that ref names: a local file, if ref starts
+// with an @ (like @/path/to/key), or a key in the Vault (like
+// secret/backups:signing-key) otherwise.
+func loadSigningKey(ref string) (*signingKey, error) {
+	if strings.HasPrefix(ref, "@") {
+		b, err := ioutil.ReadFile(strings.TrimPrefix(ref, "@"))
+		if err != nil {
+			return nil, err
+		}
+		return parseSigningKey(b)
+	}
+
+	path, key, version := vault.ParsePath(vault.Canonicalize(ref))
+	if key == "" {
+		return nil, fmt.Errorf("Signing key `%s' has to be either a path and key in the Vault (like secret/backups:key), or a local file (like @path/to/key)", ref)
+	}
+	s, err := connect(true).Read(vault.EncodePath(path, "", version))
+	if err != nil {
+		return nil, err
+	}
+	if !s.Has(key) {
+		return nil, fmt.Errorf("No key `%s' in secret `%s' to sign with", key, path)
+	}
+	return parseSigningKey([]byte(s.Get(key)))
+}
+
+// parseSigningKey works out what sort of key b holds.  Ed25519 keys can be in
+// PEM (PKCS#8 private keys and PKIX public keys, as from openssl genpkey) or
+// in OpenSSH formats; anything else is taken to be an HMAC secret.
+func parseSigningKey(b []byte) (*signingKey, error) {
+	b = bytes.TrimSpace(b)
+
+	if block, _ := pem.Decode(b); block != nil {
+		var raw interface{}
+		var err error
+		switch block.Type {
+		case "PRIVATE KEY":
+			raw, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "PUBLIC KEY":
+			raw, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "OPENSSH PRIVATE KEY":
+			raw, err = ssh.ParseRawPrivateKey(b)
+		default:
+			return nil, fmt.Errorf("Cannot sign exports with a %s; only Ed25519 keys (and HMAC secrets) will do", block.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not read the signing key: %s", err)
+		}
+		return ed25519Key(raw)
+	}
+
+	if bytes.HasPrefix(b, []byte("ssh-ed25519 ")) {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read the signing key: %s", err)
+		}
+		return ed25519Key(pub.(ssh.CryptoPublicKey).CryptoPublicKey())
+	}
+
+	if len(b) < 16 {
+		return nil, fmt.Errorf("The signing key is too short to be used as an HMAC secret (it needs to be at least 16 characters long)")
+	}
+	return &signingKey{Algorithm: hmacSigning, secret: b}, nil
+}
+
+func ed25519Key(raw interface{}) (*signingKey, error) {
+	switch k := raw.(type) {
+	case ed25519.PrivateKey:
+		return &signingKey{Algorithm: ed25519Signing, private: k, public: k.Public().(ed25519.PublicKey)}, nil
+	case *ed25519.PrivateKey:
+		return ed25519Key(*k)
+	case ed25519.PublicKey:
+		return &signingKey{Algorithm: ed25519Signing, public: k}, nil
+	}
+	return nil, fmt.Errorf("Cannot sign exports with a %T; only Ed25519 keys (and HMAC secrets) will do", raw)
+}
+
+func (k *signingKey) sign(msg []byte) ([]byte, error) {
+	if k.Algorithm == hmacSigning {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(msg)
+		return mac.Sum(nil), nil
+	}
+	if k.private == nil {
+		return nil, fmt.Errorf("Exports can only be signed with the private half of an Ed25519 key")
+	}
+	return ed25519.Sign(k.private, msg), nil
+}
+
+func (k *signingKey) verify(msg, sig []byte) bool {
+	if k.Algorithm == hmacSigning {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(msg)
+		return hmac.Equal(sig, mac.Sum(nil))
+	}
+	return ed25519.Verify(k.public, msg, sig)
+}
+
+// exportDigests returns the SHA-256 digest of each secret in an export (V1,
+// V2 or V4), keyed by path, and of the export itself.  The export is
+// compacted first, so that reformatting it doesn't change anything.
+func exportDigests(export []byte) (json.RawMessage, map[string]string, string, error) {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, export); err != nil {
+		return nil, nil, "", fmt.Errorf("Could not interpret export: %s", err)
+	}
+
+	var secrets map[string]json.RawMessage
+	var v2 []struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(compact.Bytes(), &v2); err == nil && len(v2) == 1 {
+		secrets = v2[0].Data
+	} else if err := json.Unmarshal(compact.Bytes(), &secrets); err != nil {
+		return nil, nil, "", fmt.Errorf("Only V1, V2 and V4 exports can be signed")
+	}
+
+	digests := map[string]string{}
+	for path, secret := range secrets {
+		sum := sha256.Sum256(secret)
+		digests[path] = hex.EncodeToString(sum[:])
+	}
+	sum := sha256.Sum256(compact.Bytes())
+	return compact.Bytes(), digests, hex.EncodeToString(sum[:]), nil
+}
+
+// signExport wraps an export in a signed envelope.
+func signExport(export []byte, key *signingKey) ([]byte, error) {
+	compact, digests, digest, err := exportDigests(export)
+	if err != nil {
+		return nil, err
+	}
+	s := signedExport{
+		Version:  signedExportVersion,
+		Manifest: exportManifest{Algorithm: key.Algorithm, Digest: digest, Secrets: digests},
+		Export:   compact,
+	}
+	manifest, err := json.Marshal(s.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	if s.Signature, err = key.sign(manifest); err != nil {
+		return nil, err
+	}
+
+	//Leave the export exactly as it was digested
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	if err = enc.Encode(s); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n")), nil
+}
+
+// isSignedExport returns true if b looks like the output of
+// `safe export --sign'.
+func isSignedExport(b []byte) bool {
+	b = bytes.TrimSpace(b)
+	if !bytes.HasPrefix(b, []byte("{")) || !bytes.Contains(b, []byte(`"safe_signed_export"`)) {
+		return false
+	}
+	var s signedExport
+	return json.Unmarshal(b, &s) == nil && s.Version != 0
+}
+
+// verifyExport checks a signed export against its manifest, and if a key is
+// given, checks the signature on the manifest, too.  It returns the export
+// that was inside, and the manifest.
+func verifyExport(b []byte, key *signingKey) ([]byte, *exportManifest, error) {
+	var s signedExport
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, nil, fmt.Errorf("Could not interpret signed export: %s", err)
+	}
+	if s.Version != signedExportVersion {
+		return nil, nil, fmt.Errorf("Signed export is in version %d of the format, which this version of safe does not understand", s.Version)
+	}
+
+	compact, digests, digest, err := exportDigests(s.Export)
+	if err != nil {
+		return nil, nil, err
+	}
+	var problems []string
+	for path, sum := range s.Manifest.Secrets {
+		if have, ok := digests[path]; !ok {
+			problems = append(problems, fmt.Sprintf("%s is missing", path))
+		} else if have != sum {
+			problems = append(problems, fmt.Sprintf("%s has been changed", path))
+		}
+	}
+	for path := range digests {
+		if _, ok := s.Manifest.Secrets[path]; !ok {
+			problems = append(problems, fmt.Sprintf("%s is not in the manifest", path))
+		}
+	}
+	if len(problems) == 0 && digest != s.Manifest.Digest {
+		problems = append(problems, "the digest of the export does not match")
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, nil, fmt.Errorf("Export has been damaged or tampered with:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	if key != nil {
+		if key.Algorithm != s.Manifest.Algorithm {
+			return nil, nil, fmt.Errorf("Export was signed with %s, but the key given is for %s", s.Manifest.Algorithm, key.Algorithm)
+		}
+		manifest, err := json.Marshal(s.Manifest)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !key.verify(manifest, s.Signature) {
+			return nil, nil, fmt.Errorf("The signature on the export is not valid for the key given; it has been tampered with, or was signed with another key")
+		}
+	}
+	return compact, &s.Manifest, nil
+}
+
+// unwrapSignedExport returns the export inside a signed export, having
+// checked it (and its signature, if a key is given).  Unsigned exports are
+// returned as they are, unless there is a key to verify them with, in which
+// case there is nothing to trust them by.
+func unwrapSignedExport(b []byte, key *signingKey) ([]byte, error) {
+	if !isSignedExport(b) {
+		if key != nil {
+			return nil, fmt.Errorf("Export is not signed, so it cannot be verified")
+		}
+		return b, nil
+	}
+	export, _, err := verifyExport(b, key)
+	return export, err
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+// Version 3 of the export format is meant for Vaults that are too big to hold
+// in memory all at once.  It is newline-delimited JSON: a header line, then
+// one line for each secret (in whatever order the secrets were found), and
+// finally a trailer line that says how many secrets there were, so that an
+// export that was cut short can be told apart from a complete one.
+//
+//   {"export_version":3}
+//   {"path":"secret/a","versions":[{"value":{"k":"v"}}]}
+//   {"path":"secret/b","first":4,"versions":[...]}
+//   {"export_complete":true,"secrets":2}
+//
+// Each secret line carries the same information as one entry in the data of
+// a version 2 export (or version 4, if the export was made with --metadata).
+const streamedExportVersion = 3
+
+type streamedHeader struct {
+	ExportVersion uint `json:"export_version"`
+}
+
+type streamedSecret struct {
+	Path string `json:"path"`
+	exportSecret
+}
+
+type streamedTrailer struct {
+	Complete bool `json:"export_complete"`
+	Secrets  int  `json:"secrets"`
+}
+
+// toExportSecret converts a secret from the tree walker into its exported
+// form.  Deleted versions are only kept as deleted if they were asked for
+// (and so were read); otherwise they are exported as destroyed.
+func toExportSecret(secret vault.SecretEntry, deleted, shallow bool) exportSecret {
+	ret := exportSecret{FirstVersion: secret.Versions[0].Number}
+	//We want to omit the `first` key in the json if it's 1
+	if ret.FirstVersion == 1 || shallow {
+		ret.FirstVersion = 0
+	}
+
+	for _, version := range secret.Versions {
+		thisVersion := exportVersion{
+			Deleted:   version.State == vault.SecretStateDeleted && deleted,
+			Destroyed: version.State == vault.SecretStateDestroyed || (version.State == vault.SecretStateDeleted && !deleted),
+			Value:     map[string]string{},
+		}
+
+		for _, key := range version.Data.Keys() {
+			thisVersion.Value[key] = version.Data.Get(key)
+		}
+
+		//The times go along with the rest of the metadata, when it was asked for
+		if secret.Metadata != nil {
+			thisVersion.CreatedTime, thisVersion.DeletionTime = version.CreatedTime, version.DeletionTime
+		}
+
+		ret.Versions = append(ret.Versions, thisVersion)
+	}
+
+	//Only bother with metadata that somebody has actually set
+	if m := secret.Metadata; m != nil && !m.IsDefault() {
+		ret.Metadata = &exportMetadata{
+			MaxVersions:        m.MaxVersions,
+			CASRequired:        m.CASRequired,
+			DeleteVersionAfter: m.DeleteVersionAfter,
+			CustomMetadata:     m.CustomMetadata,
+		}
+		if ret.Metadata.DeleteVersionAfter == "0s" {
+			ret.Metadata.DeleteVersionAfter = ""
+		}
+	}
+	return ret
+}
+
+// restoreMetadata sets the KV v2 metadata of the secret at path to what was
+// exported.  This has to happen after the versions have been written, so that
+// cas_required doesn't get in the way of writing them, and max_versions
+// doesn't throw any away.
+func restoreMetadata(v *vault.Vault, path string, m *exportMetadata) error {
+	if m == nil {
+		return nil
+	}
+	err := v.SetMetadata(path, vault.SecretMetadata{
+		MaxVersions:        m.MaxVersions,
+		CASRequired:        m.CASRequired,
+		DeleteVersionAfter: m.DeleteVersionAfter,
+		CustomMetadata:     m.CustomMetadata,
+	})
+	if err != nil {
+		return fmt.Errorf("Could not restore metadata of `%s': %s", path, err)
+	}
+	return nil
+}
+
+type importOpts struct {
+	IgnoreDestroyed bool
+	IgnoreDeleted   bool
+	Shallow         bool
+	Rebase          []pathRebase
+	//Quiet leaves out the notes about what was written and skipped
+	Quiet bool
+	//Plan, if set, is told about each secret instead of it being written
+	Plan *importPlan
+}
+
+// fromExportSecret converts an exported secret back into the form that the
+// vault package knows how to write, leaving out anything that the import
+// options say to ignore.
+func fromExportSecret(path string, secret exportSecret, opts importOpts) vault.SecretEntry {
+	s := vault.SecretEntry{
+		Path: path,
+	}
+
+	firstVersion := secret.FirstVersion
+	if firstVersion == 0 {
+		firstVersion = 1
+	}
+
+	if opts.Shallow && len(secret.Versions) > 0 {
+		secret.Versions = secret.Versions[len(secret.Versions)-1:]
+	}
+	for i := range secret.Versions {
+		state := vault.SecretStateAlive
+		if secret.Versions[i].Destroyed {
+			if opts.IgnoreDestroyed {
+				continue
+			}
+			state = vault.SecretStateDestroyed
+		} else if secret.Versions[i].Deleted {
+			if opts.IgnoreDeleted {
+				continue
+			}
+			state = vault.SecretStateDeleted
+		}
+		data := vault.NewSecret()
+		for k, v := range secret.Versions[i].Value {
+			data.Set(k, v, false)
+		}
+		s.Versions = append(s.Versions, vault.SecretVersion{
+			Number: firstVersion + uint(i),
+			State:  state,
+			Data:   data,
+		})
+	}
+	return s
+}
+
+// streamExport writes a version 3 export of everything under paths to out,
+// one secret at a time, as the secrets are read from the Vault.
+func streamExport(v *vault.Vault, paths []string, opts vault.TreeOpts, shallow bool, out io.Writer) error {
+	w := bufio.NewWriter(out)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+
+	if err := enc.Encode(streamedHeader{ExportVersion: streamedExportVersion}); err != nil {
+		return err
+	}
+
+	n := 0
+	for _, path := range paths {
+		err := v.Walk(path, opts, func(secret vault.SecretEntry) error {
+			if len(secret.Versions) == 0 {
+				return nil
+			}
+			n++
+			err := enc.Encode(streamedSecret{
+				Path:         secret.Path,
+				exportSecret: toExportSecret(secret, opts.GetDeletedVersions, shallow),
+			})
+			if err != nil {
+				return err
+			}
+			//Don't let a slow Vault keep what has been exported so far sitting
+			// in the buffer
+			return w.Flush()
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := enc.Encode(streamedTrailer{Complete: true, Secrets: n}); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// isStreamedExport returns true if line is the header of a version 3 export.
+func isStreamedExport(line []byte) bool {
+	line = bytes.TrimSpace(line)
+	if !bytes.HasPrefix(line, []byte("{")) || !bytes.HasSuffix(line, []byte("}")) {
+		return false
+	}
+	var h streamedHeader
+	return json.Unmarshal(line, &h) == nil && h.ExportVersion == streamedExportVersion
+}
+
+// importCheckpoint remembers which secrets have already been imported, in a
+// file with one path per line, so that an import that fails partway through
+// can be run again without writing everything a second time.
+type importCheckpoint struct {
+	lock sync.Mutex
+	done map[string]bool
+	file *os.File
+}
+
+func openImportCheckpoint(path string) (*importCheckpoint, error) {
+	c := &importCheckpoint{done: map[string]bool{}}
+	if path == "" {
+		return c, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open checkpoint file `%s': %s", path, err)
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			c.done[line] = true
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Could not read checkpoint file `%s': %s", path, err)
+	}
+	c.file = f
+	return c, nil
+}
+
+func (c *importCheckpoint) Done(path string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.done[path]
+}
+
+func (c *importCheckpoint) Mark(path string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.done[path] = true
+	if c.file == nil {
+		return nil
+	}
+	_, err := fmt.Fprintf(c.file, "%s\n", path)
+	return err
+}
+
+func (c *importCheckpoint) Close() error {
+	if c.file == nil {
+		return nil
+	}
+	return c.file.Close()
+}
+
+// versioningCheck verifies that the mounts that secrets with more than one
+// version are imported into actually support versioning, looking each mount
+// up only once.  It is safe to use from more than one goroutine at once.
+type versioningCheck struct {
+	v      *vault.Vault
+	lock   sync.Mutex
+	mounts map[string]bool
+}
+
+func newVersioningCheck(v *vault.Vault) *versioningCheck {
+	return &versioningCheck{v: v, mounts: map[string]bool{}}
+}
+
+func (c *versioningCheck) check(path string) error {
+	mount, err := c.v.Client().MountPath(path)
+	if err != nil {
+		return fmt.Errorf("Export has secrets with multiple versions for `%s', but the mount either\n"+
+			"does not exist or does not support versioning", path)
+	}
+	c.lock.Lock()
+	ok, seen := c.mounts[mount]
+	c.lock.Unlock()
+	if !seen {
+		mountVersion, err := c.v.MountVersion(mount)
+		if err != nil {
+			return fmt.Errorf("Could not determine existing mount version: %s", err)
+		}
+		ok = mountVersion == 2
+		c.lock.Lock()
+		c.mounts[mount] = ok
+		c.lock.Unlock()
+	}
+	if !ok {
+		return fmt.Errorf("Export for mount `%s' has secrets with multiple versions, but the mount either\n"+
+			"does not exist or does not support versioning", mount)
+	}
+	return nil
+}
+
+// streamImport reads the secrets of a version 3 export from in (just after
+// the header line) one at a time, and hands them to workers that write them
+// to the Vault in parallel.  Secrets that the checkpoint already has are
+// skipped, and each one that is written is added to it.
+func streamImport(v *vault.Vault, in io.Reader, opts importOpts, workers int, checkpoint *importCheckpoint) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		lock     sync.Mutex
+		firstErr error
+		mounts   = newVersioningCheck(v)
+	)
+	failed := func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return firstErr != nil
+	}
+	fail := func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	progress := currentCommand().progress
+	queue := make(chan streamedSecret, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for secret := range queue {
+				if failed() {
+					continue
+				}
+				if !opts.Shallow && len(secret.Versions) > 1 {
+					if err := mounts.check(secret.Path); err != nil {
+						fail(err)
+						continue
+					}
+				}
+
+				if opts.Plan != nil {
+					if err := opts.Plan.add(secret.Path, secret.exportSecret, true); err != nil {
+						fail(err)
+					}
+					continue
+				}
+
+				s := fromExportSecret(secret.Path, secret.exportSecret, opts)
+				err := s.Copy(v, s.Path, vault.TreeCopyOpts{
+					Clear: true,
+					Pad:   opts.pad(),
+				})
+				if err == nil {
+					err = restoreMetadata(v, secret.Path, secret.Metadata)
+				}
+				if err == nil {
+					err = checkpoint.Mark(secret.Path)
+				}
+				if err != nil {
+					fail(err)
+					continue
+				}
+				progress.AddWritten(1)
+				if !opts.Quiet {
+					notef("wrote %s\n", secret.Path)
+				}
+			}
+		}()
+	}
+
+	var (
+		n, skipped int
+		trailer    *streamedTrailer
+		err        error
+	)
+	dec := json.NewDecoder(in)
+	for !failed() {
+		var line struct {
+			streamedSecret
+			streamedTrailer
+		}
+		if err = dec.Decode(&line); err != nil {
+			if err == io.EOF {
+				err = nil
+			} else {
+				err = fmt.Errorf("Could not interpret secret #%d of the export: %s", n+1, err)
+			}
+			break
+		}
+		if line.Complete {
+			trailer = &line.streamedTrailer
+			break
+		}
+		if line.Path == "" {
+			err = fmt.Errorf("Could not interpret secret #%d of the export: it has no path", n+1)
+			break
+		}
+
+		n++
+		line.Path = opts.rebase(line.Path)
+		if checkpoint.Done(line.Path) {
+			skipped++
+			continue
+		}
+		queue <- line.streamedSecret
+	}
+	close(queue)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if err != nil {
+		return err
+	}
+	if trailer == nil {
+		return fmt.Errorf("Export ended after %d secrets, without saying that it was complete; it may have been cut short", n)
+	}
+	if trailer.Secrets != n {
+		return fmt.Errorf("Export says that it has %d secrets, but %d were found in it", trailer.Secrets, n)
+	}
+	if skipped > 0 && !opts.Quiet {
+		notef("skipped %d secrets that had already been imported\n", skipped)
+	}
+	if opts.Plan != nil {
+		opts.Plan.print()
+	}
+	return nil
+}
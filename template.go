@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sync"
+	"text/template"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+// secretTemplate renders text/template templates that pull values out of the
+// Vault.  Rendering happens in two passes: the first pass only notes which
+// secrets the template refers to, so that they can all be read in parallel
+// (and only once each) before the second pass produces the actual output.
+type secretTemplate struct {
+	vault   *vault.Vault
+	tmpl    *template.Template
+	secrets map[string]*vault.Secret
+	errors  map[string]error
+}
+
+func newSecretTemplate(v *vault.Vault, name, src string) (*secretTemplate, error) {
+	t := &secretTemplate{
+		vault:   v,
+		secrets: map[string]*vault.Secret{},
+		errors:  map[string]error{},
+	}
+
+	var err error
+	t.tmpl, err = template.New(name).Option("missingkey=error").Funcs(t.funcs(nil)).Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// funcs returns the functions available to templates.  If seen is not nil,
+// the functions just record the secrets they were asked for in it, and return
+// placeholder values.
+func (t *secretTemplate) funcs(seen map[string]bool) template.FuncMap {
+	read := func(path string) (*vault.Secret, error) {
+		path = vault.Canonicalize(path)
+		if seen != nil {
+			seen[path] = true
+			return vault.NewSecret(), nil
+		}
+		return t.read(path)
+	}
+
+	return template.FuncMap{
+		"secret": func(path string) (string, error) {
+			secret, key, version := vault.ParsePath(path)
+			if key == "" {
+				return "", fmt.Errorf("`%s' does not name a key; use secretMap for whole secrets", path)
+			}
+			s, err := read(vault.EncodePath(secret, "", version))
+			if err != nil || seen != nil {
+				return "", err
+			}
+			if !s.Has(key) {
+				return "", vault.NewKeyNotFoundError(secret, key)
+			}
+			return s.Get(key), nil
+		},
+
+		"secretMap": func(path string) (map[string]string, error) {
+			if vault.PathHasKey(path) {
+				return nil, fmt.Errorf("`%s' names a key; use secret for single values", path)
+			}
+			s, err := read(path)
+			if err != nil {
+				return nil, err
+			}
+			m := map[string]string{}
+			for _, key := range s.Keys() {
+				m[key] = s.Get(key)
+			}
+			return m, nil
+		},
+
+		"x509cert": func(path string) (*vault.X509, error) {
+			if vault.PathHasKey(path) {
+				return nil, fmt.Errorf("`%s' names a key; x509cert needs the path of a certificate", path)
+			}
+			s, err := read(path)
+			if err != nil {
+				return nil, err
+			}
+			if seen != nil {
+				return &vault.X509{Certificate: &x509.Certificate{}}, nil
+			}
+			return s.X509(false)
+		},
+
+		"b64enc": func(s string) string {
+			return base64.StdEncoding.EncodeToString([]byte(s))
+		},
+	}
+}
+
+// read returns the secret at the given path, reading it from the Vault if it
+// was not already fetched.
+func (t *secretTemplate) read(path string) (*vault.Secret, error) {
+	if err, failed := t.errors[path]; failed {
+		return nil, err
+	}
+	if s, found := t.secrets[path]; found {
+		return s, nil
+	}
+
+	s, err := t.vault.Read(path)
+	if err != nil {
+		t.errors[path] = err
+		return nil, err
+	}
+	t.secrets[path] = s
+	return s, nil
+}
+
+// prefetch does a dry run of the template to find the secrets it refers to,
+// and reads them all in parallel.  Anything that the dry run misses (say,
+// because it is only used when some secret has a particular value) will be
+// read when the template is rendered for real.
+func (t *secretTemplate) prefetch() {
+	seen := map[string]bool{}
+	t.tmpl.Funcs(t.funcs(seen)).Execute(ioutil.Discard, nil)
+	t.tmpl.Funcs(t.funcs(nil))
+
+	paths := make(chan string, len(seen))
+	for path := range seen {
+		paths <- path
+	}
+	close(paths)
+
+	numWorkers := runtime.NumCPU()
+	if numWorkers > len(seen) {
+		numWorkers = len(seen)
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				s, err := t.vault.Read(path)
+				lock.Lock()
+				if err != nil {
+					t.errors[path] = err
+				} else {
+					t.secrets[path] = s
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Render renders the template to out.  Nothing is written if rendering fails
+// part way through.
+func (t *secretTemplate) Render(out io.Writer) error {
+	t.prefetch()
+
+	var b bytes.Buffer
+	if err := t.tmpl.Execute(&b, nil); err != nil {
+		return err
+	}
+	_, err := out.Write(b.Bytes())
+	return err
+}
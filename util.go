@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/starkandwayne/safe/rc"
 )
 
 func duration(s string) (time.Duration, error) {
@@ -42,3 +45,31 @@ func uniq(l []string) []string {
 
 	return u
 }
+
+// splitTargetPath splits a `TARGET:path' argument into the alias of a known
+// Vault target and the path within it.  If the argument does not start with
+// the alias of a target in cfg, the target is returned empty and the argument
+// is returned as the path, unchanged.
+func splitTargetPath(cfg rc.Config, arg string) (target, path string) {
+	if idx := strings.Index(arg, ":"); idx > 0 && !strings.Contains(arg[:idx], "/") {
+		if _, known := cfg.Vaults[arg[:idx]]; known {
+			return arg[:idx], arg[idx+1:]
+		}
+	}
+	return "", arg
+}
+
+// envVarName turns the name of a key into the name of an environment
+// variable, by upper-casing it and replacing anything that is not a letter,
+// digit or underscore with an underscore.
+func envVarName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, key)
+}
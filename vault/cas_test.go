@@ -0,0 +1,101 @@
+package vault_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+var _ = Describe("Check-and-set writes", func() {
+	var fake *fakeVault
+
+	BeforeEach(func() {
+		fake = newFakeVault()
+		fake.set("app", map[string]string{"key": "one"})
+	})
+	AfterEach(func() {
+		fake.Close()
+	})
+
+	//update adds key=value to secret/app, but writes other=sneaky in between
+	// reading it and writing it back, the first time around
+	update := func(v *vault.Vault, calls *int) error {
+		return v.Update("secret/app", func(s *vault.Secret) error {
+			if *calls++; *calls == 1 {
+				fake.set("app", map[string]string{"key": "one", "other": "sneaky"})
+			}
+			return s.Set("mine", "yes", false)
+		})
+	}
+
+	It("re-reads and retries the change when the secret changes underneath it", func() {
+		calls := 0
+		Expect(update(fake.vault(vault.VaultConfig{}), &calls)).To(Succeed())
+		Expect(calls).To(Equal(2))
+		Expect(fake.versions("app")).To(Equal(3))
+
+		s, err := fake.vault(vault.VaultConfig{}).Read("secret/app")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.Get("other")).To(Equal("sneaky"))
+		Expect(s.Get("mine")).To(Equal("yes"))
+	})
+
+	It("fails with the conflict when retries are turned off", func() {
+		calls := 0
+		err := update(fake.vault(vault.VaultConfig{NoRetry: true}), &calls)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("--no-retry"))
+		Expect(calls).To(Equal(1))
+		Expect(fake.versions("app")).To(Equal(2))
+	})
+
+	It("gives up after a handful of conflicts", func() {
+		calls := 0
+		err := fake.vault(vault.VaultConfig{}).Update("secret/app", func(s *vault.Secret) error {
+			calls++
+			fake.set("app", map[string]string{"key": "again"})
+			return s.Set("mine", "yes", false)
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("attempts"))
+		Expect(calls).To(Equal(5))
+	})
+
+	It("stops retrying when the Vault is stopped", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		calls := 0
+		err := fake.vault(vault.VaultConfig{Context: ctx}).Update("secret/app", func(s *vault.Secret) error {
+			calls++
+			cancel()
+			fake.set("app", map[string]string{"key": "again"})
+			return s.Set("mine", "yes", false)
+		})
+		Expect(vault.IsCASConflict(err)).To(BeTrue())
+		Expect(calls).To(Equal(1))
+	})
+
+	Context("when the token can't read the metadata of secrets", func() {
+		BeforeEach(func() {
+			fake.forbidMetadata = true
+		})
+
+		It("still finds that a missing secret is missing", func() {
+			_, err := fake.vault(vault.VaultConfig{}).Read("secret/new")
+			Expect(vault.IsNotFound(err)).To(BeTrue())
+			Expect(fake.count("GET", "secret/metadata/new")).To(Equal(0))
+		})
+
+		It("writes new secrets without check-and-set", func() {
+			v := fake.vault(vault.VaultConfig{})
+			s, err := v.Read("secret/new")
+			Expect(vault.IsNotFound(err)).To(BeTrue())
+			Expect(s.Set("key", "value", false)).To(Succeed())
+			Expect(v.Write("secret/new", s)).To(Succeed())
+			Expect(fake.versions("new")).To(Equal(1))
+		})
+	})
+})
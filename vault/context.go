@@ -0,0 +1,98 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//ErrInterrupted and ErrTimedOut are what operations return when the context
+// that the Vault was made with is cancelled, or runs out of time
+var (
+	ErrInterrupted = errors.New("Interrupted")
+	ErrTimedOut    = errors.New("Timed out")
+)
+
+//Stopped returns nil if the context that the Vault was made with is still
+// going, and ErrTimedOut or ErrInterrupted if it isn't. Long-running
+// operations check this before each request that they make, so requests
+// already in flight are always allowed to finish.
+func (v *Vault) Stopped() error {
+	switch v.ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return ErrTimedOut
+	default:
+		return ErrInterrupted
+	}
+}
+
+//sleep waits for d to pass, unless the Vault is stopped first, in which case
+// it says why.
+func (v *Vault) sleep(d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-v.ctx.Done():
+		return v.Stopped()
+	}
+}
+
+//contextTransport makes every request to the Vault under ctx, so that it is
+// cut off if ctx runs out before the Vault answers it.
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req.WithContext(t.ctx))
+	if err != nil && t.ctx.Err() == context.DeadlineExceeded {
+		err = ErrTimedOut
+	}
+	return res, err
+}
+
+//An InterruptedError is returned by operations on a whole tree of secrets
+// that were stopped partway through, either because the Vault was stopped
+// (which Err says), or because some of the paths failed. Done has the paths
+// that were finished with, Failed the paths that failed, and NotDone the
+// paths that weren't touched, each in the order the operation would have
+// gone through them in. Being interrupted lets the paths under way finish,
+// but running out of time cuts off the requests in flight, so a path in
+// Failed may have been left half-done (say, copied but not deleted by a
+// move).
+type InterruptedError struct {
+	Err     error
+	Done    []string
+	Failed  []PathError
+	NotDone []string
+}
+
+//A PathError is why one path of an operation on a whole tree failed
+type PathError struct {
+	Path string
+	Err  error
+}
+
+func (e *InterruptedError) Error() string {
+	total := len(e.Done) + len(e.Failed) + len(e.NotDone)
+	if len(e.Failed) == 0 {
+		return fmt.Sprintf("%s after %d of %d paths", e.Err, len(e.Done), total)
+	}
+	return fmt.Sprintf("%d of %d paths failed (%d done, %d not started)", len(e.Failed), total, len(e.Done), len(e.NotDone))
+}
+
+//IsInterrupted returns true if err is ErrInterrupted or ErrTimedOut, or an
+// InterruptedError.
+func IsInterrupted(err error) bool {
+	if _, is := err.(*InterruptedError); is {
+		return true
+	}
+	return err == ErrInterrupted || err == ErrTimedOut
+}
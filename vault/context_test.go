@@ -0,0 +1,98 @@
+package vault_test
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+var _ = Describe("Stopping requests", func() {
+	var fake *fakeVault
+
+	BeforeEach(func() {
+		fake = newFakeVault()
+		fake.set("app", map[string]string{"key": "one"})
+	})
+	AfterEach(func() {
+		fake.Close()
+	})
+
+	//slowly makes reading secret/app take a while, calling first (if it is
+	// set) as soon as the request turns up
+	slowly := func(first func()) {
+		fake.respond = func(r *http.Request) (int, string) {
+			if r.Method == "GET" && r.URL.Path == "/v1/secret/data/app" {
+				if first != nil {
+					first()
+				}
+				time.Sleep(300 * time.Millisecond)
+			}
+			return 0, ""
+		}
+	}
+
+	It("cuts off requests in flight once the request context runs out", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		v := fake.vault(vault.VaultConfig{RequestContext: ctx})
+		slowly(nil)
+
+		start := time.Now()
+		_, err := v.Read("secret/app")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(vault.ErrTimedOut.Error()))
+		Expect(time.Since(start)).To(BeNumerically("<", 250*time.Millisecond))
+	})
+
+	It("cuts off requests waiting for their turn once the request context runs out", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		v := fake.vault(vault.VaultConfig{RequestContext: ctx, RequestsPerSecond: 1})
+
+		//Reading a secret takes more than one request, and only one can be made
+		// before time runs out
+		start := time.Now()
+		_, err := v.Read("secret/app")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(vault.ErrTimedOut.Error()))
+		Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+	})
+
+	It("lists a path that was cut off when time ran out as failed", func() {
+		requests, stop := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer stop()
+		ctx, cancel := context.WithCancel(requests)
+		defer cancel()
+		v := fake.vault(vault.VaultConfig{Context: ctx, RequestContext: requests})
+		slowly(nil)
+
+		err := v.ForEachPath([]string{"secret/app"}, func(path string) error {
+			_, err := v.Read(path)
+			return err
+		})
+		interrupted, ok := err.(*vault.InterruptedError)
+		Expect(ok).To(BeTrue())
+		Expect(interrupted.Err).To(Equal(vault.ErrTimedOut))
+		Expect(interrupted.Done).To(BeEmpty())
+		Expect(interrupted.Failed).To(HaveLen(1))
+		Expect(interrupted.Failed[0].Path).To(Equal("secret/app"))
+		Expect(interrupted.Failed[0].Err.Error()).To(ContainSubstring("may be half-done"))
+	})
+
+	It("lets requests in flight finish when the Vault is stopped", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		v := fake.vault(vault.VaultConfig{Context: ctx, RequestContext: context.Background()})
+		slowly(cancel)
+
+		s, err := v.Read("secret/app")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.Get("key")).To(Equal("one"))
+		Expect(v.Stopped()).To(Equal(vault.ErrInterrupted))
+	})
+})
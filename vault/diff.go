@@ -0,0 +1,289 @@
+package vault
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+const (
+	DiffUnchanged uint = iota
+	DiffAdded
+	DiffRemoved
+	DiffChanged
+)
+
+// KeyDiff describes how a single key differs between two secrets. Left and
+// Right hold the values on either side, and are empty if the key is absent
+// from that side.
+type KeyDiff struct {
+	Key   string
+	State uint
+	Left  string
+	Right string
+}
+
+// SecretDiff describes how a secret differs between two trees. Path is relative
+// to the roots that the trees were compared under, so the secret at the root
+// itself has an empty Path. Left and Right are nil if the secret does not
+// exist on that side.
+type SecretDiff struct {
+	Path  string
+	State uint
+	Left  *SecretEntry
+	Right *SecretEntry
+	Keys  []KeyDiff
+}
+
+type DiffOpts struct {
+	//Consider every version of each secret, instead of just the latest one.
+	// Key differences are always computed against the latest versions.
+	AllVersions bool
+	//Include secrets that are the same on both sides in the output
+	IncludeUnchanged bool
+	//Count deleted versions as destroyed ones, for when the values of deleted
+	// versions were not fetched on one side or the other
+	DeletedAsDestroyed bool
+}
+
+// Diff compares the secrets in s, rooted at root, against the secrets in other,
+// rooted at otherRoot. Secrets are matched up by their path relative to their
+// root. Secrets only in other are reported as added, and secrets only in s are
+// reported as removed. The result is sorted by relative path.
+func (s Secrets) Diff(root string, other Secrets, otherRoot string, opts DiffOpts) []SecretDiff {
+	left := s.relativeTo(root)
+	right := other.relativeTo(otherRoot)
+
+	paths := []string{}
+	for path := range left {
+		paths = append(paths, path)
+	}
+	for path := range right {
+		if _, found := left[path]; !found {
+			paths = append(paths, path)
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool { return PathLessThan(paths[i], paths[j]) })
+
+	ret := []SecretDiff{}
+	for _, path := range paths {
+		d := SecretDiff{Path: path, Left: left[path], Right: right[path]}
+		if d.compare(opts) || opts.IncludeUnchanged {
+			ret = append(ret, d)
+		}
+	}
+
+	return ret
+}
+
+//compare fills in the State and Keys of d from its Left and Right, and returns
+// true if they differ.
+func (d *SecretDiff) compare(opts DiffOpts) bool {
+	switch {
+	case d.Left == nil:
+		d.State = DiffAdded
+	case d.Right == nil:
+		d.State = DiffRemoved
+	default:
+		d.State = DiffUnchanged
+		if opts.AllVersions && !sameVersions(d.Left.Versions, d.Right.Versions, opts.DeletedAsDestroyed) {
+			d.State = DiffChanged
+		}
+	}
+
+	d.Keys = diffKeys(d.Left.latest(), d.Right.latest())
+	if d.State == DiffUnchanged {
+		for _, k := range d.Keys {
+			if k.State != DiffUnchanged {
+				d.State = DiffChanged
+				break
+			}
+		}
+	}
+	return d.State != DiffUnchanged
+}
+
+// DiffTree is one side of a WalkDiff: the secrets under Root in Vault, walked
+// with Opts.
+type DiffTree struct {
+	Vault *Vault
+	Root  string
+	Opts  TreeOpts
+	//Treat a Root that does not exist as an empty tree, instead of an error
+	AllowMissing bool
+}
+
+// WalkDiff is Diff for two trees that are walked, in order, instead of being
+// read into memory up front. fn is handed each difference in the order that
+// Diff would have returned them in, as soon as both walks have got past its
+// path, so the only secrets held onto are the ones that fn keeps. If fn
+// returns an error, both walks stop and that error is returned.
+func WalkDiff(left, right DiffTree, opts DiffOpts, fn func(SecretDiff) error) error {
+	done := make(chan struct{})
+	defer close(done)
+	l, r := left.walk(done), right.walk(done)
+
+	for {
+		lpath, lsecret := l.peek()
+		rpath, rsecret := r.peek()
+		if lsecret == nil && rsecret == nil {
+			break
+		}
+
+		var d SecretDiff
+		switch {
+		case rsecret == nil || (lsecret != nil && PathLessThan(lpath, rpath)):
+			d = SecretDiff{Path: lpath, Left: lsecret}
+			l.next = nil
+		case lsecret == nil || PathLessThan(rpath, lpath):
+			d = SecretDiff{Path: rpath, Right: rsecret}
+			r.next = nil
+		default:
+			d = SecretDiff{Path: lpath, Left: lsecret, Right: rsecret}
+			l.next, r.next = nil, nil
+		}
+
+		if d.compare(opts) || opts.IncludeUnchanged {
+			if err := fn(d); err != nil {
+				return err
+			}
+		}
+	}
+
+	if l.err != nil {
+		return l.err
+	}
+	return r.err
+}
+
+//errWalkDiffDone stops the walks of a WalkDiff that has finished early
+var errWalkDiffDone = errors.New("walk no longer needed")
+
+//diffWalk hands over the secrets of one side of a WalkDiff, in order, as its
+// walk finds them
+type diffWalk struct {
+	root    string
+	secrets chan SecretEntry
+	next    *SecretEntry
+	//err is only set once secrets is closed
+	err error
+}
+
+func (t DiffTree) walk(done <-chan struct{}) *diffWalk {
+	w := &diffWalk{root: Canonicalize(t.Root), secrets: make(chan SecretEntry, 64)}
+	opts := t.Opts
+	opts.Ordered = true
+
+	go func() {
+		defer close(w.secrets)
+		err := t.Vault.Walk(t.Root, opts, func(s SecretEntry) error {
+			select {
+			case w.secrets <- s:
+				return nil
+			case <-done:
+				return errWalkDiffDone
+			}
+		})
+		if err != nil && err != errWalkDiffDone && !(t.AllowMissing && IsNotFound(err)) {
+			w.err = err
+		}
+	}()
+	return w
+}
+
+//peek returns the next secret, and its path relative to the root of the walk,
+// without taking it. The secret is nil once the walk is over.
+func (w *diffWalk) peek() (string, *SecretEntry) {
+	if w.next == nil {
+		s, ok := <-w.secrets
+		if !ok {
+			return "", nil
+		}
+		w.next = &s
+	}
+	return relativePath(w.next.Path, w.root), w.next
+}
+
+func (s Secrets) relativeTo(root string) map[string]*SecretEntry {
+	root = Canonicalize(root)
+	ret := map[string]*SecretEntry{}
+	for i := range s {
+		ret[relativePath(s[i].Path, root)] = &s[i]
+	}
+	return ret
+}
+
+//relativePath is path, relative to root, which it is under
+func relativePath(path, root string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(path, root), "/")
+}
+
+// latest returns the data of the most recent version of the secret, or an empty
+// secret if there is no such thing.
+func (s *SecretEntry) latest() *Secret {
+	if s == nil {
+		return NewSecret()
+	}
+	return s.LatestVersion().Data
+}
+
+func diffKeys(left, right *Secret) []KeyDiff {
+	keys := append(left.Keys(), right.Keys()...)
+	sort.Strings(keys)
+
+	ret := []KeyDiff{}
+	for i, key := range keys {
+		if i > 0 && keys[i-1] == key {
+			continue
+		}
+
+		d := KeyDiff{Key: key, Left: left.Get(key), Right: right.Get(key)}
+		switch {
+		case !left.Has(key):
+			d.State = DiffAdded
+		case !right.Has(key):
+			d.State = DiffRemoved
+		case d.Left != d.Right:
+			d.State = DiffChanged
+		default:
+			d.State = DiffUnchanged
+		}
+		ret = append(ret, d)
+	}
+
+	return ret
+}
+
+func sameVersions(left, right []SecretVersion, deletedAsDestroyed bool) bool {
+	if len(left) != len(right) {
+		return false
+	}
+
+	for i := range left {
+		if left[i].Number != right[i].Number || stateOf(left[i], deletedAsDestroyed) != stateOf(right[i], deletedAsDestroyed) {
+			return false
+		}
+
+		for _, k := range diffKeys(dataOf(left[i]), dataOf(right[i])) {
+			if k.State != DiffUnchanged {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func stateOf(v SecretVersion, deletedAsDestroyed bool) uint {
+	if deletedAsDestroyed && v.State == SecretStateDeleted {
+		return SecretStateDestroyed
+	}
+	return v.State
+}
+
+func dataOf(v SecretVersion) *Secret {
+	if v.Data == nil {
+		return NewSecret()
+	}
+	return v.Data
+}
@@ -0,0 +1,134 @@
+package vault
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jhunt/go-ansi"
+	"github.com/starkandwayne/goutils/tree"
+)
+
+//TreeDrawer draws the same tree that Secrets.Draw does, but from secrets that
+// are handed to it one at a time, in order (as an ordered Walk hands them
+// over), so that the tree can be printed as it is found. Whether a branch is
+// the last one under its parent isn't known until whatever comes after it
+// turns up, so each branch directly under the root is drawn as soon as the
+// next one starts, and the last one when the drawer is closed.
+type TreeDrawer struct {
+	root           string
+	index          int
+	color, secrets bool
+	emit           func(line string)
+
+	started bool
+	//group is the secrets of the branch that is still being found, which all
+	// share the path component after the root
+	group       Secrets
+	groupWord   string
+	groupDirect bool
+	//pending is the last branch to have been finished, which can't be drawn
+	// until it is known whether it is the last one
+	pending *tree.Node
+}
+
+//NewTreeDrawer returns a TreeDrawer that draws the tree under root, a line at
+// a time, by handing each line (without a newline) to emit. color and secrets
+// are as for Secrets.Draw.
+func NewTreeDrawer(root string, color, secrets bool, emit func(line string)) *TreeDrawer {
+	root = strings.Trim(Canonicalize(root), "/")
+	d := &TreeDrawer{root: root, color: color, secrets: secrets, emit: emit}
+	if len(root) > 0 {
+		d.index = len(strings.Split(root, "/"))
+	}
+	return d
+}
+
+//Add draws whatever of the tree can be drawn, now that s has been found
+func (d *TreeDrawer) Add(s SecretEntry) {
+	split := strings.Split("/"+s.Path, "/")
+	if !d.started {
+		d.started = true
+		root := d.root
+		if root != strings.Trim(s.Path, "/") {
+			root = strings.TrimSuffix(root, "/") + "/"
+		}
+		if d.color {
+			root = ansi.Sprintf("@C{%s}", root)
+		}
+		d.emit(".")
+		d.emit("└── " + root)
+
+		//The root is a secret itself, so its keys come first
+		if len(split) == d.index+1 {
+			if len(s.Versions) > 0 {
+				keyFmt := ":%s"
+				if d.color {
+					keyFmt = "@Y{:%s}"
+				}
+				for _, k := range s.LatestVersion().Data.Keys() {
+					d.finish(&tree.Node{Name: ansi.Sprintf(keyFmt, k)})
+				}
+			}
+			return
+		}
+	}
+
+	word, direct := split[d.index+1], len(split) == d.index+2
+	if direct && !d.secrets {
+		return
+	}
+	if len(d.group) > 0 && (direct || d.groupDirect || word != d.groupWord) {
+		d.finish(d.group.printableTree(d.color, d.secrets, d.index+1))
+		d.group = nil
+	}
+	//s will be drawn under a branch of its own, or be part of the one being
+	// found, so whatever was finished before it isn't the last one
+	if d.pending != nil {
+		d.draw(*d.pending, "    ", false)
+		d.pending = nil
+	}
+	d.group = append(d.group, s)
+	d.groupWord, d.groupDirect = word, direct
+}
+
+//Close draws the rest of the tree
+func (d *TreeDrawer) Close() {
+	if len(d.group) > 0 {
+		d.finish(d.group.printableTree(d.color, d.secrets, d.index+1))
+		d.group = nil
+	}
+	if d.pending != nil {
+		d.draw(*d.pending, "    ", true)
+		d.pending = nil
+	}
+}
+
+//finish draws the branch before n, which isn't the last one, now that there
+// is another one after it
+func (d *TreeDrawer) finish(n *tree.Node) {
+	if n == nil {
+		return
+	}
+	if d.pending != nil {
+		d.draw(*d.pending, "    ", false)
+	}
+	d.pending = n
+}
+
+//draw is tree.Node's own drawing, a line at a time
+func (d *TreeDrawer) draw(n tree.Node, prefix string, tail bool) {
+	interim := "├── "
+	if tail {
+		interim = "└── "
+	}
+	for _, s := range strings.Split(strings.Trim(n.Name, "\n"), "\n") {
+		d.emit(fmt.Sprintf("%s%s%s", prefix, interim, s))
+		interim = "│   "
+		if tail {
+			interim = "    "
+		}
+	}
+	for i, c := range n.Sub {
+		d.draw(c, prefix+interim, i == len(n.Sub)-1)
+	}
+}
@@ -0,0 +1,94 @@
+package vault_test
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+var _ = Describe("Drawing a tree as it is found", func() {
+	secret := func(path string, keys ...string) vault.SecretEntry {
+		data := vault.NewSecret()
+		for _, k := range keys {
+			data.Set(k, "x", false)
+		}
+		return vault.SecretEntry{Path: path, Versions: []vault.SecretVersion{{Number: 1, Data: data}}}
+	}
+
+	//drawn draws secrets both ways, so that they can be compared
+	drawn := func(root string, color, leaves bool, secrets vault.Secrets) (string, string) {
+		secrets.Sort()
+		var out strings.Builder
+		d := vault.NewTreeDrawer(root, color, leaves, func(line string) {
+			out.WriteString(line + "\n")
+		})
+		for _, s := range secrets {
+			d.Add(s)
+		}
+		d.Close()
+		return out.String(), secrets.Draw(root, color, leaves)
+	}
+
+	trees := map[string]vault.Secrets{
+		"a wide and deep tree": {
+			secret("secret/tree/alpha", "k"),
+			secret("secret/tree/beta/env", "a", "b"),
+			secret("secret/tree/beta/name"),
+			secret("secret/tree/g", "k"),
+			secret("secret/tree/g/a"),
+			secret("secret/tree/g/a/m"),
+			secret("secret/tree/g/a/m/m", "z"),
+			secret("secret/tree/g/a/m/m/a"),
+			secret("secret/tree/z/y/x"),
+		},
+		"a tree with a secret at its root": {
+			secret("secret/tree", "one", "two"),
+			secret("secret/tree/child", "k"),
+			secret("secret/tree/dir/grandchild"),
+		},
+		"a tree with a single branch": {
+			secret("secret/tree/only/one/path", "k"),
+		},
+	}
+
+	for name, secrets := range trees {
+		secrets := secrets
+		It("draws "+name+" the same way as Draw does", func() {
+			for _, color := range []bool{false, true} {
+				for _, leaves := range []bool{false, true} {
+					streamed, whole := drawn("secret/tree", color, leaves, append(vault.Secrets{}, secrets...))
+					Expect(streamed).To(Equal(whole))
+				}
+			}
+		})
+	}
+
+	It("draws nothing at all for an empty tree", func() {
+		streamed, whole := drawn("secret/tree", false, true, vault.Secrets{})
+		Expect(streamed).To(Equal(""))
+		Expect(whole).To(Equal(""))
+	})
+
+	It("draws each branch as soon as the next one starts", func() {
+		var lines []string
+		d := vault.NewTreeDrawer("secret", false, true, func(line string) {
+			lines = append(lines, line)
+		})
+		d.Add(secret("secret/a/x"))
+		d.Add(secret("secret/a/y"))
+		Expect(lines).To(HaveLen(2))
+		d.Add(secret("secret/b"))
+		Expect(lines).To(Equal([]string{
+			".",
+			"└── secret/",
+			"    ├── a/",
+			"    │   ├── x",
+			"    │   └── y",
+		}))
+		d.Close()
+		Expect(lines[len(lines)-1]).To(Equal("    └── b"))
+	})
+})
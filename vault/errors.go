@@ -1,6 +1,10 @@
 package vault
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/cloudfoundry-community/vaultkv"
+)
 
 type secretNotFound struct {
 	message string
@@ -52,3 +56,45 @@ func IsKeyNotFound(err error) bool {
 	_, is := err.(keyNotFound)
 	return is
 }
+
+type casConflict struct {
+	path    string
+	version uint
+}
+
+func (e casConflict) Error() string {
+	if e.version == 0 {
+		return fmt.Sprintf("`%s' was created by someone else in the meantime", e.path)
+	}
+	return fmt.Sprintf("`%s' was changed by someone else in the meantime (it is no longer at version %d)", e.path, e.version)
+}
+
+//NewCASConflictError returns an error describing a check-and-set write to the
+// given path that was refused because the latest version of the secret was no
+// longer the version that the write was based on.
+func NewCASConflictError(path string, version uint) error {
+	return casConflict{path: path, version: version}
+}
+
+//IsCASConflict returns true if the given error was created with
+// NewCASConflictError(). False otherwise.
+func IsCASConflict(err error) bool {
+	_, is := err.(casConflict)
+	return is
+}
+
+type forbidden struct {
+	message string
+}
+
+func (e forbidden) Error() string {
+	return e.message
+}
+
+//IsForbidden returns true if the given error is Vault refusing a request that
+// the token doesn't have permission to make, whether it came from vaultkv or
+// from a request made with Curl.
+func IsForbidden(err error) bool {
+	_, is := err.(forbidden)
+	return is || vaultkv.IsForbidden(err)
+}
@@ -0,0 +1,188 @@
+package vault_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+//fakeVault is just enough of a Vault, with a KV v2 mount at secret/, to test
+// how safe talks to one. There is a KV v1 mount at v1/ as well, but only so
+// that it can be seen, as nothing can be read from or written to it
+type fakeVault struct {
+	*httptest.Server
+
+	lock sync.Mutex
+	//secrets maps the path of each secret (under secret/) to its versions
+	secrets map[string][]map[string]string
+	//requests counts each request made, by method and path
+	requests map[string]int
+	//forbidMetadata makes reading the metadata of any secret forbidden
+	forbidMetadata bool
+	//respond, if set, can answer a request in place of the fake, by returning
+	// a status code (and an error message to go with it), or 0 to leave it be
+	respond func(r *http.Request) (int, string)
+}
+
+func newFakeVault() *fakeVault {
+	f := &fakeVault{
+		secrets:  map[string][]map[string]string{},
+		requests: map[string]int{},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+//vault connects to the fake, with whatever else conf says
+func (f *fakeVault) vault(conf vault.VaultConfig) *vault.Vault {
+	conf.URL, conf.Token = f.URL, "fake-token"
+	v, err := vault.NewVault(conf)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+//set writes a new version of a secret, behind the back of whoever is testing
+func (f *fakeVault) set(path string, data map[string]string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.secrets[path] = append(f.secrets[path], data)
+}
+
+func (f *fakeVault) versions(path string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.secrets[path])
+}
+
+func (f *fakeVault) count(method, path string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests[method+" "+path]
+}
+
+func (f *fakeVault) serve(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	f.lock.Lock()
+	f.requests[r.Method+" "+path]++
+	respond := f.respond
+	f.lock.Unlock()
+
+	if respond != nil {
+		if code, msg := respond(r); code != 0 {
+			reply(w, code, map[string]interface{}{"errors": []string{msg}})
+			return
+		}
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	switch {
+	case path == "auth/token/lookup-self":
+		reply(w, 200, map[string]interface{}{"data": map[string]interface{}{"id": "fake-token"}})
+
+	case path == "sys/internal/ui/mounts":
+		reply(w, 200, map[string]interface{}{"data": map[string]interface{}{
+			"secret": map[string]interface{}{
+				"secret/": map[string]interface{}{"type": "kv", "options": map[string]string{"version": "2"}},
+				"v1/":     map[string]interface{}{"type": "kv", "options": map[string]string{"version": "1"}},
+			},
+		}})
+
+	case strings.HasPrefix(path, "secret/data/") && r.Method == "GET":
+		versions := f.secrets[strings.TrimPrefix(path, "secret/data/")]
+		if len(versions) == 0 {
+			reply(w, 404, map[string]interface{}{"errors": []string{}})
+			return
+		}
+		reply(w, 200, map[string]interface{}{"data": map[string]interface{}{
+			"data":     versions[len(versions)-1],
+			"metadata": map[string]interface{}{"version": len(versions)},
+		}})
+
+	case strings.HasPrefix(path, "secret/data/"):
+		secret := strings.TrimPrefix(path, "secret/data/")
+		var input struct {
+			Options struct {
+				CAS *int `json:"cas"`
+			} `json:"options"`
+			Data map[string]string `json:"data"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			reply(w, 400, map[string]interface{}{"errors": []string{err.Error()}})
+			return
+		}
+		if cas := input.Options.CAS; cas != nil && *cas != len(f.secrets[secret]) {
+			reply(w, 400, map[string]interface{}{"errors": []string{"check-and-set parameter did not match the current version"}})
+			return
+		}
+		f.secrets[secret] = append(f.secrets[secret], input.Data)
+		reply(w, 200, map[string]interface{}{"data": map[string]interface{}{"version": len(f.secrets[secret])}})
+
+	case strings.HasPrefix(path, "secret/metadata/") && r.URL.Query().Get("list") != "":
+		prefix := strings.TrimPrefix(path, "secret/metadata/")
+		if prefix != "" {
+			prefix += "/"
+		}
+		keys, seen := []string{}, map[string]bool{}
+		for secret := range f.secrets {
+			if !strings.HasPrefix(secret, prefix) {
+				continue
+			}
+			key := strings.TrimPrefix(secret, prefix)
+			if i := strings.Index(key, "/"); i >= 0 {
+				key = key[:i+1]
+			}
+			if !seen[key] {
+				keys, seen[key] = append(keys, key), true
+			}
+		}
+		if len(keys) == 0 {
+			reply(w, 404, map[string]interface{}{"errors": []string{}})
+			return
+		}
+		reply(w, 200, map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+
+	case strings.HasPrefix(path, "secret/metadata/"):
+		if f.forbidMetadata {
+			reply(w, 403, map[string]interface{}{"errors": []string{"permission denied"}})
+			return
+		}
+		versions := f.secrets[strings.TrimPrefix(path, "secret/metadata/")]
+		if len(versions) == 0 {
+			reply(w, 404, map[string]interface{}{"errors": []string{}})
+			return
+		}
+		meta := map[string]interface{}{}
+		for i := range versions {
+			meta[strconv.Itoa(i+1)] = map[string]interface{}{
+				"created_time":  "2020-01-01T00:00:00Z",
+				"deletion_time": "",
+				"destroyed":     false,
+			}
+		}
+		reply(w, 200, map[string]interface{}{"data": map[string]interface{}{
+			"current_version": len(versions),
+			"oldest_version":  1,
+			"max_versions":    0,
+			"created_time":    "2020-01-01T00:00:00Z",
+			"updated_time":    "2020-01-01T00:00:00Z",
+			"versions":        meta,
+		}})
+
+	default:
+		reply(w, 404, map[string]interface{}{"errors": []string{}})
+	}
+}
+
+func reply(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
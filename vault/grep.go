@@ -0,0 +1,66 @@
+package vault
+
+import (
+	"regexp"
+	"strings"
+)
+
+type GrepOpts struct {
+	//Match the pattern against the paths of secrets
+	Paths bool
+	//Match the pattern against the names of keys
+	Keys bool
+	//Match the pattern against the values of keys
+	Values bool
+	//Select the keys that do not match, instead of the ones that do
+	Invert bool
+}
+
+// GrepMatch is a single key that was selected by Grep. Matches holds the
+// index pairs of the parts of Value that matched the pattern, if values were
+// being searched.
+type GrepMatch struct {
+	Path    string
+	Key     string
+	Value   string
+	Matches [][]int
+}
+
+// Grep searches the latest version of each secret for keys whose path, name,
+// or value (as chosen by opts) match the given pattern.
+func (s Secrets) Grep(pattern *regexp.Regexp, opts GrepOpts) []GrepMatch {
+	ret := []GrepMatch{}
+	for i := range s {
+		data := s[i].latest()
+		pathMatched := opts.Paths && pattern.MatchString(s[i].Path)
+
+		for _, key := range data.Keys() {
+			m := GrepMatch{Path: s[i].Path, Key: key, Value: data.Get(key)}
+			if opts.Values {
+				m.Matches = pattern.FindAllStringIndex(m.Value, -1)
+			}
+
+			matched := pathMatched || len(m.Matches) > 0 ||
+				(opts.Keys && pattern.MatchString(key))
+			if matched != opts.Invert {
+				ret = append(ret, m)
+			}
+		}
+	}
+
+	return ret
+}
+
+// Mask returns the value of the match with everything except the parts that
+// matched the pattern replaced with asterisks.
+func (m GrepMatch) Mask() string {
+	var b strings.Builder
+	last := 0
+	for _, match := range m.Matches {
+		b.WriteString(strings.Repeat("*", len([]rune(m.Value[last:match[0]]))))
+		b.WriteString(m.Value[match[0]:match[1]])
+		last = match[1]
+	}
+	b.WriteString(strings.Repeat("*", len([]rune(m.Value[last:]))))
+	return b.String()
+}
@@ -0,0 +1,167 @@
+package vault
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cloudfoundry-community/vaultkv"
+)
+
+//HistoryMode says what moving or copying a secret does with its older
+// versions, which only KV v2 mounts have.
+type HistoryMode int
+
+const (
+	//HistoryDefault preserves history if Deep is set, and collapses it
+	// otherwise
+	HistoryDefault HistoryMode = iota
+	//HistoryCollapse only copies the latest version, whatever the mounts
+	HistoryCollapse
+	//HistoryPreserve copies every version (padding out versions that Vault
+	// has already let go of, so that the version numbers line up), which
+	// needs the destination to be in a KV v2 mount if the source is
+	HistoryPreserve
+	//HistoryRefuse only copies the latest version, like HistoryCollapse, but
+	// refuses to copy secrets that have any older versions, which would be
+	// lost
+	HistoryRefuse
+	//HistoryRefuseIntoV1 collapses history, like HistoryCollapse, unless the
+	// destination is in a KV v1 mount, which could never hold it, in which
+	// case it refuses, like HistoryRefuse. Moves default to it, since they
+	// leave nothing behind
+	HistoryRefuseIntoV1
+)
+
+//ParseHistoryMode reads a HistoryMode from its name: collapse, preserve or
+// refuse. An empty string is HistoryDefault.
+func ParseHistoryMode(s string) (HistoryMode, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return HistoryDefault, nil
+	case "collapse":
+		return HistoryCollapse, nil
+	case "preserve":
+		return HistoryPreserve, nil
+	case "refuse":
+		return HistoryRefuse, nil
+	}
+	return HistoryDefault, fmt.Errorf("Unknown history mode `%s' (expected collapse, preserve or refuse)", s)
+}
+
+//withHistory settles which HistoryMode opts mean, and sets Deep to match.
+func (opts MoveCopyOpts) withHistory() (MoveCopyOpts, error) {
+	switch opts.History {
+	case HistoryDefault:
+		opts.History = HistoryCollapse
+		if opts.Deep {
+			opts.History = HistoryPreserve
+		}
+	case HistoryPreserve:
+		opts.Deep = true
+	case HistoryCollapse, HistoryRefuse, HistoryRefuseIntoV1:
+		if opts.Deep {
+			return opts, fmt.Errorf("A deep copy preserves history, so it cannot collapse or refuse it")
+		}
+	}
+	return opts, nil
+}
+
+//checkMounts makes sure that moving or copying from src to dst can keep the
+// history of the secrets in src, if opts say that it should, and says whether
+// secrets with older versions should be refused. Secrets in KV v1 mounts have
+// no history to keep.
+func (v *Vault) checkMounts(src, dst string, opts MoveCopyOpts) (refuse bool, err error) {
+	srcVersion, err := v.MountVersion(src)
+	if err != nil || srcVersion != 2 {
+		return false, err
+	}
+	switch opts.History {
+	case HistoryRefuse:
+		return true, nil
+	case HistoryPreserve, HistoryRefuseIntoV1:
+	default:
+		return false, nil
+	}
+
+	dstVersion, err := v.MountVersion(dst)
+	if err != nil {
+		return false, err
+	}
+	if dstVersion == 2 {
+		return false, nil
+	}
+	if opts.History == HistoryRefuseIntoV1 {
+		return true, nil
+	}
+	return false, fmt.Errorf("Cannot preserve the history of `%s' in `%s', which is in a KV v1 mount; collapse it to the latest version instead", src, dst)
+}
+
+//checkHistory makes sure that moving or copying the secret at src to dst
+// won't lose any of its history, unless opts allow for that.
+func (v *Vault) checkHistory(src, dst string, opts MoveCopyOpts) error {
+	refuse, err := v.checkMounts(src, dst, opts)
+	if err != nil || !refuse {
+		return err
+	}
+
+	versions, err := v.Versions(src)
+	if err != nil {
+		return err
+	}
+	if n := olderVersions(versions); n > 0 {
+		return fmt.Errorf("Refusing to move or copy `%s' to `%s', as the %d older version(s) of it would be lost (%s)", src, dst, n, historyHint(opts))
+	}
+	return nil
+}
+
+//checkTreeHistory is checkHistory for every secret under src, all at once, so
+// that nothing is moved or copied if any of them would lose history.
+func (v *Vault) checkTreeHistory(src, dst string, opts MoveCopyOpts) error {
+	refuse, err := v.checkMounts(src, dst, opts)
+	if err != nil || !refuse {
+		return err
+	}
+
+	secrets, err := v.withoutProgress().ConstructSecrets(src, TreeOpts{FetchAllVersions: true})
+	if err != nil {
+		return err
+	}
+	var refused []string
+	for _, secret := range secrets {
+		if len(secret.Versions) == 0 {
+			continue
+		}
+		n := 0
+		for _, version := range secret.Versions[:len(secret.Versions)-1] {
+			if version.State != SecretStateDestroyed {
+				n++
+			}
+		}
+		if n > 0 {
+			refused = append(refused, fmt.Sprintf("%s (%d older version(s))", secret.Path, n))
+		}
+	}
+	if len(refused) > 0 {
+		return fmt.Errorf("Refusing to move or copy `%s' to `%s', as the history of these secrets would be lost (%s):\n  %s", src, dst, historyHint(opts), strings.Join(refused, "\n  "))
+	}
+	return nil
+}
+
+//historyHint says how to get past a refusal to lose history
+func historyHint(opts MoveCopyOpts) string {
+	if opts.History == HistoryRefuseIntoV1 {
+		return "the destination is in a KV v1 mount, which cannot keep them; give --history collapse to drop them"
+	}
+	return "give --history collapse to drop the older versions, or --history preserve to keep them"
+}
+
+//olderVersions counts the versions before the latest that still have data
+func olderVersions(versions []vaultkv.KVVersion) int {
+	n := 0
+	for i := 0; i < len(versions)-1; i++ {
+		if !versions[i].Destroyed {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,70 @@
+package vault_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+var _ = Describe("Keeping history when copying a tree", func() {
+	var fake *fakeVault
+
+	BeforeEach(func() {
+		fake = newFakeVault()
+		fake.set("app/a", map[string]string{"key": "a"})
+		fake.set("app/b", map[string]string{"key": "b"})
+	})
+	AfterEach(func() {
+		fake.Close()
+	})
+
+	copyTreeTo := func(dst string, history vault.HistoryMode) error {
+		v := fake.vault(vault.VaultConfig{})
+		return v.MoveCopyTree("secret/app", dst, v.Copy, vault.MoveCopyOpts{History: history})
+	}
+	copyTree := func(history vault.HistoryMode) error {
+		return copyTreeTo("secret/copy", history)
+	}
+
+	It("checks the history of each secret just the once", func() {
+		Expect(copyTree(vault.HistoryCollapse)).To(Succeed())
+		collapsed := fake.count("GET", "secret/metadata/app/a")
+
+		Expect(copyTree(vault.HistoryRefuse)).To(Succeed())
+		Expect(fake.versions("copy/a")).To(Equal(2))
+		Expect(fake.versions("copy/b")).To(Equal(2))
+		//Refusing only takes one more look at each secret, for the whole tree
+		Expect(fake.count("GET", "secret/metadata/app/a") - collapsed).To(Equal(collapsed + 1))
+	})
+
+	It("copies nothing if any secret would lose its history", func() {
+		fake.set("app/b", map[string]string{"key": "b2"})
+		err := copyTree(vault.HistoryRefuse)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("secret/app/b (1 older version(s))"))
+		Expect(err.Error()).To(ContainSubstring("--history collapse"))
+		Expect(fake.versions("copy/a")).To(Equal(0))
+		Expect(fake.versions("copy/b")).To(Equal(0))
+	})
+
+	Context("when only refusing to lose history in a KV v1 mount", func() {
+		BeforeEach(func() {
+			fake.set("app/b", map[string]string{"key": "b2"})
+		})
+
+		It("collapses history into another KV v2 mount", func() {
+			Expect(copyTree(vault.HistoryRefuseIntoV1)).To(Succeed())
+			Expect(fake.versions("copy/a")).To(Equal(1))
+			Expect(fake.versions("copy/b")).To(Equal(1))
+		})
+
+		It("refuses to lose history in a KV v1 mount", func() {
+			err := copyTreeTo("v1/copy", vault.HistoryRefuseIntoV1)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("secret/app/b (1 older version(s))"))
+			Expect(err.Error()).To(ContainSubstring("KV v1 mount"))
+			Expect(fake.count("PUT", "v1/copy/a") + fake.count("POST", "v1/copy/a")).To(BeZero())
+		})
+	})
+})
@@ -1,8 +1,13 @@
 package vault
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/cloudfoundry-community/vaultkv"
 )
@@ -42,3 +47,111 @@ func (v *Vault) MountExists(path string) (bool, error) {
 	}
 	return false, nil
 }
+
+//UpgradeMount converts the KV v1 mount at path to KV v2, and waits for Vault
+// to finish moving the secrets in it over. Every secret is read before the
+// upgrade and again afterwards, and if any of them were lost or changed, an
+// error says which. It returns how many secrets were checked.
+func (v *Vault) UpgradeMount(path string) (int, error) {
+	mount, err := v.Client().MountPath(path)
+	if err != nil {
+		return 0, err
+	}
+	if strings.Trim(path, "/") != strings.Trim(mount, "/") {
+		return 0, fmt.Errorf("`%s' is not a mount (it is in `%s'); only whole mounts can be upgraded", path, mount)
+	}
+	version, err := v.MountVersion(mount)
+	if err != nil {
+		return 0, err
+	}
+	if version != 1 {
+		return 0, fmt.Errorf("`%s' is already a KV v%d mount", mount, version)
+	}
+
+	before, err := v.mountContents(mount)
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"options": map[string]string{"version": "2"},
+	})
+	if err != nil {
+		return 0, err
+	}
+	res, err := v.Curl("POST", fmt.Sprintf("sys/mounts/%s/tune", mount), data)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 && res.StatusCode != 204 {
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return 0, err
+		}
+		return 0, DecodeErrorResponse(body)
+	}
+	//What kind of mount it was is cached, and it isn't that kind anymore
+	v.client = v.client.Client.NewKV()
+
+	//Vault upgrades the mount in the background, and refuses requests for it
+	// until it is done
+	var after map[string]map[string]string
+	for wait := 0; ; wait++ {
+		after, err = v.mountContents(mount)
+		if err == nil || !strings.Contains(strings.ToLower(err.Error()), "upgrad") {
+			break
+		}
+		if wait >= upgradeAttempts {
+			return 0, fmt.Errorf("Gave up waiting for Vault to finish upgrading `%s': %s", mount, err)
+		}
+		if err = v.sleep(upgradeInterval); err != nil {
+			return 0, err
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var problems []string
+	for path, was := range before {
+		is, ok := after[path]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s is missing", path))
+		} else if !reflect.DeepEqual(was, is) {
+			problems = append(problems, fmt.Sprintf("%s has changed", path))
+		}
+	}
+	for path := range after {
+		if _, ok := before[path]; !ok {
+			problems = append(problems, fmt.Sprintf("%s was not there before", path))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return 0, fmt.Errorf("`%s' was upgraded to KV v2, but not all of its secrets came through it intact:\n  %s", mount, strings.Join(problems, "\n  "))
+	}
+	return len(before), nil
+}
+
+const (
+	upgradeAttempts = 240
+	upgradeInterval = 500 * time.Millisecond
+)
+
+//mountContents reads every secret in a mount, keyed by path
+func (v *Vault) mountContents(mount string) (map[string]map[string]string, error) {
+	secrets, err := v.ConstructSecrets(mount, TreeOpts{FetchKeys: true})
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]map[string]string{}
+	for _, secret := range secrets {
+		data := secret.LatestVersion().Data
+		ret[secret.Path] = map[string]string{}
+		for _, key := range data.Keys() {
+			ret[secret.Path][key] = data.Get(key)
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,100 @@
+package vault
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+//numWorkers is how many requests to make at once
+func (v *Vault) numWorkers() int {
+	n := v.workers
+	if n < 1 {
+		n = runtime.NumCPU()
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+//hasPath returns true if path is one of paths
+func hasPath(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+//ForEachPath calls fn with each of paths, on as many workers at once as
+// walking a tree would use. Once fn fails for any path, or the Vault is
+// stopped, no more paths are handed out, but those already under way are
+// let finish, unless the Vault ran out of time, which cuts off the requests
+// in flight; those paths fail, and say that they might be half-done. If not
+// every path was done, an InterruptedError says which
+// were, which failed (and why) and which weren't started, in the same order
+// as paths, however the workers happened to get through them.
+func (v *Vault) ForEachPath(paths []string, fn func(string) error) error {
+	v.progress.WillWrite(len(paths))
+
+	var (
+		lock   sync.Mutex
+		next   int
+		failed bool
+		done   = make([]bool, len(paths))
+		errs   = make([]error, len(paths))
+	)
+	take := func() (int, bool) {
+		lock.Lock()
+		defer lock.Unlock()
+		if failed || next >= len(paths) || v.Stopped() != nil {
+			return 0, false
+		}
+		next++
+		return next - 1, true
+	}
+
+	workers := v.numWorkers()
+	if workers > len(paths) {
+		workers = len(paths)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i, ok := take(); ok; i, ok = take() {
+				err := fn(paths[i])
+				if err != nil && v.Stopped() == ErrTimedOut {
+					err = fmt.Errorf("%s (cut off partway, so it may be half-done)", err)
+				}
+				lock.Lock()
+				done[i], errs[i] = err == nil, err
+				failed = failed || err != nil
+				lock.Unlock()
+				if err == nil {
+					v.progress.AddWritten(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if next == len(paths) && !failed {
+		return nil
+	}
+	ret := &InterruptedError{Err: v.Stopped()}
+	for i, path := range paths {
+		switch {
+		case done[i]:
+			ret.Done = append(ret.Done, path)
+		case errs[i] != nil:
+			ret.Failed = append(ret.Failed, PathError{Path: path, Err: errs[i]})
+		default:
+			ret.NotDone = append(ret.NotDone, path)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,117 @@
+package vault
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//Progress counts how far along a long-running operation is: how many secrets
+// the tree walker has discovered and fetched, and how many have been written
+// (or moved, copied or deleted). It is safe to read while the operation is
+// going, from another goroutine. A nil Progress counts nothing.
+type Progress struct {
+	discovered int64
+	fetched    int64
+	written    int64
+	toWrite    int64
+
+	started      time.Time
+	writeStarted atomic.Value
+}
+
+//ProgressCounts is a snapshot of a Progress.
+type ProgressCounts struct {
+	Discovered int64
+	Fetched    int64
+	Written    int64
+	//ToWrite is how many secrets are going to be written in all, once that is
+	// known, and 0 until then
+	ToWrite int64
+	//Rate is how many secrets are being written a second, if any are being
+	// written yet, or fetched a second otherwise
+	Rate float64
+	//Left is roughly how long there is to go, if it can be worked out
+	Left time.Duration
+}
+
+//NewProgress starts counting
+func NewProgress() *Progress {
+	return &Progress{started: time.Now()}
+}
+
+//AddDiscovered counts n more secrets found by walking a tree
+func (p *Progress) AddDiscovered(n int) {
+	if p != nil {
+		atomic.AddInt64(&p.discovered, int64(n))
+	}
+}
+
+//AddFetched counts n more secrets read from the Vault
+func (p *Progress) AddFetched(n int) {
+	if p != nil {
+		atomic.AddInt64(&p.fetched, int64(n))
+	}
+}
+
+//AddWritten counts n more secrets written to the Vault
+func (p *Progress) AddWritten(n int) {
+	if p != nil {
+		atomic.AddInt64(&p.written, int64(n))
+	}
+}
+
+//WillWrite says that n secrets are about to be written, so that it can be
+// worked out how long that will take
+func (p *Progress) WillWrite(n int) {
+	if p == nil {
+		return
+	}
+	if atomic.AddInt64(&p.toWrite, int64(n)) == int64(n) {
+		p.writeStarted.Store(time.Now())
+	}
+}
+
+//Counts returns how far along things are
+func (p *Progress) Counts() ProgressCounts {
+	if p == nil {
+		return ProgressCounts{}
+	}
+	c := ProgressCounts{
+		Discovered: atomic.LoadInt64(&p.discovered),
+		Fetched:    atomic.LoadInt64(&p.fetched),
+		Written:    atomic.LoadInt64(&p.written),
+		ToWrite:    atomic.LoadInt64(&p.toWrite),
+	}
+
+	switch {
+	case c.ToWrite > 0:
+		since, _ := p.writeStarted.Load().(time.Time)
+		c.Rate, c.Left = rateOf(c.Written, c.ToWrite, since)
+	case c.Written > 0:
+		//Writing, with no telling how much there is to go
+		c.Rate, _ = rateOf(c.Written, 0, p.started)
+	default:
+		c.Rate, c.Left = rateOf(c.Fetched, c.Discovered, p.started)
+	}
+	return c
+}
+
+func rateOf(done, total int64, since time.Time) (float64, time.Duration) {
+	elapsed := time.Since(since).Seconds()
+	if since.IsZero() || elapsed <= 0 || done == 0 {
+		return 0, 0
+	}
+	rate := float64(done) / elapsed
+	if total <= done {
+		return rate, 0
+	}
+	return rate, time.Duration(float64(total-done) / rate * float64(time.Second))
+}
+
+//withoutProgress returns a Vault that counts nothing, for walking a tree as
+// just one part of working on a single path
+func (v *Vault) withoutProgress() *Vault {
+	quiet := *v
+	quiet.progress = nil
+	return &quiet
+}
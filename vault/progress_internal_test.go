@@ -0,0 +1,81 @@
+package vault
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Counting progress", func() {
+	ago := func(d time.Duration) time.Time {
+		return time.Now().Add(-d)
+	}
+
+	Describe("rateOf", func() {
+		It("works out the rate, and how long the rest will take at it", func() {
+			rate, left := rateOf(50, 100, ago(10*time.Second))
+			Expect(rate).To(BeNumerically("~", 5, 0.01))
+			Expect(left).To(BeNumerically("~", 10*time.Second, 50*time.Millisecond))
+		})
+
+		It("has nothing left once everything is done", func() {
+			rate, left := rateOf(100, 100, ago(10*time.Second))
+			Expect(rate).To(BeNumerically("~", 10, 0.01))
+			Expect(left).To(BeZero())
+		})
+
+		It("can't tell anything until something has been done", func() {
+			rate, left := rateOf(0, 100, ago(10*time.Second))
+			Expect(rate).To(BeZero())
+			Expect(left).To(BeZero())
+		})
+
+		It("can't tell anything without knowing when things started", func() {
+			rate, left := rateOf(50, 100, time.Time{})
+			Expect(rate).To(BeZero())
+			Expect(left).To(BeZero())
+		})
+	})
+
+	Describe("Counts", func() {
+		It("counts nothing for a nil Progress", func() {
+			var p *Progress
+			p.AddDiscovered(1)
+			p.WillWrite(1)
+			Expect(p.Counts()).To(Equal(ProgressCounts{}))
+		})
+
+		It("goes by how quickly secrets are fetched while walking", func() {
+			p := &Progress{started: ago(10 * time.Second)}
+			p.AddDiscovered(100)
+			p.AddFetched(20)
+			c := p.Counts()
+			Expect(c.Discovered).To(Equal(int64(100)))
+			Expect(c.Fetched).To(Equal(int64(20)))
+			Expect(c.Rate).To(BeNumerically("~", 2, 0.01))
+			Expect(c.Left).To(BeNumerically("~", 40*time.Second, 200*time.Millisecond))
+		})
+
+		It("goes by how quickly secrets are written once there is a known number to write", func() {
+			p := &Progress{started: ago(time.Hour)}
+			p.AddDiscovered(100)
+			p.AddFetched(100)
+			p.WillWrite(40)
+			p.writeStarted.Store(ago(10 * time.Second))
+			p.AddWritten(10)
+			c := p.Counts()
+			Expect(c.ToWrite).To(Equal(int64(40)))
+			Expect(c.Rate).To(BeNumerically("~", 1, 0.01))
+			Expect(c.Left).To(BeNumerically("~", 30*time.Second, 200*time.Millisecond))
+		})
+
+		It("has no estimate while writing an unknown number of secrets", func() {
+			p := &Progress{started: ago(10 * time.Second)}
+			p.AddWritten(30)
+			c := p.Counts()
+			Expect(c.Rate).To(BeNumerically("~", 3, 0.01))
+			Expect(c.Left).To(BeZero())
+		})
+	})
+})
@@ -302,7 +302,7 @@ func writeKnownHosts(knownHostsFile, hostname string, key ssh.PublicKey) error {
 
 	fileInfo, err := f.Stat()
 	if err != nil {
-		return fmt.Errorf("Could no retrieve info for file `%s'")
+		return fmt.Errorf("Could not retrieve info for file `%s'", knownHostsFile)
 	}
 
 	if fileInfo.Size() != 0 {
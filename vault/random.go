@@ -3,28 +3,334 @@ package vault
 import (
 	"bytes"
 	"crypto/rand"
+	"fmt"
+	"math"
 	"math/big"
 	"regexp"
+	"sort"
+	"strings"
 )
 
 var (
 	chars = "!\"#$%&'()*+,-./0123456789:;<=>?@ABCDEFGHIJKLMNOPQRSTUVWXYZ[\\]^_`abcdefghijklmnopqrstuvwxyz{|}~"
+
+	//ambiguousChars are the characters that are easily mistaken for one
+	// another when read, or written down
+	ambiguousChars = "0Oo1lI|"
 )
 
-func random(n int, policy string) (string, error) {
-	re := regexp.MustCompile("[^" + policy + "]")
-	keep := re.ReplaceAllString(chars, "")
+//PasswordPolicy describes the passwords that can be generated.
+type PasswordPolicy struct {
+	//Chars is a regular expression character class (without the surrounding
+	// brackets) of the characters that may be used, like a-zA-Z0-9
+	Chars string
+
+	//MinLower, MinUpper, MinDigits and MinSymbols are the fewest lowercase
+	// letters, uppercase letters, digits and other characters that each
+	// password must contain
+	MinLower   int
+	MinUpper   int
+	MinDigits  int
+	MinSymbols int
+
+	//NoAmbiguous leaves out characters that look alike, like 0 and O, or l
+	// and 1
+	NoAmbiguous bool
+
+	//NotFirst is a character class of the characters that passwords must not
+	// start with
+	NotFirst string
+}
+
+var passwordPresets = map[string]PasswordPolicy{
+	"alphanumeric": {
+		Chars: "a-zA-Z0-9",
+	},
+	"strong": {
+		Chars:      "!-~",
+		MinLower:   1,
+		MinUpper:   1,
+		MinDigits:  1,
+		MinSymbols: 1,
+	},
+	"mysql-safe": {
+		Chars:      "a-zA-Z0-9!#%*+=?^_~-",
+		MinLower:   1,
+		MinUpper:   1,
+		MinDigits:  1,
+		MinSymbols: 1,
+	},
+	"url-safe": {
+		Chars:     "a-zA-Z0-9._~-",
+		MinLower:  1,
+		MinUpper:  1,
+		MinDigits: 1,
+	},
+	"human": {
+		Chars:       "a-zA-Z0-9",
+		MinLower:    1,
+		MinUpper:    1,
+		MinDigits:   1,
+		NoAmbiguous: true,
+		NotFirst:    "0-9",
+	},
+}
+
+//PasswordPreset returns the named preset password policy.  See
+// PasswordPresets for the list of names.
+func PasswordPreset(name string) (PasswordPolicy, error) {
+	p, ok := passwordPresets[name]
+	if !ok {
+		return PasswordPolicy{}, fmt.Errorf("unrecognized password policy preset `%s' (try one of %s)", name, strings.Join(PasswordPresets(), ", "))
+	}
+	return p, nil
+}
+
+//PasswordPresets returns the names of the preset password policies, in order.
+func PasswordPresets() []string {
+	names := make([]string, 0, len(passwordPresets))
+	for name := range passwordPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//Override returns a copy of the policy with the character class, minimums
+// and first character rule replaced by any that are set in o.  Look-alike
+// characters are left out if either policy says so.
+func (p PasswordPolicy) Override(o PasswordPolicy) PasswordPolicy {
+	if o.Chars != "" {
+		p.Chars = o.Chars
+	}
+	if o.MinLower > 0 {
+		p.MinLower = o.MinLower
+	}
+	if o.MinUpper > 0 {
+		p.MinUpper = o.MinUpper
+	}
+	if o.MinDigits > 0 {
+		p.MinDigits = o.MinDigits
+	}
+	if o.MinSymbols > 0 {
+		p.MinSymbols = o.MinSymbols
+	}
+	if o.NotFirst != "" {
+		p.NotFirst = o.NotFirst
+	}
+	p.NoAmbiguous = p.NoAmbiguous || o.NoAmbiguous
+	return p
+}
+
+//charset returns the characters in chars that match the given character
+// class.
+func charset(class string) (string, error) {
+	re, err := regexp.Compile("[^" + class + "]")
+	if err != nil {
+		return "", fmt.Errorf("invalid character class `%s': %s", class, err)
+	}
+	return re.ReplaceAllString(chars, ""), nil
+}
 
-	var buffer bytes.Buffer
+//pick returns a random character from set
+func pick(set string) (byte, error) {
+	index, err := rand.Int(rand.Reader, big.NewInt(int64(len(set))))
+	if err != nil {
+		return 0, err
+	}
+	return set[index.Int64()], nil
+}
+
+//Generate returns a random password of length n that satisfies the policy.
+// The characters needed to meet the minimums are chosen first, and the rest
+// are filled in from all of the allowed characters, before the whole thing is
+// shuffled.
+func (p PasswordPolicy) Generate(n int) (string, error) {
+	keep, err := charset(p.Chars)
+	if err != nil {
+		return "", err
+	}
+	if p.NoAmbiguous {
+		keep = strings.Map(func(r rune) rune {
+			if strings.ContainsRune(ambiguousChars, r) {
+				return -1
+			}
+			return r
+		}, keep)
+	}
+	if keep == "" {
+		return "", fmt.Errorf("password policy `%s' does not allow any characters", p.Chars)
+	}
 
-	for i := 0; i < n; i++ {
-		index, err := rand.Int(rand.Reader, big.NewInt(int64(len(keep))))
+	first := keep
+	if p.NotFirst != "" {
+		forbidden, err := charset(p.NotFirst)
 		if err != nil {
 			return "", err
 		}
-		indexInt := index.Int64()
-		buffer.WriteString(string(keep[indexInt]))
+		first = strings.Map(func(r rune) rune {
+			if strings.ContainsRune(forbidden, r) {
+				return -1
+			}
+			return r
+		}, keep)
+		if first == "" && n > 0 {
+			return "", fmt.Errorf("password policy does not allow any characters to start a password with")
+		}
+	}
+
+	classes := []struct {
+		name string
+		min  int
+		in   func(byte) bool
+	}{
+		{"lowercase letters", p.MinLower, func(c byte) bool { return c >= 'a' && c <= 'z' }},
+		{"uppercase letters", p.MinUpper, func(c byte) bool { return c >= 'A' && c <= 'Z' }},
+		{"digits", p.MinDigits, func(c byte) bool { return c >= '0' && c <= '9' }},
+		{"symbols", p.MinSymbols, func(c byte) bool {
+			return !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9')
+		}},
+	}
+
+	sets := make([]string, len(classes))
+	required := 0
+	for i, class := range classes {
+		if class.min <= 0 {
+			continue
+		}
+		var set bytes.Buffer
+		for j := 0; j < len(keep); j++ {
+			if class.in(keep[j]) {
+				set.WriteByte(keep[j])
+			}
+		}
+		if set.Len() == 0 {
+			return "", fmt.Errorf("password policy requires %d %s, but does not allow any", class.min, class.name)
+		}
+		sets[i] = set.String()
+		required += class.min
+	}
+	if required > n {
+		return "", fmt.Errorf("password policy requires at least %d characters, but only %d were asked for", required, n)
 	}
 
-	return buffer.String(), nil
+	//Very short passwords can end up made entirely of characters that are
+	// not allowed to go first, in which case we just try again.
+	for attempt := 0; attempt < 100; attempt++ {
+		var buffer bytes.Buffer
+		for i, class := range classes {
+			for j := 0; j < class.min; j++ {
+				c, err := pick(sets[i])
+				if err != nil {
+					return "", err
+				}
+				buffer.WriteByte(c)
+			}
+		}
+		for buffer.Len() < n {
+			c, err := pick(keep)
+			if err != nil {
+				return "", err
+			}
+			buffer.WriteByte(c)
+		}
+
+		//Shuffle (Fisher-Yates), so the required characters end up anywhere
+		b := buffer.Bytes()
+		for i := len(b) - 1; i > 0; i-- {
+			j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+			if err != nil {
+				return "", err
+			}
+			b[i], b[j.Int64()] = b[j.Int64()], b[i]
+		}
+		if n == 0 || strings.IndexByte(first, b[0]) >= 0 {
+			return string(b), nil
+		}
+
+		//If the password starts with something it must not, swap in one of
+		// the allowed characters from later on.
+		swappable := []int{}
+		for i := 1; i < len(b); i++ {
+			if strings.IndexByte(first, b[i]) >= 0 {
+				swappable = append(swappable, i)
+			}
+		}
+		if len(swappable) > 0 {
+			k, err := rand.Int(rand.Reader, big.NewInt(int64(len(swappable))))
+			if err != nil {
+				return "", err
+			}
+			i := swappable[k.Int64()]
+			b[0], b[i] = b[i], b[0]
+			return string(b), nil
+		}
+	}
+
+	return "", fmt.Errorf("password policy cannot be satisfied by a %d-character password that does not start with [%s]", n, p.NotFirst)
+}
+
+//PassphrasePolicy describes the passphrases that can be generated, diceware
+// style, from the EFF large wordlist.
+type PassphrasePolicy struct {
+	//Words is how many words to use
+	Words int
+
+	//Separator goes between the words
+	Separator string
+
+	//Capitalize upper-cases the first letter of each word
+	Capitalize bool
+
+	//Digit adds a random digit to the end of one of the words, chosen at
+	// random, for systems that insist on one
+	Digit bool
+}
+
+//Generate returns a random passphrase that follows the policy.
+func (p PassphrasePolicy) Generate() (string, error) {
+	if p.Words < 1 {
+		return "", fmt.Errorf("passphrases need at least one word")
+	}
+
+	words := make([]string, p.Words)
+	for i := range words {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(effWords))))
+		if err != nil {
+			return "", err
+		}
+		words[i] = effWords[n.Int64()]
+		if p.Capitalize {
+			words[i] = strings.ToUpper(words[i][:1]) + words[i][1:]
+		}
+	}
+
+	if p.Digit {
+		i, err := rand.Int(rand.Reader, big.NewInt(int64(len(words))))
+		if err != nil {
+			return "", err
+		}
+		d, err := pick("0123456789")
+		if err != nil {
+			return "", err
+		}
+		words[i.Int64()] += string(d)
+	}
+
+	return strings.Join(words, p.Separator), nil
+}
+
+//Entropy returns the number of bits of entropy in the passphrases that the
+// policy generates, assuming that an attacker knows the policy and the
+// wordlist.
+func (p PassphrasePolicy) Entropy() float64 {
+	bits := float64(p.Words) * math.Log2(float64(len(effWords)))
+	if p.Digit && p.Words > 0 {
+		bits += math.Log2(10) + math.Log2(float64(p.Words))
+	}
+	return bits
+}
+
+func random(n int, policy string) (string, error) {
+	return PasswordPolicy{Chars: policy}.Generate(n)
 }
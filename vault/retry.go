@@ -0,0 +1,123 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/vaultkv"
+)
+
+//rateLimiter spaces requests out evenly, so that no more than a given number
+// of them are sent each second, no matter how many goroutines are sending them.
+type rateLimiter struct {
+	lock     sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond int) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Second / time.Duration(perSecond)}
+}
+
+//Wait blocks until the caller is allowed to send its request, or until ctx is
+// done, in which case it says why. A nil rateLimiter never blocks.
+func (r *rateLimiter) Wait(ctx context.Context) error {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	wait := r.next.Sub(now)
+	r.next = r.next.Add(r.interval)
+	r.lock.Unlock()
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//limitedTransport makes every request to the Vault wait its turn with the
+// rate limiter first, for as long as the context of the request allows.
+type limitedTransport struct {
+	limiter *rateLimiter
+	base    http.RoundTripper
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+//IsRetryable returns true if err is the sort of error that might go away if
+// the request is tried again: Vault being rate-limited, having an internal
+// error, or being in the middle of failing over, or the connection to it
+// failing.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if vaultkv.IsTransport(err) || vaultkv.IsInternalServer(err) || vaultkv.IsAnyStandbyErr(err) {
+		return true
+	}
+	//vaultkv doesn't have an error type for 429s, so go by what Vault says
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "rate limit") || strings.Contains(msg, "too many requests")
+}
+
+const (
+	retryAttempts = 5
+	retryBackoff  = 250 * time.Millisecond
+	retryMaxWait  = 8 * time.Second
+)
+
+//RetryOnFailure calls fn, and calls it again if it fails with an error that
+// IsRetryable, waiting exponentially longer (with jitter, so that a lot of
+// workers don't all come back at once) each time, up to a fixed number of
+// attempts. If retries are turned off, fn is only called once. If the Vault is
+// stopped while waiting to try again, the error fn failed with is returned.
+func (v *Vault) RetryOnFailure(fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if !IsRetryable(err) || v.noRetry {
+			return err
+		}
+		if attempt >= retryAttempts {
+			return fmt.Errorf("%s (gave up after %d attempts)", err, attempt)
+		}
+		wait := retryWait(attempt)
+		if v.sleep(wait/2+time.Duration(mathrand.Int63n(int64(wait/2)))) != nil {
+			return err
+		}
+	}
+}
+
+//retryWait is the most that RetryOnFailure waits for after the given attempt
+// fails: twice as long as after the attempt before, up to retryMaxWait
+func retryWait(attempt int) time.Duration {
+	wait := retryBackoff
+	for i := 1; i < attempt && wait < retryMaxWait; i++ {
+		wait *= 2
+	}
+	if wait > retryMaxWait {
+		wait = retryMaxWait
+	}
+	return wait
+}
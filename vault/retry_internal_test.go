@@ -0,0 +1,79 @@
+package vault
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Backing off between retries", func() {
+	It("waits twice as long after each attempt", func() {
+		Expect(retryWait(1)).To(Equal(retryBackoff))
+		Expect(retryWait(2)).To(Equal(2 * retryBackoff))
+		Expect(retryWait(3)).To(Equal(4 * retryBackoff))
+	})
+
+	It("never waits longer than the cap", func() {
+		Expect(retryWait(6)).To(Equal(retryMaxWait))
+		Expect(retryWait(100)).To(Equal(retryMaxWait))
+	})
+})
+
+var _ = Describe("Rate limiting", func() {
+	It("doesn't limit anything without a rate", func() {
+		Expect(newRateLimiter(0)).To(BeNil())
+		start := time.Now()
+		for i := 0; i < 100; i++ {
+			Expect(newRateLimiter(0).Wait(context.Background())).To(Succeed())
+		}
+		Expect(time.Since(start)).To(BeNumerically("<", 10*time.Millisecond))
+	})
+
+	It("spaces requests out evenly, however many goroutines send them", func() {
+		limiter := newRateLimiter(50)
+		var lock sync.Mutex
+		var sent []time.Time
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 3; j++ {
+					Expect(limiter.Wait(context.Background())).To(Succeed())
+					lock.Lock()
+					sent = append(sent, time.Now())
+					lock.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		Expect(sent).To(HaveLen(12))
+		first, last := sent[0], sent[0]
+		for _, t := range sent {
+			if t.Before(first) {
+				first = t
+			}
+			if t.After(last) {
+				last = t
+			}
+		}
+		//12 requests at 50 a second are 11 gaps of 20ms apart
+		Expect(last.Sub(first)).To(BeNumerically(">=", 200*time.Millisecond))
+	})
+
+	It("stops waiting for a turn once the context is done", func() {
+		limiter := newRateLimiter(1)
+		Expect(limiter.Wait(context.Background())).To(Succeed())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		Expect(limiter.Wait(ctx)).To(Equal(context.DeadlineExceeded))
+		Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+	})
+})
@@ -0,0 +1,148 @@
+package vault_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+var _ = Describe("Retrying requests", func() {
+	var fake *fakeVault
+
+	BeforeEach(func() {
+		fake = newFakeVault()
+		fake.set("app/db", map[string]string{"password": "sekrit"})
+	})
+	AfterEach(func() {
+		fake.Close()
+	})
+
+	//failWith makes reading secret/app/db fail with the given status code (and
+	// error message) the first n times
+	failWith := func(n, code int, msg string) {
+		fake.respond = func(r *http.Request) (int, string) {
+			if r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/app/db") && n > 0 {
+				n--
+				return code, msg
+			}
+			return 0, ""
+		}
+	}
+
+	Describe("IsRetryable", func() {
+		read := func() error {
+			_, err := fake.vault(vault.VaultConfig{}).Read("secret/app/db")
+			return err
+		}
+
+		It("is true for Vault being rate-limited", func() {
+			failWith(1, 429, "request path \"secret/data/app/db\": rate limit quota exceeded")
+			Expect(vault.IsRetryable(read())).To(BeTrue())
+		})
+
+		It("is true for internal errors", func() {
+			failWith(1, 500, "internal error")
+			Expect(vault.IsRetryable(read())).To(BeTrue())
+		})
+
+		It("is true for the connection to Vault failing", func() {
+			fake.Close()
+			Expect(vault.IsRetryable(read())).To(BeTrue())
+		})
+
+		It("is false for errors that won't go away", func() {
+			Expect(vault.IsRetryable(nil)).To(BeFalse())
+			failWith(1, 403, "permission denied")
+			Expect(vault.IsRetryable(read())).To(BeFalse())
+			failWith(1, 400, "bad request")
+			Expect(vault.IsRetryable(read())).To(BeFalse())
+			_, err := fake.vault(vault.VaultConfig{}).Read("secret/app/nope")
+			Expect(vault.IsNotFound(err)).To(BeTrue())
+			Expect(vault.IsRetryable(err)).To(BeFalse())
+		})
+	})
+
+	Describe("RetryOnFailure", func() {
+		var calls int
+		readWith := func(v *vault.Vault) error {
+			return v.RetryOnFailure(func() error {
+				calls++
+				_, err := v.Read("secret/app/db")
+				return err
+			})
+		}
+		BeforeEach(func() {
+			calls = 0
+		})
+
+		It("tries again until the request goes through", func() {
+			failWith(2, 500, "internal error")
+			Expect(readWith(fake.vault(vault.VaultConfig{}))).To(Succeed())
+			Expect(calls).To(Equal(3))
+		})
+
+		It("gives up after a handful of attempts", func() {
+			failWith(100, 429, "rate limit quota exceeded")
+			err := readWith(fake.vault(vault.VaultConfig{}))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("gave up after 5 attempts"))
+			Expect(calls).To(Equal(5))
+		})
+
+		It("doesn't retry errors that won't go away", func() {
+			failWith(1, 403, "permission denied")
+			Expect(readWith(fake.vault(vault.VaultConfig{}))).NotTo(Succeed())
+			Expect(calls).To(Equal(1))
+		})
+
+		It("doesn't retry at all when retries are turned off", func() {
+			failWith(1, 500, "internal error")
+			err := readWith(fake.vault(vault.VaultConfig{NoRetry: true}))
+			Expect(vault.IsRetryable(err)).To(BeTrue())
+			Expect(calls).To(Equal(1))
+		})
+
+		It("stops waiting to try again when the Vault is stopped", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			v := fake.vault(vault.VaultConfig{Context: ctx})
+			failWith(100, 500, "internal error")
+
+			start := time.Now()
+			err := v.RetryOnFailure(func() error {
+				calls++
+				cancel()
+				_, err := v.Read("secret/app/db")
+				return err
+			})
+			Expect(vault.IsRetryable(err)).To(BeTrue())
+			Expect(err.Error()).NotTo(ContainSubstring("gave up"))
+			Expect(calls).To(Equal(1))
+			Expect(time.Since(start)).To(BeNumerically("<", 100*time.Millisecond))
+		})
+	})
+
+	Describe("walking a tree", func() {
+		It("retries the secrets that fail for a while", func() {
+			failWith(2, 429, "rate limit quota exceeded")
+			secrets, err := fake.vault(vault.VaultConfig{}).ConstructSecrets("secret/app", vault.TreeOpts{FetchKeys: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(secrets).To(HaveLen(1))
+			Expect(secrets[0].LatestVersion().Data.Get("password")).To(Equal("sekrit"))
+		})
+
+		It("says which path it was reading when it gives up", func() {
+			failWith(100, 500, "internal error")
+			_, err := fake.vault(vault.VaultConfig{NoRetry: true}).ConstructSecrets("secret/app", vault.TreeOpts{FetchKeys: true})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(fmt.Sprintf("`%s'", "secret/app/db")))
+		})
+	})
+})
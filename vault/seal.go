@@ -31,6 +31,9 @@ func (v *Vault) Unseal(keys []string) error {
 	}
 
 	for _, key := range keys {
+		if err := v.Stopped(); err != nil {
+			return err
+		}
 		state, err := v.client.Client.Unseal(key)
 		if err != nil {
 			return err
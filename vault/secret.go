@@ -19,10 +19,21 @@ import (
 // want, including passwords, RSAKey keys, usernames, etc.
 type Secret struct {
 	data map[string]string
+	cas  casInfo
+}
+
+//casInfo records where a secret was read from, and which version of it was
+// read, so that writing it back to the same path can use check-and-set.
+type casInfo struct {
+	path    string
+	version uint
+	//missing is set when there was no secret to read, in which case version
+	// is not known until it is needed (see resolveCAS)
+	missing bool
 }
 
 func NewSecret() *Secret {
-	return &Secret{make(map[string]string)}
+	return &Secret{data: make(map[string]string)}
 }
 
 func (s Secret) MarshalJSON() ([]byte, error) {
@@ -152,7 +163,13 @@ func (s *Secret) DHParam(length int, skipIfExists bool) error {
 
 // Password creates and stores a new randomized password.
 func (s *Secret) Password(key string, length int, policy string, skipIfExists bool) error {
-	r, err := random(length, policy)
+	return s.PasswordWithPolicy(key, length, PasswordPolicy{Chars: policy}, skipIfExists)
+}
+
+// PasswordWithPolicy generates a random password of the given length that
+// satisfies the given policy, and stores it under key.
+func (s *Secret) PasswordWithPolicy(key string, length int, policy PasswordPolicy, skipIfExists bool) error {
+	r, err := policy.Generate(length)
 	if err != nil {
 		return err
 	}
@@ -163,6 +180,16 @@ func (s *Secret) Password(key string, length int, policy string, skipIfExists bo
 	return nil
 }
 
+// Passphrase generates a random passphrase that follows the given policy, and
+// stores it under key.
+func (s *Secret) Passphrase(key string, policy PassphrasePolicy, skipIfExists bool) error {
+	r, err := policy.Generate()
+	if err != nil {
+		return err
+	}
+	return s.Set(key, r, skipIfExists)
+}
+
 func crypt_md5(pass string) (string, error) {
 	c := md5_crypt.New()
 	salt, err := random(16, "a-zA-Z")
@@ -2,10 +2,11 @@ package vault
 
 import (
 	"fmt"
-	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/cloudfoundry-community/vaultkv"
 	"github.com/jhunt/go-ansi"
@@ -23,6 +24,8 @@ type workQueue struct {
 	c      *sync.Cond
 	awake  int
 	closed bool
+	//progress counts each secret that is pushed as discovered
+	progress *Progress
 }
 
 type workQueueNode struct {
@@ -30,10 +33,11 @@ type workQueueNode struct {
 	payload *workOrder
 }
 
-func newWorkQueue(numWorkers int) *workQueue {
+func newWorkQueue(numWorkers int, progress *Progress) *workQueue {
 	return &workQueue{
-		c:     sync.NewCond(&sync.Mutex{}),
-		awake: numWorkers,
+		c:        sync.NewCond(&sync.Mutex{}),
+		awake:    numWorkers,
+		progress: progress,
 	}
 }
 
@@ -81,6 +85,9 @@ func (w *workQueue) Push(o *workOrder) {
 	}
 
 	toAdd := &workQueueNode{payload: o}
+	if o.insertInto.isSecret() {
+		w.progress.AddDiscovered(1)
+	}
 
 	if w.tail != nil {
 		w.tail.next = toAdd
@@ -117,6 +124,10 @@ type secretTree struct {
 	Version      uint
 	Deleted      bool
 	Destroyed    bool
+	//Only filled in when the walk is asked to FetchMetadata
+	Metadata     *SecretMetadata
+	CreatedTime  string
+	DeletionTime string
 }
 
 func (v *Vault) ConstructSecrets(path string, opts TreeOpts) (s Secrets, err error) {
@@ -226,9 +237,14 @@ func (t secretTree) convertToSecrets() Secrets {
 				}
 
 				thisVersion := SecretVersion{
-					Data:   NewSecret(),
-					Number: version.Version,
-					State:  SecretStateAlive,
+					Data:         NewSecret(),
+					Number:       version.Version,
+					State:        SecretStateAlive,
+					CreatedTime:  version.CreatedTime,
+					DeletionTime: version.DeletionTime,
+				}
+				if version.Metadata != nil {
+					thisEntry.Metadata = version.Metadata
 				}
 
 				if version.Destroyed {
@@ -277,6 +293,9 @@ func (s *Secrets) Append(e SecretEntry) {
 type SecretEntry struct {
 	Path     string
 	Versions []SecretVersion
+	//Metadata is only set if FetchMetadata was given, and the secret is in a
+	// KV v2 mount
+	Metadata *SecretMetadata
 }
 
 const (
@@ -285,10 +304,27 @@ const (
 	SecretStateDestroyed
 )
 
+//LatestVersion returns the most recent version of the secret.  A secret with no
+// versions at all gets an empty one, so that callers don't have to check.
+func (s SecretEntry) LatestVersion() SecretVersion {
+	if len(s.Versions) == 0 {
+		return SecretVersion{Data: NewSecret()}
+	}
+	latest := s.Versions[len(s.Versions)-1]
+	if latest.Data == nil {
+		latest.Data = NewSecret()
+	}
+	return latest
+}
+
 type SecretVersion struct {
 	Data   *Secret
 	Number uint
 	State  uint
+	//CreatedTime is only set if the secret is in a KV v2 mount, and
+	// DeletionTime is only set if FetchMetadata was given, as well
+	CreatedTime  string
+	DeletionTime string
 }
 
 type TreeOpts struct {
@@ -308,15 +344,33 @@ type TreeOpts struct {
 	GetDeletedVersions bool
 	//Only perform gets. If the target is not a secret, then an error is returned
 	GetOnly bool
+	//Also fetch the KV v2 metadata of each secret, along with when each of
+	// its versions was created and deleted
+	FetchMetadata bool
+	//Ordered makes Walk hand secrets over in the order that ConstructSecrets
+	// would sort them in. Ignored by everything else
+	Ordered bool
 }
 
 func (v *Vault) constructTree(path string, opts TreeOpts) (*secretTree, error) {
-	numWorkers := runtime.NumCPU()
-	if numWorkers < 1 {
-		numWorkers = 1
+	ret, err := v.walkTree(path, opts, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	queue := newWorkQueue(numWorkers)
+	//Make the output deterministic
+	ret.sort()
+
+	return ret, nil
+}
+
+//walkTree sends workers out over the tree under path. If emit is nil, the
+// whole tree is built up and returned. Otherwise, each secret is passed to
+// emit as soon as it is complete, and nothing is kept.
+func (v *Vault) walkTree(path string, opts TreeOpts, emit func(SecretEntry) error) (*secretTree, error) {
+	numWorkers := v.numWorkers()
+
+	queue := newWorkQueue(numWorkers, v.progress)
 	errChan := make(chan error)
 
 	path = Canonicalize(path)
@@ -335,6 +389,14 @@ func (v *Vault) constructTree(path string, opts TreeOpts) (*secretTree, error) {
 	if err != nil {
 		return nil, err
 	}
+	//This waits until getWorkType has given the root its final name (with a
+	// trailing slash, if it is a directory), which the workers finish it under
+	var order *walkOrder
+	if emit != nil && opts.Ordered {
+		order = newWalkOrder(emit)
+		emit = order.add
+		order.pending(ret.Name)
+	}
 	queue.Push(&workOrder{
 		insertInto: ret,
 		operation:  operation,
@@ -346,6 +408,8 @@ func (v *Vault) constructTree(path string, opts TreeOpts) (*secretTree, error) {
 			orders: queue,
 			errors: errChan,
 			opts:   opts,
+			emit:   emit,
+			order:  order,
 		}
 		go worker.work()
 	}
@@ -362,10 +426,7 @@ func (v *Vault) constructTree(path string, opts TreeOpts) (*secretTree, error) {
 		return nil, err
 	}
 
-	//Make the output deterministic
-	ret.sort()
-
-	return ret, err
+	return ret, nil
 }
 
 //Only use this for the base for the initial node of the tree. You can infer
@@ -422,6 +483,10 @@ func (t *secretTree) populateNodeType(v *Vault) error {
 	return nil
 }
 
+func (t *secretTree) isSecret() bool {
+	return t.Type == treeTypeSecret || t.Type == treeTypeDirAndSecret
+}
+
 func (t *secretTree) getWorkType(opts TreeOpts) uint16 {
 	ret := opTypeNone
 
@@ -683,6 +748,12 @@ type treeWorker struct {
 	orders *workQueue
 	errors chan error
 	opts   TreeOpts
+	//emit, if set, is given each secret as soon as it is complete, instead of
+	// it being kept in the tree
+	emit func(SecretEntry) error
+	//order, if set, is told which paths are still to be worked, so that it
+	// can hold secrets back until everything that sorts before them is done
+	order *walkOrder
 }
 
 func (w *treeWorker) work() {
@@ -697,6 +768,11 @@ func (w *treeWorker) work() {
 
 	order, done := w.orders.Pop()
 	for !done {
+		if err = w.vault.Stopped(); err != nil {
+			handleError()
+			return
+		}
+
 		var answer []secretTree
 		var toAppend []secretTree
 		for _, op := range []struct {
@@ -711,8 +787,13 @@ func (w *treeWorker) work() {
 			if order.operation&op.code == opTypeNone {
 				continue
 			}
-			toAppend, err = op.fn(*order.insertInto)
+			err = w.vault.RetryOnFailure(func() error {
+				var err error
+				toAppend, err = op.fn(*order.insertInto)
+				return err
+			})
 			if err != nil {
+				err = walkError(order.insertInto.Name, err)
 				break
 			}
 			//toAppend can be nil if a get was issued on a destroyed node
@@ -728,19 +809,50 @@ func (w *treeWorker) work() {
 		}
 
 		for i := range answer {
-			answer[i].MountVersion, err = w.vault.MountVersion(answer[i].Name)
+			err = w.vault.RetryOnFailure(func() error {
+				var err error
+				answer[i].MountVersion, err = w.vault.MountVersion(answer[i].Name)
+				return err
+			})
 			if err != nil {
+				err = walkError(answer[i].Name, err)
 				handleError()
 				return
 			}
 		}
 
-		order.insertInto.Branches = append(order.insertInto.Branches, answer...)
-		for i, node := range order.insertInto.Branches {
-			w.orders.Push(&workOrder{
-				insertInto: &(order.insertInto.Branches[i]),
-				operation:  node.getWorkType(w.opts),
-			})
+		if order.insertInto.isSecret() {
+			w.vault.progress.AddFetched(1)
+		}
+
+		if w.emit != nil {
+			answer, err = w.emitSecret(order, answer)
+			if err != nil {
+				handleError()
+				return
+			}
+			//Nothing holds on to these nodes once they have been worked, so
+			// the tree never takes up more memory than the work still to do
+			for i := range answer {
+				operation := answer[i].getWorkType(w.opts)
+				w.order.pending(answer[i].Name)
+				w.orders.Push(&workOrder{
+					insertInto: &answer[i],
+					operation:  operation,
+				})
+			}
+			if err = w.order.finished(order.insertInto.Name); err != nil {
+				handleError()
+				return
+			}
+		} else {
+			order.insertInto.Branches = append(order.insertInto.Branches, answer...)
+			for i, node := range order.insertInto.Branches {
+				w.orders.Push(&workOrder{
+					insertInto: &(order.insertInto.Branches[i]),
+					operation:  node.getWorkType(w.opts),
+				})
+			}
 		}
 
 		order, done = w.orders.Pop()
@@ -749,6 +861,54 @@ func (w *treeWorker) work() {
 	w.errors <- nil
 }
 
+//walkError says which path a worker was working on when it failed, unless
+// the error is one that callers look out for.
+func walkError(path string, err error) error {
+	if IsNotFound(err) {
+		return err
+	}
+	return fmt.Errorf("Could not read `%s': %s", path, err)
+}
+
+//emitSecret fetches the keys of each version of a secret that was just
+// found, straight away, and passes the finished secret to w.emit. It returns
+// the rest of the nodes that were found (from listing a path that is both a
+// secret and a directory), which still need to be worked.
+func (w *treeWorker) emitSecret(order *workOrder, found []secretTree) ([]secretTree, error) {
+	if order.operation&opTypeVersions == opTypeNone {
+		return found, nil
+	}
+
+	secret := secretTree{Name: order.insertInto.Name, Type: treeTypeSecret}
+	var rest []secretTree
+	for _, node := range found {
+		if node.Type != treeTypeVersion {
+			rest = append(rest, node)
+			continue
+		}
+		if node.getWorkType(w.opts)&opTypeGet != opTypeNone {
+			var keys []secretTree
+			err := w.vault.RetryOnFailure(func() error {
+				var err error
+				keys, err = w.workGet(node)
+				return err
+			})
+			if err != nil {
+				return nil, walkError(node.Name, err)
+			}
+			node.Branches = keys
+		}
+		secret.Branches = append(secret.Branches, node)
+	}
+
+	for _, s := range secret.convertToSecrets() {
+		if err := w.emit(s); err != nil {
+			return nil, err
+		}
+	}
+	return rest, nil
+}
+
 func (w *treeWorker) workList(t secretTree) ([]secretTree, error) {
 	path := strings.TrimSuffix(t.Name, "/")
 	list, err := w.vault.List(path)
@@ -890,12 +1050,24 @@ func (w *treeWorker) workVersions(t secretTree) ([]secretTree, error) {
 		}, nil
 	}
 
-	versions, err := w.vault.Versions(path)
+	//The metadata has the versions in it too, so if it is wanted, it is all
+	// that needs fetching
+	var versions []vaultkv.KVVersion
+	var meta *SecretMetadata
+	var err error
+	if w.opts.FetchMetadata {
+		meta, err = w.vault.Metadata(path)
+		if err == nil {
+			versions = meta.versions()
+		}
+	} else {
+		versions, err = w.vault.Versions(path)
+	}
 	//For v2 backends, this is the first non-list Vault access.
 	// If we're unable to get a path that we could list because of permissions,
 	// don't explode.
 	if err != nil {
-		if t.MountVersion == 2 && vaultkv.IsForbidden(err) {
+		if IsForbidden(err) {
 			return nil, nil
 		}
 		return nil, err
@@ -903,13 +1075,23 @@ func (w *treeWorker) workVersions(t secretTree) ([]secretTree, error) {
 
 	ret := []secretTree{}
 	for i := range versions {
-		ret = append(ret, secretTree{
+		node := secretTree{
 			Name:      t.Name,
 			Type:      treeTypeVersion,
 			Version:   versions[i].Version,
 			Deleted:   versions[i].Deleted,
 			Destroyed: versions[i].Destroyed,
-		})
+		}
+		//The metadata belongs to the secret, but the secret's node only gets
+		// its versions as branches, so each of them carries it along
+		if meta != nil {
+			node.Metadata = meta
+			times := meta.Versions[strconv.FormatUint(uint64(node.Version), 10)]
+			node.CreatedTime, node.DeletionTime = times.CreatedTime, times.DeletionTime
+		} else if !versions[i].CreatedAt.IsZero() {
+			node.CreatedTime = versions[i].CreatedAt.Format(time.RFC3339Nano)
+		}
+		ret = append(ret, node)
 	}
 
 	if !w.opts.FetchAllVersions {
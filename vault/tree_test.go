@@ -0,0 +1,69 @@
+package vault_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+var _ = Describe("Walking a tree with metadata", func() {
+	var fake *fakeVault
+
+	BeforeEach(func() {
+		fake = newFakeVault()
+		fake.set("app/db", map[string]string{"password": "one"})
+		fake.set("app/db", map[string]string{"password": "two"})
+		fake.set("app/web", map[string]string{"token": "abc"})
+	})
+	AfterEach(func() {
+		fake.Close()
+	})
+
+	It("reads the metadata of each secret only once", func() {
+		secrets, err := fake.vault(vault.VaultConfig{}).ConstructSecrets("secret/app", vault.TreeOpts{
+			FetchKeys:        true,
+			FetchAllVersions: true,
+			FetchMetadata:    true,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(secrets).To(HaveLen(2))
+		Expect(secrets[0].Path).To(Equal("secret/app/db"))
+		Expect(secrets[0].Versions).To(HaveLen(2))
+		Expect(secrets[0].Versions[0].Number).To(BeEquivalentTo(1))
+		Expect(secrets[0].Versions[1].Data.Get("password")).To(Equal("two"))
+		Expect(secrets[1].Versions).To(HaveLen(1))
+
+		Expect(fake.count("GET", "secret/metadata/app/db")).To(Equal(1))
+		Expect(fake.count("GET", "secret/metadata/app/web")).To(Equal(1))
+	})
+
+	It("skips secrets whose metadata the token can't read", func() {
+		fake.forbidMetadata = true
+		secrets, err := fake.vault(vault.VaultConfig{}).ConstructSecrets("secret/app", vault.TreeOpts{
+			FetchKeys:     true,
+			FetchMetadata: true,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(secrets).To(BeEmpty())
+	})
+})
+
+var _ = Describe("The latest version of a secret", func() {
+	It("is the last one", func() {
+		s := vault.NewSecret()
+		Expect(s.Set("key", "two", false)).To(Succeed())
+		entry := vault.SecretEntry{Versions: []vault.SecretVersion{
+			{Number: 1, Data: vault.NewSecret()},
+			{Number: 2, Data: s},
+		}}
+		Expect(entry.LatestVersion().Number).To(BeEquivalentTo(2))
+		Expect(entry.LatestVersion().Data.Get("key")).To(Equal("two"))
+	})
+
+	It("is empty for a secret with no versions", func() {
+		latest := vault.SecretEntry{Path: "secret/gone"}.LatestVersion()
+		Expect(latest.Number).To(BeEquivalentTo(0))
+		Expect(latest.Data.Keys()).To(BeEmpty())
+	})
+})
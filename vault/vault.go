@@ -2,25 +2,35 @@ package vault
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	mathrand "math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cloudfoundry-community/vaultkv"
 	"github.com/jhunt/go-ansi"
 )
 
 type Vault struct {
-	client *vaultkv.KV
-	debug  bool
+	client   *vaultkv.KV
+	debug    bool
+	noRetry  bool
+	workers  int
+	ctx      context.Context
+	progress *Progress
 }
 
 type VaultConfig struct {
@@ -29,6 +39,27 @@ type VaultConfig struct {
 	Namespace  string
 	CACerts    *x509.CertPool
 	SkipVerify bool
+	//NoRetry makes writes that hit a check-and-set conflict, and requests made
+	// while walking a tree that fail for reasons that might go away, fail
+	// instead of being retried
+	NoRetry bool
+	//Workers is how many requests are made at once while walking a tree. If
+	// it isn't set, there is a worker for each CPU
+	Workers int
+	//RequestsPerSecond, if set, limits how many requests are sent to the Vault
+	// each second, however many workers are sending them
+	RequestsPerSecond int
+	//Context, if set, stops long-running operations (like walking, copying
+	// or deleting a tree) from making any more requests once it is done
+	Context context.Context
+	//RequestContext, if set, is given to every request made to the Vault, so
+	// that even requests in flight are cut off once it is done. It should only
+	// run out, and never be cancelled, so that the requests in flight when
+	// Context is cancelled get to finish
+	RequestContext context.Context
+	//Progress, if set, is kept up to date by long-running operations, so that
+	// how far along they are can be shown
+	Progress *Progress
 }
 
 // NewVault creates a new Vault object.  If an empty token is specified,
@@ -65,20 +96,34 @@ func NewVault(conf VaultConfig) (*Vault, error) {
 		return nil, fmt.Errorf("Error setting up proxy: %s", err)
 	}
 
+	var transport http.RoundTripper = &http.Transport{
+		Proxy: proxyRouter.Proxy,
+		TLSClientConfig: &tls.Config{
+			RootCAs:            conf.CACerts,
+			InsecureSkipVerify: conf.SkipVerify,
+		},
+		MaxIdleConnsPerHost: 100,
+	}
+	if conf.Context == nil {
+		conf.Context = context.Background()
+	}
+
+	if limiter := newRateLimiter(conf.RequestsPerSecond); limiter != nil {
+		transport = &limitedTransport{limiter: limiter, base: transport}
+	}
+	//This goes around the rate limiter, so that waiting for a turn is cut off
+	// too
+	if conf.RequestContext != nil {
+		transport = &contextTransport{ctx: conf.RequestContext, base: transport}
+	}
+
 	return &Vault{
 		client: (&vaultkv.Client{
 			VaultURL:  vaultURL,
 			AuthToken: conf.Token,
 			Namespace: conf.Namespace,
 			Client: &http.Client{
-				Transport: &http.Transport{
-					Proxy: proxyRouter.Proxy,
-					TLSClientConfig: &tls.Config{
-						RootCAs:            conf.CACerts,
-						InsecureSkipVerify: conf.SkipVerify,
-					},
-					MaxIdleConnsPerHost: 100,
-				},
+				Transport: transport,
 			},
 			Trace: func() (ret io.Writer) {
 				if shouldDebug() {
@@ -87,7 +132,11 @@ func NewVault(conf VaultConfig) (*Vault, error) {
 				return ret
 			}(),
 		}).NewKV(),
-		debug: shouldDebug(),
+		debug:    shouldDebug(),
+		noRetry:  conf.NoRetry,
+		workers:  conf.Workers,
+		ctx:      conf.Context,
+		progress: conf.Progress,
 	}, nil
 }
 
@@ -110,6 +159,152 @@ func (v *Vault) Versions(path string) ([]vaultkv.KVVersion, error) {
 	return ret, err
 }
 
+//splitMount splits a path into the mount it lives in and the path of the secret
+// within that mount.
+func (v *Vault) splitMount(path string) (mount, subpath string, err error) {
+	mount, err = v.client.MountPath(path)
+	if err != nil {
+		return "", "", err
+	}
+	subpath = strings.Trim(strings.TrimPrefix(strings.Trim(path, "/"), strings.Trim(mount, "/")), "/")
+	return strings.Trim(mount, "/"), subpath, nil
+}
+
+// SecretMetadata is the KV v2 metadata of a secret.  Only MaxVersions,
+// CASRequired, DeleteVersionAfter and CustomMetadata can be changed.
+type SecretMetadata struct {
+	MaxVersions        uint              `json:"max_versions"`
+	CASRequired        bool              `json:"cas_required"`
+	DeleteVersionAfter string            `json:"delete_version_after"`
+	CustomMetadata     map[string]string `json:"custom_metadata"`
+
+	CurrentVersion uint   `json:"current_version,omitempty"`
+	OldestVersion  uint   `json:"oldest_version,omitempty"`
+	CreatedTime    string `json:"created_time,omitempty"`
+	UpdatedTime    string `json:"updated_time,omitempty"`
+
+	//Versions maps each version number still known to Vault to when that
+	// version was created, and deleted
+	Versions map[string]VersionMetadata `json:"versions,omitempty"`
+}
+
+// VersionMetadata is the part of the KV v2 metadata of a secret that is kept
+// for each of its versions.
+type VersionMetadata struct {
+	CreatedTime  string `json:"created_time"`
+	DeletionTime string `json:"deletion_time"`
+	Destroyed    bool   `json:"destroyed"`
+}
+
+//versions lists the versions of the secret, oldest first, the same as Versions
+// would have
+func (m SecretMetadata) versions() []vaultkv.KVVersion {
+	ret := []vaultkv.KVVersion{}
+	for number, times := range m.Versions {
+		n, err := strconv.ParseUint(number, 10, 64)
+		if err != nil {
+			continue
+		}
+		version := vaultkv.KVVersion{Version: uint(n), Destroyed: times.Destroyed}
+		version.CreatedAt, _ = time.Parse(time.RFC3339Nano, times.CreatedTime)
+		_, err = time.Parse(time.RFC3339Nano, times.DeletionTime)
+		version.Deleted = err == nil
+		ret = append(ret, version)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Version < ret[j].Version })
+	return ret
+}
+
+// IsDefault returns true if none of the changeable metadata has been set.
+func (m SecretMetadata) IsDefault() bool {
+	return m.MaxVersions == 0 && !m.CASRequired && len(m.CustomMetadata) == 0 &&
+		(m.DeleteVersionAfter == "" || m.DeleteVersionAfter == "0s")
+}
+
+// Metadata retrieves the KV v2 metadata of the secret at the given path.
+func (v *Vault) Metadata(path string) (*SecretMetadata, error) {
+	path, _, _ = ParsePath(Canonicalize(path))
+	mount, subpath, err := v.metadataPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := v.Curl("GET", fmt.Sprintf("%s/metadata/%s", mount, subpath), nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == 404 {
+		return nil, NewSecretNotFoundError(path)
+	}
+	if res.StatusCode == 403 {
+		return nil, forbidden{message: DecodeErrorResponse(body).Error()}
+	}
+	if res.StatusCode != 200 {
+		return nil, DecodeErrorResponse(body)
+	}
+
+	var raw struct {
+		Data SecretMetadata `json:"data"`
+	}
+	if err = json.Unmarshal(body, &raw); err != nil {
+		return nil, fmt.Errorf("Could not parse metadata for `%s': %s", path, err)
+	}
+	return &raw.Data, nil
+}
+
+// SetMetadata replaces the changeable KV v2 metadata of the secret at the
+// given path with the values in m.
+func (v *Vault) SetMetadata(path string, m SecretMetadata) error {
+	path, _, _ = ParsePath(Canonicalize(path))
+	mount, subpath, err := v.metadataPath(path)
+	if err != nil {
+		return err
+	}
+
+	if m.CustomMetadata == nil {
+		m.CustomMetadata = map[string]string{}
+	}
+	data, err := json.Marshal(struct {
+		MaxVersions        uint              `json:"max_versions"`
+		CASRequired        bool              `json:"cas_required"`
+		DeleteVersionAfter string            `json:"delete_version_after,omitempty"`
+		CustomMetadata     map[string]string `json:"custom_metadata"`
+	}{m.MaxVersions, m.CASRequired, m.DeleteVersionAfter, m.CustomMetadata})
+	if err != nil {
+		return err
+	}
+
+	res, err := v.Curl("POST", fmt.Sprintf("%s/metadata/%s", mount, subpath), data)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 && res.StatusCode != 204 {
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		return DecodeErrorResponse(body)
+	}
+	return nil
+}
+
+func (v *Vault) metadataPath(path string) (mount, subpath string, err error) {
+	mountVersion, err := v.MountVersion(path)
+	if err != nil {
+		return "", "", err
+	}
+	if mountVersion != 2 {
+		return "", "", fmt.Errorf("`%s' is not in a KV v2 mount, so it has no metadata", path)
+	}
+	return v.splitMount(path)
+}
+
 func shouldDebug() bool {
 	d := strings.ToLower(os.Getenv("DEBUG"))
 	return d != "" && d != "false" && d != "0" && d != "no" && d != "off"
@@ -140,7 +335,15 @@ func (v *Vault) Read(path string) (secret *Secret, err error) {
 	secret = NewSecret()
 
 	raw := map[string]interface{}{}
-	_, err = v.client.Get(path, &raw, &vaultkv.KVGetOpts{Version: uint(version)})
+	meta, err := v.client.Get(path, &raw, &vaultkv.KVGetOpts{Version: uint(version)})
+	if version == 0 && key == "" && (err == nil || vaultkv.IsNotFound(err)) {
+		//Remember what we read, so that writing this back can be done with
+		// check-and-set
+		casErr := v.recordCAS(secret, path, meta.Version, err == nil)
+		if casErr != nil {
+			return nil, casErr
+		}
+	}
 	if err != nil {
 		if vaultkv.IsNotFound(err) {
 			err = NewSecretNotFoundError(path)
@@ -188,7 +391,9 @@ func (v *Vault) List(path string) (paths []string, err error) {
 	return paths, err
 }
 
-// Write takes a Secret and writes it to the Vault at the specified path.
+// Write takes a Secret and writes it to the Vault at the specified path.  If
+// the Secret was read from the same path in a KV v2 mount, the write is done
+// with check-and-set, against the version that was read.
 func (v *Vault) Write(path string, s *Secret) error {
 	path = Canonicalize(path)
 	if strings.Contains(path, ":") {
@@ -199,6 +404,15 @@ func (v *Vault) Write(path string, s *Secret) error {
 		return v.deleteIfPresent(path, DeleteOpts{})
 	}
 
+	if s.cas.path != "" && s.cas.path == path {
+		if err := v.resolveCAS(s); err != nil {
+			return err
+		}
+		if s.cas.path != "" {
+			return v.CheckAndSet(path, s, s.cas.version)
+		}
+	}
+
 	_, err := v.client.Set(path, s.data, nil)
 	if vaultkv.IsNotFound(err) {
 		err = NewSecretNotFoundError(path)
@@ -207,6 +421,157 @@ func (v *Vault) Write(path string, s *Secret) error {
 	return err
 }
 
+//recordCAS notes the version of the secret at path that s was read from.  If
+// the secret was not found, that is left for resolveCAS to look up, if s is
+// ever written back.  Nothing is recorded for KV v1 mounts, which do not
+// support check-and-set.
+func (v *Vault) recordCAS(s *Secret, path string, version uint, found bool) error {
+	mountVersion, err := v.MountVersion(path)
+	if err != nil || mountVersion != 2 {
+		return err
+	}
+
+	s.cas = casInfo{path: path, version: version, missing: !found}
+	return nil
+}
+
+//resolveCAS works out the version to check-and-set s against, when s was read
+// from a secret that was not there: the version of its deleted or destroyed
+// latest version, or 0 if it has never existed.  That takes reading the
+// metadata of the secret, which not every token that can read the secret
+// itself can do; if the token can't, nothing is recorded, and s is written
+// back without check-and-set.
+func (v *Vault) resolveCAS(s *Secret) error {
+	if !s.cas.missing {
+		return nil
+	}
+
+	versions, err := v.client.Versions(s.cas.path)
+	switch {
+	case vaultkv.IsForbidden(err):
+		s.cas = casInfo{}
+		return nil
+	case err != nil && !vaultkv.IsNotFound(err):
+		return err
+	}
+
+	s.cas.missing, s.cas.version = false, 0
+	if len(versions) > 0 {
+		s.cas.version = versions[len(versions)-1].Version
+	}
+	return nil
+}
+
+// ReadForUpdate reads the latest version of the secret at the given path, and
+// returns it along with the number of that version, for passing to CheckAndSet
+// later.  If the secret does not exist, or its latest version is deleted or
+// destroyed, an empty Secret is returned instead.  On KV v1 mounts, the
+// version is always 0, as it is when the secret is missing and the token can't
+// read its metadata.
+func (v *Vault) ReadForUpdate(path string) (*Secret, uint, error) {
+	s, err := v.Read(path)
+	if err != nil && !IsSecretNotFound(err) {
+		return nil, 0, err
+	}
+	if err = v.resolveCAS(s); err != nil {
+		return nil, 0, err
+	}
+	return s, s.cas.version, nil
+}
+
+// CheckAndSet takes a Secret and writes it to the Vault at the specified path,
+// but only if the latest version of the secret there is still the given
+// version.  A version of 0 means that the secret must not exist yet.  If the
+// secret has changed, an error satisfying IsCASConflict is returned.  KV v1
+// mounts have no notion of versions, so this is the same as Write for them.
+func (v *Vault) CheckAndSet(path string, s *Secret, version uint) error {
+	path = Canonicalize(path)
+	if strings.Contains(path, ":") {
+		return fmt.Errorf("cannot write to paths in /path:key notation")
+	}
+
+	mountVersion, err := v.MountVersion(path)
+	if err != nil {
+		return err
+	}
+	if mountVersion != 2 {
+		_, err = v.client.Set(path, s.data, nil)
+		if vaultkv.IsNotFound(err) {
+			err = NewSecretNotFoundError(path)
+		}
+		return err
+	}
+
+	mount, subpath, err := v.splitMount(path)
+	if err != nil {
+		return err
+	}
+
+	meta, err := v.client.Client.V2Set(mount, subpath, s.data, vaultkv.V2SetOpts{}.WithCAS(version))
+	if vaultkv.IsBadRequest(err) && strings.Contains(err.Error(), "check-and-set") {
+		err = NewCASConflictError(path, version)
+	}
+	if vaultkv.IsNotFound(err) {
+		err = NewSecretNotFoundError(path)
+	}
+	if err == nil {
+		s.cas = casInfo{path: path, version: meta.Version}
+	}
+
+	return err
+}
+
+// SkipWrite can be returned by the function passed to Update to leave the
+// secret as it is, without it being treated as an error.
+var SkipWrite = errors.New("skip this write")
+
+// Update reads the secret at the given path (or starts from an empty secret,
+// if there isn't one), hands it to fn to be changed, and then writes it back
+// using check-and-set.  If someone else changes the secret in the meantime,
+// the whole thing is retried from the top, unless retries are turned off, in
+// which case the conflict error is returned.
+func (v *Vault) Update(path string, fn func(*Secret) error) error {
+	return v.RetryOnConflict(func() error {
+		s, _, err := v.ReadForUpdate(path)
+		if err != nil {
+			return err
+		}
+
+		if err = fn(s); err != nil {
+			if err == SkipWrite {
+				return nil
+			}
+			return err
+		}
+		return v.Write(path, s)
+	})
+}
+
+const casAttempts = 5
+
+// RetryOnConflict calls fn, and calls it again if it fails because of a
+// check-and-set conflict, up to a fixed number of attempts.  If retries are
+// turned off, fn is only called once.  fn is expected to re-read anything
+// that it writes.  If the Vault is stopped while waiting to try again, the
+// conflict is returned.
+func (v *Vault) RetryOnConflict(fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if !IsCASConflict(err) {
+			return err
+		}
+		if v.noRetry {
+			return fmt.Errorf("%s, and --no-retry was given", err)
+		}
+		if attempt >= casAttempts {
+			return fmt.Errorf("%s, even after %d attempts", err, attempt)
+		}
+		if v.sleep(time.Duration(attempt*(50+mathrand.Intn(50)))*time.Millisecond) != nil {
+			return err
+		}
+	}
+}
+
 //errIfFolder returns an error with your provided message if the given path is a folder.
 // Can also throw an error if contacting the backend failed, in which case that error
 // is returned.
@@ -316,8 +681,9 @@ func (v *Vault) verifySecretExists(path string) error {
 	return err
 }
 
-//DeleteTree recursively deletes the leaf nodes beneath the given root until
-//the root has no children, and then deletes that.
+//DeleteTree recursively deletes the leaf nodes beneath the given root, and
+//the root itself, several at once. If the Vault is stopped or any of them fail
+//partway through, an InterruptedError says which paths were deleted.
 func (v *Vault) DeleteTree(root string, opts DeleteOpts) error {
 	root = Canonicalize(root)
 
@@ -325,23 +691,20 @@ func (v *Vault) DeleteTree(root string, opts DeleteOpts) error {
 	if err != nil {
 		return err
 	}
-	for _, path := range secrets.Paths() {
-		err = v.deleteEntireSecret(path, opts.Destroy, opts.All)
-		if err != nil {
-			return err
-		}
-	}
+	paths := secrets.Paths()
 
 	mount, err := v.Client().MountPath(root)
 	if err != nil {
 		return err
 	}
 
-	if strings.Trim(root, "/") != strings.Trim(mount, "/") {
-		err = v.deleteEntireSecret(root, opts.Destroy, opts.All)
+	if strings.Trim(root, "/") != strings.Trim(mount, "/") && !hasPath(paths, root) {
+		paths = append(paths, root)
 	}
 
-	return err
+	return v.ForEachPath(paths, func(path string) error {
+		return v.deleteEntireSecret(path, opts.Destroy, opts.All)
+	})
 }
 
 type DeleteOpts struct {
@@ -530,6 +893,37 @@ func (v *Vault) Undelete(path string) error {
 	return v.Client().Undelete(secret, []uint{uint(version)})
 }
 
+//UndeleteTree undeletes each secret beneath the given root (and the root
+// itself) whose latest version is deleted, several at once. If all is set,
+// every deleted version of each secret is undeleted instead. Destroyed versions
+// are left alone. If the Vault is stopped or any of them fail partway through,
+// an InterruptedError says which paths were undeleted.
+func (v *Vault) UndeleteTree(root string, all bool) error {
+	root = Canonicalize(root)
+
+	secrets, err := v.ConstructSecrets(root, TreeOpts{AllowDeletedSecrets: true, FetchAllVersions: all})
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	deleted := map[string][]uint{}
+	for _, secret := range secrets {
+		for _, version := range secret.Versions {
+			if version.State == SecretStateDeleted {
+				deleted[secret.Path] = append(deleted[secret.Path], version.Number)
+			}
+		}
+		if len(deleted[secret.Path]) > 0 {
+			paths = append(paths, secret.Path)
+		}
+	}
+
+	return v.ForEachPath(paths, func(path string) error {
+		return v.client.Undelete(path, deleted[path])
+	})
+}
+
 //deleteIfPresent first checks to see if there is a Secret at the given path,
 // and if so, it deletes it. Otherwise, no error is thrown
 func (v *Vault) deleteIfPresent(path string, opts DeleteOpts) error {
@@ -573,6 +967,15 @@ type MoveCopyOpts struct {
 	// It also puts in dummy destroyed keys to dest to match destroyed keys from src
 	//Makes no sense without Deep
 	DeletedVersions bool
+	//History says what to do with the older versions of each secret. The
+	// mount version of each side is checked first, so that history is never
+	// dropped or mangled without being asked for
+	History HistoryMode
+
+	//historyChecked is set by MoveCopyTree, which checks the history of the
+	// whole tree before moving or copying any of it, so that each path isn't
+	// checked all over again
+	historyChecked bool
 }
 
 // Copy copies secrets from one path to another.
@@ -584,10 +987,13 @@ func (v *Vault) Copy(oldpath, newpath string, opts MoveCopyOpts) error {
 	oldpath = Canonicalize(oldpath)
 	newpath = Canonicalize(newpath)
 
+	opts, err := opts.withHistory()
+	if err != nil {
+		return err
+	}
 	if opts.DeletedVersions && !opts.Deep {
 		panic("Gave DeletedVersions and not Deep")
 	}
-	var err error
 	reqState := verifyStateAlive
 	if opts.DeletedVersions {
 		reqState = verifyStateAliveOrDeleted
@@ -656,7 +1062,12 @@ func (v *Vault) Copy(oldpath, newpath string, opts MoveCopyOpts) error {
 		if dstKey != "" {
 			return fmt.Errorf("Cannot move full secret `%s` into specific key `%s`", oldpath, newpath)
 		}
-		t, err := v.ConstructSecrets(srcPath, TreeOpts{
+		if srcVersion == 0 && !opts.historyChecked {
+			if err := v.checkHistory(srcPath, dstPath, opts); err != nil {
+				return err
+			}
+		}
+		t, err := v.withoutProgress().ConstructSecrets(srcPath, TreeOpts{
 			FetchKeys:           true,
 			GetOnly:             true,
 			FetchAllVersions:    opts.Deep || srcVersion != 0,
@@ -701,11 +1112,23 @@ func (v *Vault) Copy(oldpath, newpath string, opts MoveCopyOpts) error {
 
 //MoveCopyTree will recursively copy all nodes from the root to the new location.
 // This function will get confused about 'secret:key' syntax, so don't let those
-// get routed here - they don't make sense for a recursion anyway.
+// get routed here - they don't make sense for a recursion anyway. Several
+// secrets are moved or copied at once; if the Vault is stopped or any of them
+// fail partway through, an InterruptedError says which of the paths under
+// oldRoot were moved or copied.
 func (v *Vault) MoveCopyTree(oldRoot, newRoot string, f func(string, string, MoveCopyOpts) error, opts MoveCopyOpts) error {
 	oldRoot = Canonicalize(oldRoot)
 	newRoot = Canonicalize(newRoot)
 
+	opts, err := opts.withHistory()
+	if err != nil {
+		return err
+	}
+	if err = v.checkTreeHistory(oldRoot, newRoot, opts); err != nil {
+		return err
+	}
+	opts.historyChecked = true
+
 	tree, err := v.ConstructSecrets(oldRoot, TreeOpts{FetchKeys: false, AllowDeletedSecrets: opts.Deep, SkipVersionInfo: true})
 	if err != nil {
 		return err
@@ -737,18 +1160,14 @@ func (v *Vault) MoveCopyTree(oldRoot, newRoot string, f func(string, string, Mov
 			return nil
 		}
 	}
-	for _, path := range tree.Paths() {
-		newPath := strings.Replace(path, oldRoot, newRoot, 1)
-		err = f(path, newPath, opts)
-		if err != nil {
-			return err
-		}
+	paths := tree.Paths()
+	if _, err := v.Read(oldRoot); !hasPath(paths, oldRoot) && !IsNotFound(err) { // run through a copy unless we successfully got a 404 from this node
+		paths = append(paths, oldRoot)
 	}
 
-	if _, err := v.Read(oldRoot); !IsNotFound(err) { // run through a copy unless we successfully got a 404 from this node
-		return f(oldRoot, newRoot, opts)
-	}
-	return nil
+	return v.ForEachPath(paths, func(path string) error {
+		return f(path, strings.Replace(path, oldRoot, newRoot, 1), opts)
+	})
 }
 
 // Move moves secrets from one path to another.
@@ -758,7 +1177,12 @@ func (v *Vault) Move(oldpath, newpath string, opts MoveCopyOpts) error {
 	oldpath = Canonicalize(oldpath)
 	newpath = Canonicalize(newpath)
 
-	err := v.canSemanticallyDelete(oldpath)
+	opts, err := opts.withHistory()
+	if err != nil {
+		return err
+	}
+
+	err = v.canSemanticallyDelete(oldpath)
 	if err != nil {
 		return fmt.Errorf("Can't move `%s': %s. Did you mean cp?", oldpath, err)
 	}
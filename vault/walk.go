@@ -0,0 +1,138 @@
+package vault
+
+import (
+	"container/heap"
+	"sync"
+)
+
+//Walk walks the tree under path just like ConstructSecrets, but instead of
+// building the whole tree up in memory, it hands each secret to fn as soon as
+// all of its versions have been fetched, so that callers can get on with them
+// straight away. fn is only ever called by one worker at a time. If fn returns
+// an error, the walk stops and that error is returned.
+//
+//Normally, the secrets arrive in whatever order the workers finish them in.
+// If opts.Ordered is set, they arrive in the order that ConstructSecrets sorts
+// them in, instead; each secret is held back only until everything that sorts
+// before it has been found.
+func (v *Vault) Walk(path string, opts TreeOpts, fn func(SecretEntry) error) error {
+	walkOpts := opts
+	walkOpts.SkipVersionInfo = opts.AllowDeletedSecrets && opts.SkipVersionInfo
+
+	var (
+		lock   sync.Mutex
+		failed error
+	)
+	_, err := v.walkTree(path, walkOpts, func(s SecretEntry) error {
+		found := Secrets{s}
+		if !opts.AllowDeletedSecrets {
+			found.purgeWhereLatestVersionDeleted()
+		}
+		if opts.SkipVersionInfo {
+			found.purgeVersions()
+		}
+		if len(found) == 0 {
+			return nil
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		//The other workers don't stop straight away, so make sure that fn
+		// isn't called again once it has failed
+		if failed == nil {
+			failed = fn(found[0])
+		}
+		return failed
+	})
+	return err
+}
+
+//walkOrder puts the secrets found by the workers of an ordered walk back in
+// order. Every path that is still to be worked could yet turn up secrets at or
+// beneath it, and nothing beneath a path sorts before it, so a secret can be
+// handed over once it sorts before every path that is still to be worked.
+type walkOrder struct {
+	lock  sync.Mutex
+	emit  func(SecretEntry) error
+	ready secretHeap
+	todo  pathHeap
+	//How many times each path in todo is still to be worked. Paths that are
+	// done are only taken out of todo once they get to the top of it
+	counts map[string]int
+}
+
+func newWalkOrder(emit func(SecretEntry) error) *walkOrder {
+	return &walkOrder{emit: emit, counts: map[string]int{}}
+}
+
+//pending notes that path is still to be worked. A nil walkOrder does nothing.
+func (o *walkOrder) pending(path string) {
+	if o == nil {
+		return
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.counts[path]++; o.counts[path] == 1 {
+		heap.Push(&o.todo, path)
+	}
+}
+
+//add holds on to a secret until it is its turn.
+func (o *walkOrder) add(s SecretEntry) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	heap.Push(&o.ready, s)
+	return nil
+}
+
+//finished notes that path has been worked, and hands over every secret that
+// can now be. A nil walkOrder does nothing.
+func (o *walkOrder) finished(path string) error {
+	if o == nil {
+		return nil
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.counts[path]--; o.counts[path] <= 0 {
+		delete(o.counts, path)
+	}
+
+	for o.ready.Len() > 0 {
+		for o.todo.Len() > 0 && o.counts[o.todo[0]] == 0 {
+			heap.Pop(&o.todo)
+		}
+		if o.todo.Len() > 0 && !PathLessThan(o.ready[0].Path, o.todo[0]) {
+			break
+		}
+		if err := o.emit(heap.Pop(&o.ready).(SecretEntry)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type secretHeap []SecretEntry
+
+func (h secretHeap) Len() int            { return len(h) }
+func (h secretHeap) Less(i, j int) bool  { return PathLessThan(h[i].Path, h[j].Path) }
+func (h secretHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *secretHeap) Push(x interface{}) { *h = append(*h, x.(SecretEntry)) }
+func (h *secretHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+type pathHeap []string
+
+func (h pathHeap) Len() int            { return len(h) }
+func (h pathHeap) Less(i, j int) bool  { return PathLessThan(h[i], h[j]) }
+func (h pathHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *pathHeap) Push(x interface{}) { *h = append(*h, x.(string)) }
+func (h *pathHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,101 @@
+package vault_test
+
+import (
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/safe/vault"
+)
+
+var _ = Describe("Walking a tree", func() {
+	var (
+		fake  *fakeVault
+		paths []string
+	)
+
+	BeforeEach(func() {
+		fake = newFakeVault()
+		paths = nil
+		add := func(path string) {
+			fake.set(path, map[string]string{"key": path})
+			paths = append(paths, "secret/"+path)
+		}
+		for a := 0; a < 6; a++ {
+			for b := 0; b < 6; b++ {
+				add(fmt.Sprintf("tree/a%d/b%d", a, b))
+			}
+		}
+		//Secrets that are directories, too
+		add("tree/a2")
+		add("tree/a2/b1/c")
+		add("tree/a2/b1/c/d")
+		sort.Slice(paths, func(i, j int) bool { return vault.PathLessThan(paths[i], paths[j]) })
+
+		//Answer in a jumble, so that the workers finish out of order
+		var lock sync.Mutex
+		jitter := mathrand.New(mathrand.NewSource(GinkgoRandomSeed()))
+		fake.respond = func(r *http.Request) (int, string) {
+			lock.Lock()
+			d := time.Duration(jitter.Intn(5)) * time.Millisecond
+			lock.Unlock()
+			time.Sleep(d)
+			return 0, ""
+		}
+	})
+	AfterEach(func() {
+		fake.Close()
+	})
+
+	walk := func(fn func(vault.SecretEntry) error) error {
+		v := fake.vault(vault.VaultConfig{Workers: 16})
+		return v.Walk("secret/tree", vault.TreeOpts{FetchKeys: true, Ordered: true}, fn)
+	}
+
+	It("hands over every secret in order, however the workers finish", func() {
+		var got []string
+		Expect(walk(func(s vault.SecretEntry) error {
+			got = append(got, s.Path)
+			Expect(s.LatestVersion().Data.Get("key")).To(Equal(s.Path[len("secret/"):]))
+			return nil
+		})).To(Succeed())
+		Expect(got).To(Equal(paths))
+	})
+
+	It("hands over secrets that are directories too, before what is under them", func() {
+		var got []string
+		Expect(walk(func(s vault.SecretEntry) error {
+			got = append(got, s.Path)
+			return nil
+		})).To(Succeed())
+		index := map[string]int{}
+		for i, path := range got {
+			index[path] = i
+		}
+		Expect(index).To(HaveKey("secret/tree/a2"))
+		Expect(index["secret/tree/a2"]).To(BeNumerically("<", index["secret/tree/a2/b0"]))
+		Expect(index["secret/tree/a2/b1"]).To(BeNumerically("<", index["secret/tree/a2/b1/c"]))
+		Expect(index["secret/tree/a2/b1/c"]).To(BeNumerically("<", index["secret/tree/a2/b1/c/d"]))
+		Expect(index["secret/tree/a2/b1/c/d"]).To(BeNumerically("<", index["secret/tree/a2/b2"]))
+	})
+
+	It("stops as soon as fn fails", func() {
+		oops := errors.New("oops")
+		calls := 0
+		err := walk(func(s vault.SecretEntry) error {
+			if calls++; calls == 3 {
+				return oops
+			}
+			return nil
+		})
+		Expect(err).To(Equal(oops))
+		Expect(calls).To(Equal(3))
+	})
+})
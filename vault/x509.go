@@ -26,6 +26,8 @@ type X509 struct {
 
 	KeyUsage    x509.KeyUsage
 	ExtKeyUsage []x509.ExtKeyUsage
+
+	cas casInfo
 }
 
 func (s Secret) X509(requireKey bool) (*X509, error) {
@@ -114,6 +116,7 @@ func (s Secret) X509(requireKey bool) (*X509, error) {
 		PrivateKey:     key,
 		KeyUsage:       cert.KeyUsage,
 		ExtKeyUsage:    cert.ExtKeyUsage,
+		cas:            s.cas,
 	}
 
 	if s.Has("serial") {
@@ -561,6 +564,7 @@ func (x *X509) MakeCA() {
 
 func (x X509) Secret(skipIfExists bool) (*Secret, error) {
 	s := NewSecret()
+	s.cas = x.cas
 
 	cert := string(pem.EncodeToMemory(&pem.Block{
 		Type:  "CERTIFICATE",